@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fsd/internal/config"
 	"fsd/internal/routes"
 	"fsd/pkg/ipc"
+	"fsd/pkg/pipeline"
 	"fsd/pkg/tasks"
 	"net/http"
 	"os"
@@ -31,7 +33,7 @@ func init() {
 	config.InitConfig()
 }
 
-func processEventStream(ctx context.Context, watcher *fsnotify.Watcher, broadcaster *ipc.Broadcaster) {
+func processEventStream(ctx context.Context, watcher *fsnotify.Watcher, events chan<- tasks.FsMessage) {
 	for {
 		select {
 		case event, ok := <-watcher.Events:
@@ -41,7 +43,11 @@ func processEventStream(ctx context.Context, watcher *fsnotify.Watcher, broadcas
 			}
 
 			zap.L().Info("Received event", zap.String("event", event.String()))
-			broadcaster.Broadcast(tasks.NewFromINotifyEvent(event))
+			select {
+			case events <- tasks.NewFromINotifyEvent(event):
+			case <-ctx.Done():
+				return
+			}
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				zap.L().Error("Failed to receive watcher error")
@@ -86,6 +92,24 @@ func dbContext(db *sql.DB) func(next http.Handler) http.Handler {
 	}
 }
 
+func watcherContext(watcher *fsnotify.Watcher) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "watcher", watcher)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func broadcasterContext(broadcaster *ipc.Broadcaster) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "broadcaster", broadcaster)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 func runApp() {
 	zap.L().Info("Starting up")
 	zap.L().Debug("config", zap.Any("config", config.GetConfig()))
@@ -118,23 +142,53 @@ func runApp() {
 	// Set up background threads
 	broadcaster := ipc.NewBroadcaster()
 	registry := tasks.NewTaskRegistry()
-	registry.Init(
-		rootPath,
-		broadcaster,
-		watcher,
+	taskNames := []string{
 		tasks.FsTaskName(),
 		tasks.MetadataTaskName(),
 		tasks.CompactionTaskName(),
 		tasks.ProcTaskName(),
-	)
+		tasks.WebhookTaskName(),
+		tasks.UsageTaskName(),
+	}
+	if config.GetConfig().HashingEnabled {
+		taskNames = append(taskNames, tasks.HashTaskName())
+	}
+	if config.GetConfig().ScrubEnabled {
+		// Scrubbing checks files against the hashes the hash task stores, so it only covers
+		// whatever was hashed while it was on
+		if !config.GetConfig().HashingEnabled {
+			zap.L().Warn("scrub_enabled is set without hashing_enabled, only files that were already hashed will be scrubbed")
+		}
+		taskNames = append(taskNames, tasks.ScrubTaskName())
+	}
+	if len(config.GetConfig().FimPaths) > 0 {
+		taskNames = append(taskNames, tasks.FimTaskName())
+	}
+	registry.Init(rootPath, broadcaster, watcher, taskNames...)
 	registry.Run(ctx)
 
-	go processEventStream(ctx, watcher, broadcaster)
+	// Raw events are cleaned up on their way to the broadcaster
+	var stages []pipeline.Stage
+	if config.GetConfig().RenamePairWindow > 0 {
+		stages = append(stages, pipeline.NewRenamePairer(config.GetConfig().RenamePairWindow))
+	}
+	if config.GetConfig().CoalesceWindow > 0 {
+		stages = append(stages, pipeline.NewCoalescer(config.GetConfig().CoalesceWindow))
+	}
+	if config.GetConfig().SettleQuietPeriod > 0 {
+		stages = append(stages, pipeline.NewSettler(config.GetConfig().SettleQuietPeriod))
+	}
+
+	events := pipeline.Run(ctx, broadcaster, stages...)
+	go processEventStream(ctx, watcher, events)
 
-	err = watcher.Add(rootPath)
+	// Watch everything that already exists under the root, new directories are picked up as
+	// their Create events arrive.
+	watched, err := tasks.WatchRecursive(watcher, rootPath)
 	if err != nil {
 		zap.L().Fatal("failed to watch directory", zap.String("dirname", rootPath), zap.Error(err))
 	}
+	zap.L().Info("watching directories", zap.String("root", rootPath), zap.Int("count", watched))
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
@@ -148,6 +202,8 @@ func runApp() {
 	// Spin up the web server
 	r := chi.NewRouter()
 	r.Use(dbContext(db))
+	r.Use(watcherContext(watcher))
+	r.Use(broadcasterContext(broadcaster))
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Recoverer)
@@ -182,6 +238,8 @@ func runApp() {
 		zap.L().Info("Received shutdown signal")
 		// Cancel background threads
 		cancel()
+		broadcaster.FlushLog()
+		broadcaster.FlushOffsets()
 
 		// Shutdown the web server
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -198,20 +256,33 @@ func runApp() {
 
 func main() {
 	// Parse command-line flags
-	metadataUpdateInterval := flag.Duration("metadata-update-interval", config.GetConfig().MetadataUpdateInterval, "Metadata update interval")
+	metadataUpdateInterval := flag.Duration("metadata-update-interval", 0, "Deprecated: metadata is kept up to date from events, see -metadata-reconcile-interval")
+	metadataReconcileInterval := flag.Duration("metadata-reconcile-interval", config.GetConfig().MetadataReconcileInterval, "Metadata reconciliation interval")
 	compactionInterval := flag.Duration("compaction-interval", config.GetConfig().CompactionInterval, "Compaction interval")
 	broadcastBufferDepth := flag.Int("broadcast-buffer-depth", config.GetConfig().BroadcastBufferDepth, "Broadcast buffer depth")
 	listenAddr := flag.String("listen-addr", config.GetConfig().ListenAddr, "Listen address")
 	watchDir := flag.String("watch-dir", config.GetConfig().WatchDir, "Watch directory")
+	coalesceWindow := flag.Duration("coalesce-window", config.GetConfig().CoalesceWindow, "Event coalescing window, 0 to disable")
 	flag.Parse()
 
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "metadata-update-interval" {
+			zap.L().Warn("-metadata-update-interval is deprecated and ignored, metadata is kept up to date from events",
+				zap.Duration("value", *metadataUpdateInterval))
+		}
+	})
+
 	// Update config with flag values
 	cfg := config.GetConfig()
-	cfg.MetadataUpdateInterval = *metadataUpdateInterval
+	cfg.MetadataReconcileInterval = *metadataReconcileInterval
 	cfg.CompactionInterval = *compactionInterval
 	cfg.BroadcastBufferDepth = *broadcastBufferDepth
 	cfg.ListenAddr = *listenAddr
 	cfg.WatchDir = *watchDir
+	cfg.CoalesceWindow = *coalesceWindow
+	if err := errors.Join(cfg.Validate(), ipc.ValidatePolicies(cfg)); err != nil {
+		zap.L().Fatal("invalid config", zap.Error(err))
+	}
 
 	runApp()
 }
@@ -2,9 +2,13 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"maps"
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,13 +16,63 @@ import (
 	"go.uber.org/zap"
 )
 
+// WebhookConfig is a single outbound webhook target.
+type WebhookConfig struct {
+	// Name identifies the target in logs and the delivery tables, defaulting to the URL
+	Name string `toml:"name"`
+	URL  string `toml:"url"`
+
+	// Prefixes, Globs and Ops select the filesystem events to send. Empty ops means every
+	// filesystem operation.
+	Prefixes []string `toml:"prefixes"`
+	Globs    []string `toml:"globs"`
+	Ops      []string `toml:"ops"`
+
+	// ProcCompletion sends a message whenever a proc finishes
+	ProcCompletion bool `toml:"proc_completion"`
+
+	// Secret, if set, signs each request body with HMAC-SHA256
+	Secret string `toml:"secret"`
+}
+
 type Config struct {
-	MetadataUpdateInterval  time.Duration `toml:"metadata_update_interval"`
-	CompactionInterval      time.Duration `toml:"compaction_interval"`
-	DiskStatsUpdateInterval time.Duration `toml:"disk_stats_update_interval"`
-	BroadcastBufferDepth    int           `toml:"broadcast_buffer_depth"`
-	ListenAddr              string        `toml:"listen_addr"`
-	WatchDir                string        `toml:"watch_dir"`
+	MetadataReconcileInterval time.Duration     `toml:"metadata_reconcile_interval"`
+	CompactionInterval        time.Duration     `toml:"compaction_interval"`
+	HistoryRetention          time.Duration     `toml:"history_retention"`
+	DiskStatsUpdateInterval   time.Duration     `toml:"disk_stats_update_interval"`
+	UsageSnapshotInterval     time.Duration     `toml:"usage_snapshot_interval"`
+	UsageRetention            time.Duration     `toml:"usage_retention"`
+	UsageLargestFiles         int               `toml:"usage_largest_files"`
+	HashingEnabled            bool              `toml:"hashing_enabled"`
+	HashRateLimit             int               `toml:"hash_rate_limit"`
+	HashScanInterval          time.Duration     `toml:"hash_scan_interval"`
+	ScrubEnabled              bool              `toml:"scrub_enabled"`
+	ScrubInterval             time.Duration     `toml:"scrub_interval"`
+	FimPaths                  []string          `toml:"fim_paths"`
+	FimCheckInterval          time.Duration     `toml:"fim_check_interval"`
+	ProcTimeout               time.Duration     `toml:"proc_timeout"`
+	ProcRecovery              string            `toml:"proc_recovery"`
+	ProcKillGrace             time.Duration     `toml:"proc_kill_grace"`
+	ProcLogRetention          time.Duration     `toml:"proc_log_retention"`
+	ProcDefaultConcurrency    int               `toml:"proc_default_concurrency"`
+	ProcConcurrency           map[string]int    `toml:"proc_concurrency"`
+	BroadcastBufferDepth      int               `toml:"broadcast_buffer_depth"`
+	BroadcastPolicy           string            `toml:"broadcast_policy"`
+	BroadcastBlockTimeout     time.Duration     `toml:"broadcast_block_timeout"`
+	SubscriberPolicies        map[string]string `toml:"subscriber_policies"`
+	EventLogRetention         time.Duration     `toml:"event_log_retention"`
+	RenamePairWindow          time.Duration     `toml:"rename_pair_window"`
+	SettleQuietPeriod         time.Duration     `toml:"settle_quiet_period"`
+	CoalesceWindow            time.Duration     `toml:"coalesce_window"`
+	WebsocketEventRate        float64           `toml:"websocket_event_rate"`
+	WebsocketEventBurst       int               `toml:"websocket_event_burst"`
+	WebhookTimeout            time.Duration     `toml:"webhook_timeout"`
+	WebhookMaxAttempts        int               `toml:"webhook_max_attempts"`
+	WebhookMaxBackoff         time.Duration     `toml:"webhook_max_backoff"`
+	Webhooks                  []WebhookConfig   `toml:"webhooks"`
+	ListenAddr                string            `toml:"listen_addr"`
+	AllowedOrigins            []string          `toml:"allowed_origins"`
+	WatchDir                  string            `toml:"watch_dir"`
 }
 
 var (
@@ -27,12 +81,121 @@ var (
 )
 
 var DEFAULT_CONFIG = Config{
-	MetadataUpdateInterval:  500 * time.Millisecond,
-	CompactionInterval:      1 * time.Minute,
-	DiskStatsUpdateInterval: 5 * time.Second,
-	BroadcastBufferDepth:    1000,
-	ListenAddr:              "localhost:16000",
-	WatchDir:                "/tmp/fsd",
+	MetadataReconcileInterval: 5 * time.Minute,
+	CompactionInterval:        1 * time.Minute,
+	HistoryRetention:          30 * 24 * time.Hour,
+	DiskStatsUpdateInterval:   5 * time.Second,
+	UsageSnapshotInterval:     15 * time.Minute,
+	UsageRetention:            90 * 24 * time.Hour,
+	UsageLargestFiles:         10,
+	HashingEnabled:            false,
+	HashRateLimit:             32 << 20,
+	HashScanInterval:          10 * time.Minute,
+	ScrubEnabled:              false,
+	ScrubInterval:             7 * 24 * time.Hour,
+	FimPaths:                  []string{},
+	FimCheckInterval:          1 * time.Hour,
+	ProcTimeout:               0,
+	ProcRecovery:              "fail",
+	ProcKillGrace:             10 * time.Second,
+	ProcLogRetention:          30 * 24 * time.Hour,
+	ProcDefaultConcurrency:    2,
+	ProcConcurrency:           map[string]int{},
+	BroadcastBufferDepth:      1000,
+	BroadcastPolicy:           "drop-oldest",
+	BroadcastBlockTimeout:     5 * time.Second,
+	SubscriberPolicies:        map[string]string{},
+	EventLogRetention:         24 * time.Hour,
+	RenamePairWindow:          100 * time.Millisecond,
+	SettleQuietPeriod:         5 * time.Second,
+	CoalesceWindow:            250 * time.Millisecond,
+	WebsocketEventRate:        200,
+	WebsocketEventBurst:       400,
+	WebhookTimeout:            10 * time.Second,
+	WebhookMaxAttempts:        8,
+	WebhookMaxBackoff:         10 * time.Minute,
+	Webhooks:                  []WebhookConfig{},
+	ListenAddr:                "localhost:16000",
+	AllowedOrigins:            []string{},
+	WatchDir:                  "/tmp/fsd",
+}
+
+// defaultConfig returns a copy of DEFAULT_CONFIG that can be changed without changing it.
+func defaultConfig() Config {
+	config := DEFAULT_CONFIG
+	config.FimPaths = slices.Clone(DEFAULT_CONFIG.FimPaths)
+	config.AllowedOrigins = slices.Clone(DEFAULT_CONFIG.AllowedOrigins)
+	config.ProcConcurrency = maps.Clone(DEFAULT_CONFIG.ProcConcurrency)
+	config.SubscriberPolicies = maps.Clone(DEFAULT_CONFIG.SubscriberPolicies)
+	config.Webhooks = make([]WebhookConfig, len(DEFAULT_CONFIG.Webhooks))
+	for i, webhook := range DEFAULT_CONFIG.Webhooks {
+		webhook.Prefixes = slices.Clone(webhook.Prefixes)
+		webhook.Globs = slices.Clone(webhook.Globs)
+		webhook.Ops = slices.Clone(webhook.Ops)
+		config.Webhooks[i] = webhook
+	}
+
+	return config
+}
+
+// Validate reports every setting that fsd can't run with.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.BroadcastBlockTimeout <= 0 {
+		errs = append(errs, errors.New("broadcast_block_timeout must be positive"))
+	}
+	if c.MetadataReconcileInterval <= 0 {
+		errs = append(errs, errors.New("metadata_reconcile_interval must be positive"))
+	}
+	if c.DiskStatsUpdateInterval <= 0 {
+		errs = append(errs, errors.New("disk_stats_update_interval must be positive"))
+	}
+	if c.HashScanInterval <= 0 {
+		errs = append(errs, errors.New("hash_scan_interval must be positive"))
+	}
+	if c.UsageSnapshotInterval <= 0 {
+		errs = append(errs, errors.New("usage_snapshot_interval must be positive"))
+	}
+	if c.ScrubInterval <= 0 {
+		errs = append(errs, errors.New("scrub_interval must be positive"))
+	}
+	if c.FimCheckInterval <= 0 {
+		errs = append(errs, errors.New("fim_check_interval must be positive"))
+	}
+	if root, err := filepath.Abs(c.WatchDir); err != nil {
+		errs = append(errs, fmt.Errorf("invalid watch_dir: %w", err))
+	} else {
+		// Only the watch directory gets events, so anything outside it would never be checked
+		for _, path := range c.FimPaths {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(root, path)
+			}
+			path = filepath.Clean(path)
+			if path != root && !strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/") {
+				errs = append(errs, fmt.Errorf("fim_paths entry %s is outside of watch_dir %s", path, root))
+			}
+		}
+	}
+	if c.ProcRecovery != "fail" && c.ProcRecovery != "requeue" {
+		errs = append(errs, fmt.Errorf("invalid proc_recovery: %q, wanted fail or requeue", c.ProcRecovery))
+	}
+	if c.ProcKillGrace <= 0 {
+		errs = append(errs, errors.New("proc_kill_grace must be positive, or cancelled procs that ignore SIGTERM are never killed"))
+	}
+	if c.WebhookMaxAttempts <= 0 {
+		errs = append(errs, errors.New("webhook_max_attempts must be positive"))
+	}
+	if c.WebhookMaxBackoff <= 0 {
+		errs = append(errs, errors.New("webhook_max_backoff must be positive"))
+	}
+	if c.RenamePairWindow < 0 {
+		errs = append(errs, errors.New("rename_pair_window can't be negative, 0 turns off rename pairing"))
+	}
+	if c.SettleQuietPeriod < 0 {
+		errs = append(errs, errors.New("settle_quiet_period can't be negative, 0 turns off Settled events"))
+	}
+
+	return errors.Join(errs...)
 }
 
 // InitConfig initializes the global config
@@ -84,17 +247,20 @@ func loadConfig() *Config {
 		}
 
 		zap.L().Info("created default config file", zap.String("path", configFilePath))
-		return &DEFAULT_CONFIG
+		config := defaultConfig()
+		return &config
 	}
 
 	zap.L().Info("using existing config file", zap.String("path", configFilePath))
 
-	// Attempt to decode the existing config file
-	var config Config
+	// Attempt to decode the existing config file on top of the defaults, so that keys missing
+	// from older config files keep their default values.
+	config := defaultConfig()
 	if _, err := toml.DecodeFile(configFilePath, &config); err != nil {
 		// If decoding fails, log a warning and return the default configuration
 		zap.L().Warn("failed to decode config file, using default config", zap.Error(err))
-		return &DEFAULT_CONFIG
+		config = defaultConfig()
+		return &config
 	}
 
 	// Return the successfully loaded configuration
@@ -109,3 +275,32 @@ func GetDBPath() string {
 
 	return filepath.Join(currentUser.HomeDir, ".fsd", "fsd.db")
 }
+
+func GetSpillDir() string {
+	currentUser, err := user.Current()
+	if err != nil {
+		zap.L().Fatal("failed to get current user", zap.Error(err))
+	}
+
+	return filepath.Join(currentUser.HomeDir, ".fsd", "spill")
+}
+
+// GetFimKeyPath returns the path of the ed25519 key that integrity reports are signed with.
+func GetFimKeyPath() string {
+	currentUser, err := user.Current()
+	if err != nil {
+		zap.L().Fatal("failed to get current user", zap.Error(err))
+	}
+
+	return filepath.Join(currentUser.HomeDir, ".fsd", "fim_ed25519.pem")
+}
+
+// GetProcLogDir returns the directory that procs write their output to as they run.
+func GetProcLogDir() string {
+	currentUser, err := user.Current()
+	if err != nil {
+		zap.L().Fatal("failed to get current user", zap.Error(err))
+	}
+
+	return filepath.Join(currentUser.HomeDir, ".fsd", "logs")
+}
@@ -0,0 +1,68 @@
+package routes
+
+import (
+	"database/sql"
+	"fmt"
+	"fsd/internal/resp"
+	"fsd/pkg/tasks"
+	"net/http"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// defaultDuplicateMinSize leaves out empty files, which are all identical
+const defaultDuplicateMinSize = 1
+
+type DuplicatesController struct{}
+
+// GetDuplicates lists groups of files with identical content, most reclaimable bytes first.
+// Files that haven't been hashed yet are hashed on the spot, but only if they share their size
+// with another file, so the first request over a large tree can take a while.
+//
+//	prefix    only look beneath this directory, may be repeated
+//	glob      full path or file name pattern, may be repeated
+//	min_size  smallest file to consider in bytes, 1 by default
+//	limit     most groups to return
+func (d *DuplicatesController) GetDuplicates(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+	query := r.URL.Query()
+
+	for _, glob := range query["glob"] {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			resp.NewBadRequestResponse(w, r, fmt.Sprintf("invalid glob %q: %s", glob, err))
+			return
+		}
+	}
+
+	minSize, err := parseInt64Param(r, "min_size")
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+	if minSize == nil {
+		size := int64(defaultDuplicateMinSize)
+		minSize = &size
+	}
+
+	limit, err := parseUintParam(r, "limit", defaultEventsLimit)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+	limit = min(limit, maxEventsLimit)
+
+	groups, err := tasks.FindDuplicates(r.Context(), db, tasks.DuplicateQuery{
+		Prefixes: query["prefix"],
+		Globs:    query["glob"],
+		MinSize:  *minSize,
+		Limit:    int(limit),
+	})
+	if err != nil {
+		zap.L().Error("failed to find duplicates", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to find duplicates")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, groups)
+}
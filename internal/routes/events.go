@@ -0,0 +1,214 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"fsd/internal/resp"
+	"fsd/pkg/ipc"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+
+	// streamKeepAlive is how often an idle stream gets a comment line, so proxies don't time
+	// out the connection
+	streamKeepAlive = 15 * time.Second
+)
+
+// connectionCounter numbers streaming connections so each gets its own subscriber identifier.
+var connectionCounter atomic.Uint64
+
+func nextConnectionID(kind string) string {
+	return fmt.Sprintf("%s-%d", kind, connectionCounter.Add(1))
+}
+
+type EventsController struct{}
+
+type EventsPage struct {
+	Events  []ipc.Event `json:"events"`
+	LastSeq uint64      `json:"last_seq"`
+}
+
+// GetEvents returns logged events after the `after` sequence number, so a client that was
+// offline can catch up on what it missed. Pass the seq of the last event received as `after`
+// to get the next page.
+func (e *EventsController) GetEvents(w http.ResponseWriter, r *http.Request) {
+	broadcaster := r.Context().Value("broadcaster").(*ipc.Broadcaster)
+
+	after, err := parseUintParam(r, "after", 0)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+
+	limit, err := parseUintParam(r, "limit", defaultEventsLimit)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+	limit = min(limit, maxEventsLimit)
+
+	events, err := broadcaster.ReadLog(r.Context(), after, int(limit))
+	if err != nil {
+		zap.L().Error("failed to read event log", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to read event log")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, EventsPage{
+		Events:  events,
+		LastSeq: broadcaster.LastSeq(),
+	})
+}
+
+// parseUintParam reads an optional non-negative integer query parameter.
+func parseUintParam(r *http.Request, name string, fallback uint64) (uint64, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+
+	v, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, raw)
+	}
+
+	return v, nil
+}
+
+// parseFilter builds an event filter from the `prefix`, `glob` and `op` query parameters. Each
+// may be repeated, and `op` also takes a comma-separated list.
+func parseFilter(r *http.Request) (ipc.Filter, error) {
+	query := r.URL.Query()
+	filter := ipc.Filter{
+		Prefixes: query["prefix"],
+		Globs:    query["glob"],
+	}
+
+	for _, ops := range query["op"] {
+		for _, name := range strings.Split(ops, ",") {
+			if name == "" {
+				continue
+			}
+
+			op, err := ipc.ParseFsdOp(name)
+			if err != nil {
+				return filter, err
+			}
+
+			if filter.Operations == nil {
+				filter.Operations = make(map[ipc.FsdOp]bool)
+			}
+			filter.Operations[op] = true
+		}
+	}
+
+	return filter, nil
+}
+
+// StreamEvents pushes broadcast messages to the client as Server-Sent Events until it goes
+// away. Each event's id is its sequence number, so a reconnecting client that sends
+// Last-Event-ID (or `last_event_id`) is caught up on anything it missed first.
+func (e *EventsController) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	broadcaster := r.Context().Value("broadcaster").(*ipc.Broadcaster)
+
+	filter, err := parseFilter(r)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		resp.NewInternalServerErrorResponse(w, r, "streaming is not supported")
+		return
+	}
+
+	// A slow client should lose its oldest events rather than hold up everyone else
+	id := nextConnectionID("sse")
+	var ch chan ipc.Message
+	if lastEventID != "" {
+		after, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			resp.NewBadRequestResponse(w, r, fmt.Sprintf("invalid Last-Event-ID: %s", lastEventID))
+			return
+		}
+		ch = broadcaster.SubscribeFrom(id, ipc.DropOldest, after)
+	} else {
+		ch = broadcaster.SubscribeWithPolicy(id, ipc.DropOldest)
+	}
+	defer broadcaster.Unsubscribe(ch)
+
+	zap.L().Info("event stream opened", zap.String("receiver", id), zap.String("last event id", lastEventID))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			if !filter.Match(msg) {
+				continue
+			}
+
+			if err := writeServerSentEvent(w, msg); err != nil {
+				zap.L().Info("event stream closed", zap.String("receiver", id), zap.Error(err))
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			zap.L().Info("event stream closed", zap.String("receiver", id))
+			return
+		}
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, msg ipc.Message) error {
+	event, ok := msg.(ipc.Event)
+	if !ok {
+		event = ipc.Event{Timestamp: time.Now(), Message: msg}
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if event.Seq != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.Seq); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.EventOperation(), data)
+	return err
+}
@@ -0,0 +1,307 @@
+package routes
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fsd/internal/config"
+	"fsd/internal/resp"
+	"fsd/pkg/fim"
+	"fsd/pkg/tasks"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.uber.org/zap"
+)
+
+type FimController struct{}
+
+// FimReport is a signed report as stored.
+type FimReport struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	fim.SignedReport
+}
+
+// FimBaseline is the result of capturing a new baseline.
+type FimBaseline struct {
+	Paths      []string  `json:"paths"`
+	Entries    int       `json:"entries"`
+	CapturedAt time.Time `json:"captured_at"`
+}
+
+// FimVerifyRequest is a report to check, as it was returned when it was created.
+type FimVerifyRequest struct {
+	Report    json.RawMessage `json:"report"`
+	Signature []byte          `json:"signature"`
+}
+
+// Bind implements render.Binder.
+func (f *FimVerifyRequest) Bind(r *http.Request) error {
+	if len(f.Report) == 0 {
+		return errors.New("report is required")
+	}
+
+	if len(f.Signature) == 0 {
+		return errors.New("signature is required")
+	}
+
+	return nil
+}
+
+// FimKey is the public key reports are signed with, base64 encoded as JSON.
+type FimKey struct {
+	PublicKey ed25519.PublicKey `json:"public_key"`
+}
+
+// FimVerification is whether a report was signed by this host's key.
+type FimVerification struct {
+	Valid     bool              `json:"valid"`
+	PublicKey ed25519.PublicKey `json:"public_key"`
+}
+
+// fimPaths returns the monitored paths, or writes an error and returns nothing if integrity
+// monitoring is off.
+func fimPaths(w http.ResponseWriter, r *http.Request) []string {
+	root, err := filepath.Abs(config.GetConfig().WatchDir)
+	if err != nil {
+		resp.NewInternalServerErrorResponse(w, r, "failed to resolve watch directory")
+		return nil
+	}
+
+	paths := tasks.FimPaths(root)
+	if len(paths) == 0 {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, "integrity monitoring is not enabled, set fim_paths")
+		return nil
+	}
+
+	return paths
+}
+
+// GetFimChanges returns everything that currently differs from the baseline, unsigned.
+func (f *FimController) GetFimChanges(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	paths := fimPaths(w, r)
+	if paths == nil {
+		return
+	}
+
+	report, err := tasks.FindFimChanges(r.Context(), db, paths)
+	if err != nil {
+		zap.L().Error("failed to find fim changes", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to find fim changes")
+		return
+	}
+	report.GeneratedAt = time.Now()
+
+	resp.NewSuccessResponse(w, r, report)
+}
+
+// CaptureFimBaseline accepts the current state of the monitored paths as the new baseline,
+// clearing every recorded change. Everything is hashed again, so this can take a while. It has
+// to be sent as JSON, so that another site can't get a browser to send it.
+func (f *FimController) CaptureFimBaseline(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	if !allowedChange(r) {
+		resp.NewErrorResponse(w, r, http.StatusForbidden, "capturing a baseline needs Content-Type: application/json from an allowed origin")
+		return
+	}
+
+	paths := fimPaths(w, r)
+	if paths == nil {
+		return
+	}
+
+	entries, err := tasks.CaptureFimBaseline(r.Context(), db, paths)
+	if err != nil {
+		zap.L().Error("failed to capture fim baseline", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to capture fim baseline")
+		return
+	}
+
+	resp.NewCreatedResponse(w, r, FimBaseline{
+		Paths:      paths,
+		Entries:    entries,
+		CapturedAt: time.Now(),
+	})
+}
+
+// CreateFimReport signs a report of everything that currently differs from the baseline, and
+// keeps it so it can be fetched and verified later.
+func (f *FimController) CreateFimReport(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	paths := fimPaths(w, r)
+	if paths == nil {
+		return
+	}
+
+	key, err := fim.LoadOrCreateKey(config.GetFimKeyPath())
+	if err != nil {
+		zap.L().Error("failed to load fim signing key", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to load signing key")
+		return
+	}
+
+	report, err := tasks.FindFimChanges(r.Context(), db, paths)
+	if err != nil {
+		zap.L().Error("failed to find fim changes", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to find fim changes")
+		return
+	}
+
+	report.GeneratedAt = time.Now()
+
+	signed, err := fim.Sign(key, report)
+	if err != nil {
+		zap.L().Error("failed to sign fim report", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to sign report")
+		return
+	}
+
+	stored := FimReport{CreatedAt: report.GeneratedAt, SignedReport: signed}
+	result, err := db.ExecContext(r.Context(), `
+		INSERT INTO fim_reports (report, signature, public_key, created_at) VALUES (?, ?, ?, ?)
+	`, string(signed.Report), signed.Signature, []byte(signed.PublicKey), stored.CreatedAt)
+	if err != nil {
+		zap.L().Error("failed to insert into fim_reports", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to store report")
+		return
+	}
+
+	stored.ID, err = result.LastInsertId()
+	if err != nil {
+		zap.L().Error("failed to get last insert id", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to store report")
+		return
+	}
+
+	resp.NewCreatedResponse(w, r, stored)
+}
+
+func scanFimReport(row interface{ Scan(...any) error }) (FimReport, error) {
+	var report FimReport
+	var body string
+	var publicKey []byte
+	err := row.Scan(&report.ID, &body, &report.Signature, &publicKey, &report.CreatedAt)
+	report.Report = json.RawMessage(body)
+	report.PublicKey = publicKey
+	return report, err
+}
+
+// GetFimReports returns the stored reports, newest first.
+func (f *FimController) GetFimReports(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	if paths := fimPaths(w, r); paths == nil {
+		return
+	}
+
+	limit, err := parseUintParam(r, "limit", defaultEventsLimit)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+	limit = min(limit, maxEventsLimit)
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, report, signature, public_key, created_at FROM fim_reports
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		zap.L().Error("failed to send database query", zap.String("table name", "fim_reports"), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to send database query")
+		return
+	}
+	defer rows.Close()
+
+	reports := []FimReport{}
+	for rows.Next() {
+		report, err := scanFimReport(rows)
+		if err != nil {
+			zap.L().Error("failed to scan fim report", zap.Error(err))
+			resp.NewInternalServerErrorResponse(w, r, "failed to scan fim reports")
+			return
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		zap.L().Error("failed to scan fim report", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to scan fim reports")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, reports)
+}
+
+// GetFimReport returns a single stored report.
+func (f *FimController) GetFimReport(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	if paths := fimPaths(w, r); paths == nil {
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	report, err := scanFimReport(db.QueryRowContext(r.Context(), `
+		SELECT id, report, signature, public_key, created_at FROM fim_reports WHERE id = ?
+	`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, fmt.Sprintf("no report with id %s", id))
+		return
+	}
+	if err != nil {
+		zap.L().Error("failed to scan fim report", zap.String("id", id), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to scan fim report")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, report)
+}
+
+// GetFimKey returns the public half of the key reports are signed with, for verifying them
+// somewhere else.
+func (f *FimController) GetFimKey(w http.ResponseWriter, r *http.Request) {
+	key, err := fim.LoadOrCreateKey(config.GetFimKeyPath())
+	if err != nil {
+		zap.L().Error("failed to load fim signing key", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to load signing key")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, FimKey{PublicKey: key.Public().(ed25519.PublicKey)})
+}
+
+// VerifyFimReport checks that a report was signed by this host's key and hasn't been altered
+// since.
+func (f *FimController) VerifyFimReport(w http.ResponseWriter, r *http.Request) {
+	var req FimVerifyRequest
+	if err := render.Bind(r, &req); err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+
+	key, err := fim.LoadOrCreateKey(config.GetFimKeyPath())
+	if err != nil {
+		zap.L().Error("failed to load fim signing key", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to load signing key")
+		return
+	}
+
+	publicKey := key.Public().(ed25519.PublicKey)
+	valid, err := fim.Verify(publicKey, req.Report, req.Signature)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, FimVerification{Valid: valid, PublicKey: publicKey})
+}
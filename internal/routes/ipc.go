@@ -0,0 +1,16 @@
+package routes
+
+import (
+	"fsd/internal/resp"
+	"fsd/pkg/ipc"
+	"net/http"
+)
+
+type IpcController struct{}
+
+// GetSubscribers reports the delivery counters for every broadcaster subscriber, which is how
+// you tell when a task is falling behind.
+func (i *IpcController) GetSubscribers(w http.ResponseWriter, r *http.Request) {
+	broadcaster := r.Context().Value("broadcaster").(*ipc.Broadcaster)
+	resp.NewSuccessResponse(w, r, broadcaster.Stats())
+}
@@ -3,6 +3,7 @@ package routes
 import (
 	"database/sql"
 	"fsd/internal/config"
+	"fsd/internal/resp"
 	"net/http"
 	"time"
 
@@ -14,28 +15,75 @@ import (
 type MetadataController struct{}
 
 type Metadata struct {
-	ID          int64     `json:"id"`
-	FullPath    string    `json:"full_path"`
-	SizeBytes   int64     `json:"size_bytes"`
-	FileMode    int64     `json:"file_mode"`
-	IsDirectory int       `json:"is_directory"`
-	CreatedAt   time.Time `json:"created_at"`
-	ModifiedAt  time.Time `json:"modified_at"`
+	ID             int64      `json:"id"`
+	FullPath       string     `json:"full_path"`
+	SizeBytes      int64      `json:"size_bytes"`
+	FileMode       int64      `json:"file_mode"`
+	IsDirectory    int        `json:"is_directory"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ModifiedAt     time.Time  `json:"modified_at"`
+	FileType       string     `json:"file_type"`
+	Inode          int64      `json:"inode"`
+	Device         int64      `json:"device"`
+	Nlink          int64      `json:"nlink"`
+	AllocatedBytes int64      `json:"allocated_bytes"`
+	Blocks         int64      `json:"blocks"`
+	Uid            int64      `json:"uid"`
+	Gid            int64      `json:"gid"`
+	Owner          string     `json:"owner"`
+	Group          string     `json:"group"`
+	AccessedAt     *time.Time `json:"accessed_at"`
+	ChangedAt      *time.Time `json:"changed_at"`
+	SymlinkTarget  *string    `json:"symlink_target"`
+	SHA256         *string    `json:"sha256"`
+	XXHash         *string    `json:"xxhash"`
+	HashedAt       *time.Time `json:"hashed_at"`
+}
+
+// metadataColumns are the columns read by scanMetadata, which both metadata tables have.
+const metadataColumns = `
+	id, full_path, size_bytes, file_mode, is_directory, created_at, modified_at,
+	file_type, inode, device, nlink, allocated_bytes, uid, gid, owner_name, group_name,
+	accessed_at, changed_at, symlink_target, sha256, xxhash, hashed_at
+`
+
+func scanMetadata(rows *sql.Rows) (Metadata, error) {
+	var meta Metadata
+	err := rows.Scan(
+		&meta.ID,
+		&meta.FullPath,
+		&meta.SizeBytes,
+		&meta.FileMode,
+		&meta.IsDirectory,
+		&meta.CreatedAt,
+		&meta.ModifiedAt,
+		&meta.FileType,
+		&meta.Inode,
+		&meta.Device,
+		&meta.Nlink,
+		&meta.AllocatedBytes,
+		&meta.Uid,
+		&meta.Gid,
+		&meta.Owner,
+		&meta.Group,
+		&meta.AccessedAt,
+		&meta.ChangedAt,
+		&meta.SymlinkTarget,
+		&meta.SHA256,
+		&meta.XXHash,
+		&meta.HashedAt,
+	)
+
+	// st_blocks is in 512 byte units
+	meta.Blocks = meta.AllocatedBytes / 512
+	return meta, err
 }
 
 func RowsToMetadata(rows *sql.Rows) ([]Metadata, error) {
 	var metas []Metadata
 	for rows.Next() {
-		var meta Metadata
-		if err := rows.Scan(
-			&meta.ID,
-			&meta.FullPath,
-			&meta.SizeBytes,
-			&meta.FileMode,
-			&meta.IsDirectory,
-			&meta.CreatedAt,
-			&meta.ModifiedAt,
-		); err != nil {
+		meta, err := scanMetadata(rows)
+		if err != nil {
 			return nil, err
 		}
 
@@ -49,7 +97,25 @@ func RowsToMetadata(rows *sql.Rows) ([]Metadata, error) {
 	return metas, nil
 }
 
+// GetMetadata lists the metadata snapshots, newest first unless asked otherwise. See
+// parseMetadataQuery for the filters.
 func (m *MetadataController) GetMetadata(w http.ResponseWriter, r *http.Request) {
+	m.listMetadata(w, r, "metadata", "created", true)
+}
+
+// GetLatestMetadata lists the current state of every path, in path order unless asked
+// otherwise. See parseMetadataQuery for the filters.
+func (m *MetadataController) GetLatestMetadata(w http.ResponseWriter, r *http.Request) {
+	m.listMetadata(w, r, "metadata_current", "path", false)
+}
+
+func (m *MetadataController) listMetadata(w http.ResponseWriter, r *http.Request, table string, defaultSort string, defaultDesc bool) {
+	query, err := parseMetadataQuery(r, defaultSort, defaultDesc)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+
 	db, err := sql.Open("sqlite3", config.GetDBPath())
 	if err != nil {
 		zap.L().Error("failed to open metadata database connection", zap.Error(err))
@@ -58,33 +124,73 @@ func (m *MetadataController) GetMetadata(w http.ResponseWriter, r *http.Request)
 	}
 	defer db.Close()
 
-	query := `SELECT * FROM metadata ORDER BY created_at DESC`
-	rows, err := db.Query(query)
+	metadata, next, err := query.run(r.Context(), db, table)
 	if err != nil {
-		zap.L().Error("failed to send database query", zap.Error(err))
+		zap.L().Error("failed to query metadata", zap.String("table name", table), zap.Error(err))
 		render.Status(r, http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	metadata, err := RowsToMetadata(rows)
-	if err != nil {
-		zap.L().Error("failed to parse metadata", zap.Error(err))
-		render.Status(r, http.StatusInternalServerError)
-		return
+	setNextLink(w, r, next)
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, metadata)
+}
+
+type MetadataHistory struct {
+	ID            int64      `json:"id"`
+	FullPath      string     `json:"full_path"`
+	Change        string     `json:"change"`
+	OldPath       *string    `json:"old_path"`
+	IsDirectory   int        `json:"is_directory"`
+	OldSizeBytes  *int64     `json:"old_size_bytes"`
+	NewSizeBytes  *int64     `json:"new_size_bytes"`
+	OldFileMode   *int64     `json:"old_file_mode"`
+	NewFileMode   *int64     `json:"new_file_mode"`
+	OldModifiedAt *time.Time `json:"old_modified_at"`
+	NewModifiedAt *time.Time `json:"new_modified_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+func RowsToMetadataHistory(rows *sql.Rows) ([]MetadataHistory, error) {
+	var history []MetadataHistory
+	for rows.Next() {
+		var h MetadataHistory
+		if err := rows.Scan(
+			&h.ID,
+			&h.FullPath,
+			&h.Change,
+			&h.OldPath,
+			&h.IsDirectory,
+			&h.OldSizeBytes,
+			&h.NewSizeBytes,
+			&h.OldFileMode,
+			&h.NewFileMode,
+			&h.OldModifiedAt,
+			&h.NewModifiedAt,
+			&h.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		history = append(history, h)
 	}
 
-	if len(metadata) == 0 {
-		zap.L().Warn("no metadata found")
-		render.Status(r, http.StatusNotFound)
-		return
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, metadata)
+	return history, nil
 }
 
-func (m *MetadataController) GetLatestMetadata(w http.ResponseWriter, r *http.Request) {
+// GetMetadataHistory returns the timeline of changes for a single path, oldest first. Renames
+// are included whether the path was the source or the destination.
+func (m *MetadataController) GetMetadataHistory(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		resp.NewBadRequestResponse(w, r, "path is required")
+		return
+	}
+
 	db, err := sql.Open("sqlite3", config.GetDBPath())
 	if err != nil {
 		zap.L().Error("failed to open metadata database connection", zap.Error(err))
@@ -93,20 +199,17 @@ func (m *MetadataController) GetLatestMetadata(w http.ResponseWriter, r *http.Re
 	}
 	defer db.Close()
 
-	// Get the most recent metadata for each unique full_path
 	query := `
-		SELECT m.*
-		FROM metadata m
-		INNER JOIN (
-			SELECT full_path, MAX(created_at) as max_created_at
-			FROM metadata
-			GROUP BY full_path
-		) latest
-		ON m.full_path = latest.full_path AND m.created_at = latest.max_created_at
-		ORDER BY m.full_path
+		SELECT
+			id, full_path, change, old_path, is_directory,
+			old_size_bytes, new_size_bytes, old_file_mode, new_file_mode, old_modified_at, new_modified_at,
+			created_at
+		FROM metadata_history
+		WHERE full_path = ? OR old_path = ?
+		ORDER BY id
 	`
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, path, path)
 	if err != nil {
 		zap.L().Error("failed to send database query", zap.Error(err))
 		render.Status(r, http.StatusInternalServerError)
@@ -114,19 +217,19 @@ func (m *MetadataController) GetLatestMetadata(w http.ResponseWriter, r *http.Re
 	}
 	defer rows.Close()
 
-	metadata, err := RowsToMetadata(rows)
+	history, err := RowsToMetadataHistory(rows)
 	if err != nil {
-		zap.L().Error("failed to parse metadata", zap.Error(err))
+		zap.L().Error("failed to parse metadata history", zap.Error(err))
 		render.Status(r, http.StatusInternalServerError)
 		return
 	}
 
-	if len(metadata) == 0 {
-		zap.L().Warn("no metadata found")
+	if len(history) == 0 {
+		zap.L().Warn("no metadata history found", zap.String("path", path))
 		render.Status(r, http.StatusNotFound)
 		return
 	}
 
 	render.Status(r, http.StatusOK)
-	render.JSON(w, r, metadata)
+	render.JSON(w, r, history)
 }
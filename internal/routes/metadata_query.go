@@ -0,0 +1,411 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fsd/pkg/ipc"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadataSortColumns maps the `sort` query parameter onto columns.
+var metadataSortColumns = map[string]string{
+	"path":     "full_path",
+	"size":     "size_bytes",
+	"modified": "modified_at",
+	"created":  "created_at",
+}
+
+// metadataCursor is the position of the last row on a page. The id breaks ties between rows
+// with the same sort value.
+type metadataCursor struct {
+	Value json.RawMessage `json:"v"`
+	ID    int64           `json:"id"`
+}
+
+func (c metadataCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// metadataQuery is the set of filters accepted by the /metadata listing endpoints.
+type metadataQuery struct {
+	prefix         string
+	globs          []string
+	isDirectory    *bool
+	minSize        *int64
+	maxSize        *int64
+	modifiedAfter  *time.Time
+	modifiedBefore *time.Time
+	sha256         string
+	xxhash         string
+
+	sort   string
+	desc   bool
+	limit  uint64
+	cursor *metadataCursor
+}
+
+// parseMetadataQuery reads the filters from the query string:
+//
+//	prefix                           only the path and anything beneath it
+//	glob                             full path or file name pattern, may be repeated
+//	type                             "file" or "dir"
+//	min_size, max_size               inclusive size range in bytes
+//	modified_after, modified_before  RFC 3339 mtime range
+//	sha256, xxhash                   content hash, hex encoded
+//	sort                             path, size, modified or created
+//	order                            asc or desc
+//	limit                            page size
+//	cursor                           from the previous page's Link header
+func parseMetadataQuery(r *http.Request, defaultSort string, defaultDesc bool) (metadataQuery, error) {
+	query := r.URL.Query()
+	q := metadataQuery{
+		prefix: strings.TrimSuffix(query.Get("prefix"), "/"),
+		globs:  query["glob"],
+		sha256: strings.ToLower(query.Get("sha256")),
+		xxhash: strings.ToLower(query.Get("xxhash")),
+		sort:   defaultSort,
+		desc:   defaultDesc,
+	}
+
+	for _, glob := range q.globs {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return q, fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+	}
+
+	switch query.Get("type") {
+	case "":
+	case "file":
+		isDirectory := false
+		q.isDirectory = &isDirectory
+	case "dir":
+		isDirectory := true
+		q.isDirectory = &isDirectory
+	default:
+		return q, fmt.Errorf("invalid type: %s, wanted file or dir", query.Get("type"))
+	}
+
+	var err error
+	if q.minSize, err = parseInt64Param(r, "min_size"); err != nil {
+		return q, err
+	}
+	if q.maxSize, err = parseInt64Param(r, "max_size"); err != nil {
+		return q, err
+	}
+	if q.modifiedAfter, err = parseTimeParam(r, "modified_after"); err != nil {
+		return q, err
+	}
+	if q.modifiedBefore, err = parseTimeParam(r, "modified_before"); err != nil {
+		return q, err
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		if _, ok := metadataSortColumns[sort]; !ok {
+			return q, fmt.Errorf("invalid sort: %s, wanted one of path, size, modified or created", sort)
+		}
+		q.sort = sort
+	}
+
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		q.desc = false
+	case "desc":
+		q.desc = true
+	default:
+		return q, fmt.Errorf("invalid order: %s, wanted asc or desc", query.Get("order"))
+	}
+
+	if q.limit, err = parseUintParam(r, "limit", defaultEventsLimit); err != nil {
+		return q, err
+	}
+	q.limit = max(min(q.limit, maxEventsLimit), 1)
+
+	if raw := query.Get("cursor"); raw != "" {
+		b, err := base64.RawURLEncoding.DecodeString(raw)
+		if err != nil {
+			return q, errors.New("invalid cursor")
+		}
+
+		var cursor metadataCursor
+		if err := json.Unmarshal(b, &cursor); err != nil {
+			return q, errors.New("invalid cursor")
+		}
+		q.cursor = &cursor
+	}
+
+	return q, nil
+}
+
+// cursorValue decodes the cursor's sort value into something sqlite compares correctly
+// against the sort column.
+func (q metadataQuery) cursorValue() (interface{}, error) {
+	var err error
+	switch q.sort {
+	case "size":
+		var v int64
+		err = json.Unmarshal(q.cursor.Value, &v)
+		return v, err
+	case "modified", "created":
+		var v time.Time
+		err = json.Unmarshal(q.cursor.Value, &v)
+		return v, err
+	default:
+		var v string
+		err = json.Unmarshal(q.cursor.Value, &v)
+		return v, err
+	}
+}
+
+func (q metadataQuery) sortValue(meta Metadata) interface{} {
+	switch q.sort {
+	case "size":
+		return meta.SizeBytes
+	case "modified":
+		return meta.ModifiedAt
+	case "created":
+		return meta.CreatedAt
+	default:
+		return meta.FullPath
+	}
+}
+
+// metadataGlobBatch is how many rows are read at a time while looking for glob matches.
+const metadataGlobBatch = 1000
+
+// sqlGlob translates a filepath.Match pattern into an sqlite GLOB pattern that matches at
+// least everything the original does. sqlite's `*` also matches slashes, so the results still
+// need checking. It reports false for patterns it can't translate, which is only escapes
+// inside a character class.
+func sqlGlob(pattern string) (string, bool) {
+	var b strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case inClass && c == '\\':
+			return "", false
+		case inClass:
+			inClass = c != ']'
+			b.WriteByte(c)
+		case c == '\\' && i+1 < len(pattern):
+			// sqlite has no escapes, but a single character class does the same thing
+			i++
+			b.WriteString("[" + pattern[i:i+1] + "]")
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String(), true
+}
+
+// globWhere narrows a query down to paths that might match one of `globs`, either as a whole
+// or by their file name. It returns nothing if any of them can't be translated.
+func globWhere(globs []string) (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	for _, glob := range globs {
+		pattern, ok := sqlGlob(glob)
+		if !ok {
+			return "", nil
+		}
+		where = append(where, "full_path GLOB ?", "full_path GLOB ?")
+		args = append(args, pattern, "*/"+pattern)
+	}
+
+	return "(" + strings.Join(where, " OR ") + ")", args
+}
+
+// run fetches a single page from `table`, returning the cursor for the next page if there is
+// one. Globs are narrowed down in sql, then checked here so they behave like event filters do,
+// reading as many batches as it takes to fill the page.
+func (q metadataQuery) run(ctx context.Context, db *sql.DB, table string) ([]Metadata, *metadataCursor, error) {
+	var where []string
+	var args []interface{}
+
+	if q.prefix != "" {
+		where = append(where, "(full_path = ? OR (full_path >= ? AND full_path < ?))")
+		args = append(args, q.prefix, q.prefix+"/", q.prefix+"0")
+	}
+	if q.isDirectory != nil {
+		where = append(where, "is_directory = ?")
+		args = append(args, *q.isDirectory)
+	}
+	if q.minSize != nil {
+		where = append(where, "size_bytes >= ?")
+		args = append(args, *q.minSize)
+	}
+	if q.maxSize != nil {
+		where = append(where, "size_bytes <= ?")
+		args = append(args, *q.maxSize)
+	}
+	if q.modifiedAfter != nil {
+		where = append(where, "modified_at >= ?")
+		args = append(args, *q.modifiedAfter)
+	}
+	if q.modifiedBefore != nil {
+		where = append(where, "modified_at < ?")
+		args = append(args, *q.modifiedBefore)
+	}
+
+	if q.sha256 != "" {
+		where = append(where, "sha256 = ?")
+		args = append(args, q.sha256)
+	}
+	if q.xxhash != "" {
+		where = append(where, "xxhash = ?")
+		args = append(args, q.xxhash)
+	}
+
+	if len(q.globs) > 0 {
+		if clause, globArgs := globWhere(q.globs); clause != "" {
+			where = append(where, clause)
+			args = append(args, globArgs...)
+		}
+	}
+
+	column := metadataSortColumns[q.sort]
+	direction, comparison := "ASC", ">"
+	if q.desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	var after interface{}
+	var afterID int64
+	if q.cursor != nil {
+		value, err := q.cursorValue()
+		if err != nil {
+			return nil, nil, errors.New("invalid cursor")
+		}
+		after, afterID = value, q.cursor.ID
+	}
+
+	// One extra match tells us whether there's another page
+	batch := q.limit + 1
+	if len(q.globs) > 0 {
+		batch = max(batch, metadataGlobBatch)
+	}
+
+	filter := ipc.Filter{Globs: q.globs}
+	metas := []Metadata{}
+	for {
+		pageWhere, pageArgs := where, args
+		if after != nil {
+			pageWhere = append(pageWhere[:len(pageWhere):len(pageWhere)], fmt.Sprintf("(%s, id) %s (?, ?)", column, comparison))
+			pageArgs = append(pageArgs[:len(pageArgs):len(pageArgs)], after, afterID)
+		}
+
+		query := fmt.Sprintf(`SELECT %s FROM %s`, metadataColumns, table)
+		if len(pageWhere) > 0 {
+			query += " WHERE " + strings.Join(pageWhere, " AND ")
+		}
+		query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT ?", column, direction, direction)
+		pageArgs = append(pageArgs[:len(pageArgs):len(pageArgs)], batch)
+
+		page, err := queryMetadata(ctx, db, query, pageArgs)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, meta := range page {
+			if !filter.MatchPath(meta.FullPath) {
+				continue
+			}
+
+			if uint64(len(metas)) == q.limit {
+				last := metas[len(metas)-1]
+				value, err := json.Marshal(q.sortValue(last))
+				if err != nil {
+					return nil, nil, err
+				}
+				return metas, &metadataCursor{Value: value, ID: last.ID}, nil
+			}
+
+			metas = append(metas, meta)
+		}
+
+		if uint64(len(page)) < batch {
+			return metas, nil, nil
+		}
+
+		last := page[len(page)-1]
+		after, afterID = q.sortValue(last), last.ID
+	}
+}
+
+// queryMetadata runs `query` and reads back every row.
+func queryMetadata(ctx context.Context, db *sql.DB, query string, args []interface{}) ([]Metadata, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metas := []Metadata{}
+	for rows.Next() {
+		meta, err := scanMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+
+	return metas, rows.Err()
+}
+
+// setNextLink points the Link header at the page after `cursor`, keeping the other query
+// parameters as they were.
+func setNextLink(w http.ResponseWriter, r *http.Request, cursor *metadataCursor) {
+	if cursor == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set("cursor", cursor.encode())
+	next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+}
+
+func parseInt64Param(r *http.Request, name string) (*int64, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, raw)
+	}
+
+	return &v, nil
+}
+
+func parseTimeParam(r *http.Request, name string) (*time.Time, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+
+	v, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s, wanted an RFC 3339 timestamp", name, raw)
+	}
+
+	// Times are stored as text in local time, so compare like with like
+	v = v.Local()
+	return &v, nil
+}
@@ -0,0 +1,24 @@
+package routes
+
+import "testing"
+
+func TestSqlGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+		ok      bool
+	}{
+		{pattern: "*.mp4", want: "*.mp4", ok: true},
+		{pattern: "clip-?.[a-c]*", want: "clip-?.[a-c]*", ok: true},
+		{pattern: `\*.txt`, want: "[*].txt", ok: true},
+		{pattern: "[^a-c]/*", want: "[^a-c]/*", ok: true},
+		{pattern: `[\]]`, ok: false},
+	}
+
+	for _, tt := range tests {
+		got, ok := sqlGlob(tt.pattern)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("sqlGlob(%q) = %q, %v, want %q, %v", tt.pattern, got, ok, tt.want, tt.ok)
+		}
+	}
+}
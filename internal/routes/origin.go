@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"fsd/internal/config"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// allowedOrigin reports whether `r` came from a page that's allowed to use fsd on the user's
+// behalf: one served by fsd itself, or one listed in `allowed_origins`. Browsers always send
+// an Origin with websocket handshakes and cross-site requests, so one that's missing is
+// rejected too. CORS doesn't cover either of these, it only stops pages reading responses.
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		zap.L().Warn("rejected request without an origin", zap.String("path", r.URL.Path))
+		return false
+	}
+
+	if slices.Contains(config.GetConfig().AllowedOrigins, origin) {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	zap.L().Warn("rejected request from another origin", zap.String("path", r.URL.Path), zap.String("origin", origin))
+	return false
+}
+
+// allowedChange reports whether `r` can change something fsd can't put back, like the FIM
+// baseline. It has to be a JSON request, which a page on another site can't send without a
+// CORS preflight, so a form can't be used to make it. Browsers always send an Origin with
+// those, so it's checked when it's there. Other clients don't send one.
+func allowedChange(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		zap.L().Warn("rejected change that isn't a json request", zap.String("path", r.URL.Path))
+		return false
+	}
+
+	return r.Header.Get("Origin") == "" || allowedOrigin(r)
+}
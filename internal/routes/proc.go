@@ -1,13 +1,17 @@
 package routes
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"fsd/internal/resp"
 	"fsd/pkg/procs"
+	"fsd/pkg/tasks"
 	"net/http"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,29 +21,58 @@ import (
 )
 
 type ProcController struct{}
+
+// Proc is a proc as it was queued. Args is the exact argv it runs with after the command, and
+// WorkDir is where it runs. Env is only what's added to fsd's own environment, which isn't
+// recorded since it can hold secrets. Procs queued before work_dir was stored have it empty,
+// and ran in fsd's own working directory.
 type Proc struct {
-	ID         int       `json:"id"`
-	Command    string    `json:"command"`
-	Args       string    `json:"args"`
-	IsExecuted int       `json:"is_executed"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID         int        `json:"id"`
+	Command    string     `json:"command"`
+	Args       []string   `json:"args"`
+	Env        []string   `json:"env"`
+	WorkDir    string     `json:"work_dir"`
+	IsExecuted int        `json:"is_executed"`
+	State      string     `json:"state"`
+	Priority   int        `json:"priority"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at"`
+}
+
+// ProcState is where a proc got to.
+type ProcState struct {
+	ID    int    `json:"id"`
+	State string `json:"state"`
 }
 
 type ProcSubmitRequest struct {
 	Command string              `json:"command"`
 	Args    map[string][]string `json:"args"`
+
+	// Priority puts the proc ahead of queued procs with a lower priority, 0 by default
+	Priority int `json:"priority"`
 }
 
+// ProcResult is how a proc went. Stdout and Stderr only have the end of the output, the rest is
+// in the proc's log.
 type ProcResult struct {
 	ID        int       `json:"id"`
 	Stdout    string    `json:"stdout"`
 	Stderr    string    `json:"stderr"`
 	CreatedAt time.Time `json:"created_at"`
+
+	// ExitCode is missing if the command never got to run, and the rest are missing for procs
+	// that finished before they were recorded
+	ExitCode   *int       `json:"exit_code"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	DurationMs *int64     `json:"duration_ms"`
 }
 
 var PROCS = []string{
 	procs.YtProcName(),
 	procs.DirProcName(),
+	procs.DedupeProcName(),
 }
 
 func (p *ProcSubmitRequest) bindHelper() error {
@@ -62,6 +95,10 @@ func (p *ProcSubmitRequest) bindHelper() error {
 		if len(channelName) == 0 || channelName[0] == "" {
 			return errors.New("non-empty channel-name is required")
 		}
+
+		if err := procs.ValidateYtArgs(p.Args); err != nil {
+			return err
+		}
 	case procs.DirProcName():
 		val, ok := p.Args["dirname"]
 		if !ok {
@@ -71,6 +108,28 @@ func (p *ProcSubmitRequest) bindHelper() error {
 		if len(val) == 0 {
 			return errors.New("non-empty dirname required")
 		}
+	case procs.DedupeProcName():
+		val, ok := p.Args["dir"]
+		if !ok {
+			return errors.New("dir is required")
+		}
+
+		if len(val) == 0 {
+			return errors.New("non-empty dir required")
+		}
+
+		if mode, ok := p.Args["mode"]; ok && (len(mode) == 0 || (mode[0] != procs.DedupeHardlink && mode[0] != procs.DedupeReflink)) {
+			return fmt.Errorf("mode must be %s or %s", procs.DedupeHardlink, procs.DedupeReflink)
+		}
+
+		if dryRun, ok := p.Args["dry_run"]; ok {
+			if len(dryRun) == 0 {
+				return errors.New("non-empty dry_run required")
+			}
+			if _, err := strconv.ParseBool(dryRun[0]); err != nil {
+				return errors.New("dry_run must be true or false")
+			}
+		}
 	default:
 		return errors.New("invalid proc choice")
 	}
@@ -94,7 +153,11 @@ func (p *ProcController) GetAvailableProcs(w http.ResponseWriter, r *http.Reques
 func (p *ProcController) GetProcs(w http.ResponseWriter, r *http.Request) {
 	db := r.Context().Value("db").(*sql.DB)
 
-	query := `SELECT * FROM proc ORDER BY created_at DESC`
+	query := `
+		SELECT id, command, args, env, work_dir, is_executed, state, priority, created_at, started_at
+		FROM proc
+		ORDER BY created_at DESC
+	`
 	rows, err := db.Query(query)
 	if err != nil {
 		zap.L().Error("failed to send database query", zap.Error(err))
@@ -106,12 +169,24 @@ func (p *ProcController) GetProcs(w http.ResponseWriter, r *http.Request) {
 	procs := []Proc{}
 	for rows.Next() {
 		var proc Proc
-		err = rows.Scan(&proc.ID, &proc.Command, &proc.Args, &proc.IsExecuted, &proc.CreatedAt)
+		var args, env string
+		err = rows.Scan(&proc.ID, &proc.Command, &args, &env, &proc.WorkDir, &proc.IsExecuted, &proc.State, &proc.Priority, &proc.CreatedAt, &proc.StartedAt)
 		if err != nil {
 			zap.L().Error("failed to scan proc", zap.Error(err))
 			resp.NewInternalServerErrorResponse(w, r, "failed to scan proc")
 			return
 		}
+
+		if err := json.Unmarshal([]byte(args), &proc.Args); err != nil {
+			zap.L().Error("failed to decode proc args", zap.Int("id", proc.ID), zap.Error(err))
+			resp.NewInternalServerErrorResponse(w, r, "failed to decode proc args")
+			return
+		}
+		if err := json.Unmarshal([]byte(env), &proc.Env); err != nil {
+			zap.L().Error("failed to decode proc env", zap.Int("id", proc.ID), zap.Error(err))
+			resp.NewInternalServerErrorResponse(w, r, "failed to decode proc env")
+			return
+		}
 		procs = append(procs, proc)
 	}
 
@@ -137,47 +212,94 @@ func (p *ProcController) SubmitProc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	proc, err := createProc(r.Context(), req)
+	if err != nil {
+		resp.NewInternalServerErrorResponse(w, r, fmt.Sprintf("failed to create %s proc", req.Command))
+		return
+	}
+
+	resp.NewCreatedResponse(w, r, proc)
+}
+
+// createProc queues a validated proc request, shared by the REST and websocket APIs.
+func createProc(ctx context.Context, req ProcSubmitRequest) (Proc, error) {
 	switch req.Command {
 	case procs.YtProcName():
-		ytProc, err := procs.NewYtProc(r.Context(), req.Args)
+		ytProc, err := procs.NewYtProc(ctx, req.Args, req.Priority)
 		if err != nil {
 			zap.L().Error("failed to create yt proc", zap.String("proc", procs.YtProcName()), zap.Error(err))
-			resp.NewInternalServerErrorResponse(w, r, "failed to create yt proc")
-			return
+			return Proc{}, err
 		}
 
-		proc := Proc{
+		return Proc{
 			ID:         ytProc.GetID(),
 			Command:    ytProc.GetCmd(),
-			Args:       strings.Join(ytProc.GetArgs(), " "),
+			Args:       ytProc.GetArgs(),
+			Env:        []string{},
+			WorkDir:    ytProc.GetWorkDir(),
 			IsExecuted: 0,
+			State:      tasks.ProcQueued,
+			Priority:   req.Priority,
 			CreatedAt:  time.Now(),
-		}
-
-		resp.NewCreatedResponse(w, r, proc)
+		}, nil
 	case procs.DirProcName():
-		dirProc, err := procs.NewDirProc(r.Context(), req.Args["dirname"][0])
+		dirProc, err := procs.NewDirProc(ctx, req.Args["dirname"][0], req.Priority)
 		if err != nil {
 			zap.L().Error("failed to create proc", zap.String("proc", procs.DirProcName()), zap.Error(err))
-			resp.NewInternalServerErrorResponse(w, r, "failed to create proc")
-			return
+			return Proc{}, err
 		}
 
-		proc := Proc{
+		return Proc{
 			ID:         dirProc.GetID(),
 			Command:    dirProc.GetCmd(),
-			Args:       dirProc.GetArgs()[0],
+			Args:       dirProc.GetArgs(),
+			Env:        []string{},
+			WorkDir:    dirProc.GetWorkDir(),
 			IsExecuted: 0,
+			State:      tasks.ProcQueued,
+			Priority:   req.Priority,
 			CreatedAt:  time.Now(),
+		}, nil
+	case procs.DedupeProcName():
+		mode := procs.DedupeHardlink
+		if val, ok := req.Args["mode"]; ok {
+			mode = val[0]
+		}
+
+		dryRun := false
+		if val, ok := req.Args["dry_run"]; ok {
+			dryRun, _ = strconv.ParseBool(val[0])
+		}
+
+		dedupeProc, err := procs.NewDedupeProc(ctx, req.Args["dir"][0], mode, dryRun, req.Priority)
+		if err != nil {
+			zap.L().Error("failed to create proc", zap.String("proc", procs.DedupeProcName()), zap.Error(err))
+			return Proc{}, err
 		}
-		resp.NewCreatedResponse(w, r, proc)
+
+		return Proc{
+			ID:         dedupeProc.GetID(),
+			Command:    dedupeProc.GetCmd(),
+			Args:       dedupeProc.GetArgs(),
+			Env:        []string{},
+			WorkDir:    dedupeProc.GetWorkDir(),
+			IsExecuted: 0,
+			State:      tasks.ProcQueued,
+			Priority:   req.Priority,
+			CreatedAt:  time.Now(),
+		}, nil
 	}
+
+	return Proc{}, fmt.Errorf("invalid proc: %s", req.Command)
 }
 
 func (p *ProcController) GetProcResults(w http.ResponseWriter, r *http.Request) {
 	db := r.Context().Value("db").(*sql.DB)
 
-	query := `SELECT * FROM proc_results`
+	query := `
+		SELECT id, stdout, stderr, created_at, exit_code, started_at, finished_at, duration_ms
+		FROM proc_results
+	`
 	rows, err := db.Query(query)
 	if err != nil {
 		resp.NewInternalServerErrorResponse(w, r, "failed to send database query")
@@ -188,7 +310,16 @@ func (p *ProcController) GetProcResults(w http.ResponseWriter, r *http.Request)
 	var results []ProcResult
 	for rows.Next() {
 		var result ProcResult
-		err = rows.Scan(&result.ID, &result.Stdout, &result.Stderr, &result.CreatedAt)
+		err = rows.Scan(
+			&result.ID,
+			&result.Stdout,
+			&result.Stderr,
+			&result.CreatedAt,
+			&result.ExitCode,
+			&result.StartedAt,
+			&result.FinishedAt,
+			&result.DurationMs,
+		)
 		if err != nil {
 			zap.L().Error("failed to scan proc result", zap.Error(err))
 			resp.NewInternalServerErrorResponse(w, r, "failed to scan proc result")
@@ -215,7 +346,10 @@ func (p *ProcController) GetProcResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `SELECT * FROM proc_results WHERE id = ?`
+	query := `
+		SELECT id, stdout, stderr, created_at, exit_code, started_at, finished_at, duration_ms
+		FROM proc_results WHERE id = ?
+	`
 	rows, err := db.Query(query, id)
 	if err != nil {
 		resp.NewInternalServerErrorResponse(w, r, "failed to send database query")
@@ -226,7 +360,16 @@ func (p *ProcController) GetProcResult(w http.ResponseWriter, r *http.Request) {
 	var results []ProcResult
 	for rows.Next() {
 		var result ProcResult
-		err = rows.Scan(&result.ID, &result.Stdout, &result.Stderr, &result.CreatedAt)
+		err = rows.Scan(
+			&result.ID,
+			&result.Stdout,
+			&result.Stderr,
+			&result.CreatedAt,
+			&result.ExitCode,
+			&result.StartedAt,
+			&result.FinishedAt,
+			&result.DurationMs,
+		)
 		if err != nil {
 			zap.L().Error("failed to scan proc result", zap.Error(err))
 			resp.NewInternalServerErrorResponse(w, r, "failed to scan proc result")
@@ -243,3 +386,96 @@ func (p *ProcController) GetProcResult(w http.ResponseWriter, r *http.Request) {
 
 	resp.NewSuccessResponse(w, r, results)
 }
+
+// GetDedupeResults returns what a dedupe proc did with each file it considered, in the order
+// it got to them. Pass the id of the last result as `after` to get the next page.
+//
+//	after  only results after this one
+//	limit  most results to return
+func (p *ProcController) GetDedupeResults(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, "id must be an integer")
+		return
+	}
+
+	after, err := parseUintParam(r, "after", 0)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+
+	limit, err := parseUintParam(r, "limit", defaultEventsLimit)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+	limit = min(limit, maxEventsLimit)
+
+	var command string
+	err = db.QueryRowContext(r.Context(), `SELECT command FROM proc WHERE id = ?`, id).Scan(&command)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && command != procs.DedupeProcName()) {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, fmt.Sprintf("no dedupe proc with id %d", id))
+		return
+	}
+	if err != nil {
+		zap.L().Error("failed to look up proc", zap.Int("id", id), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to look up proc")
+		return
+	}
+
+	results, err := procs.DedupeResults(r.Context(), db, id, int64(after), int(limit))
+	if err != nil {
+		zap.L().Error("failed to get dedupe results", zap.Int("id", id), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to get dedupe results")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, results)
+}
+
+// CancelProc stops a queued or running proc. For a running proc, it waits for the proc to stop
+// and returns the state it ended up in.
+func (p *ProcController) CancelProc(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, "id must be an integer")
+		return
+	}
+
+	state, err := tasks.CancelProc(r.Context(), db, id)
+	if errors.Is(err, tasks.ErrProcNotFound) {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, fmt.Sprintf("no proc with id %d", id))
+		return
+	}
+	if errors.Is(err, tasks.ErrProcFinished) {
+		resp.NewErrorResponse(w, r, http.StatusConflict, fmt.Sprintf("proc %d has already finished: %s", id, state))
+		return
+	}
+	if err != nil {
+		zap.L().Error("failed to cancel proc", zap.Int("id", id), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to cancel proc")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, ProcState{ID: id, State: state})
+}
+
+// GetProcQueue returns the running and queued procs, grouped by command, with each queued
+// proc's place in line and when it's expected to start and finish.
+func (p *ProcController) GetProcQueue(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	queue, err := tasks.ProcQueue(r.Context(), db)
+	if err != nil {
+		zap.L().Error("failed to get proc queue", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to get proc queue")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, queue)
+}
@@ -0,0 +1,329 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fsd/internal/resp"
+	"fsd/pkg/tasks"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	// procLogPollInterval is how often a followed log is checked for more output
+	procLogPollInterval = 500 * time.Millisecond
+
+	// procLogMaxEvent is the most of a single line that's held back waiting for the rest of it
+	procLogMaxEvent = 64 << 10
+)
+
+// procState returns the state of the proc with `id`, or nothing if there's no such proc.
+func procState(ctx context.Context, db *sql.DB, id int) (string, error) {
+	var state string
+	err := db.QueryRowContext(ctx, `SELECT state FROM proc WHERE id = ?`, id).Scan(&state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return state, err
+}
+
+// tailOffset returns where the last `lines` lines of the first `size` bytes of `f` start.
+func tailOffset(f io.ReaderAt, size int64, lines uint64) (int64, error) {
+	buf := make([]byte, 32<<10)
+	count := uint64(0)
+	for pos := size; pos > 0; {
+		n := min(int64(len(buf)), pos)
+		pos -= n
+		if _, err := f.ReadAt(buf[:n], pos); err != nil {
+			return 0, err
+		}
+
+		for i := n - 1; i >= 0; i-- {
+			// A newline at the very end finishes the last line rather than starting another
+			if buf[i] != '\n' || pos+i == size-1 {
+				continue
+			}
+
+			count++
+			if count == lines {
+				return pos + i + 1, nil
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// GetProcLogs returns what a proc has written so far as plain text, either all of it or the
+// last `tail` lines, and serves Range requests within that. With `follow=true` the output is
+// streamed as Server-Sent Events instead, one line each, until the proc finishes. Each event's
+// id is the byte offset after its line, so a reconnecting client that sends Last-Event-ID (or
+// `last_event_id`) picks up where it left off.
+func (p *ProcController) GetProcLogs(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, "id must be an integer")
+		return
+	}
+
+	follow := false
+	if raw := r.URL.Query().Get("follow"); raw != "" {
+		follow, err = strconv.ParseBool(raw)
+		if err != nil {
+			resp.NewBadRequestResponse(w, r, fmt.Sprintf("invalid follow: %s", raw))
+			return
+		}
+	}
+
+	tail, err := parseUintParam(r, "tail", 0)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+
+	state, err := procState(r.Context(), db, id)
+	if err != nil {
+		zap.L().Error("failed to get proc state", zap.Int("id", id), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to get proc state")
+		return
+	}
+	if state == "" {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, fmt.Sprintf("no proc with id %d", id))
+		return
+	}
+
+	if follow {
+		followProcLog(w, r, db, id, tail)
+		return
+	}
+
+	f, err := os.Open(tasks.ProcLogPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, fmt.Sprintf("proc %d has no logs", id))
+		return
+	}
+	if err != nil {
+		zap.L().Error("failed to open proc log", zap.Int("id", id), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to open proc log")
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		zap.L().Error("failed to stat proc log", zap.Int("id", id), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to read proc log")
+		return
+	}
+
+	// Only read up to the size now, the rest may still be being written
+	size := info.Size()
+	start := int64(0)
+	if tail > 0 {
+		start, err = tailOffset(f, size, tail)
+		if err != nil {
+			zap.L().Error("failed to read proc log", zap.Int("id", id), zap.Error(err))
+			resp.NewInternalServerErrorResponse(w, r, "failed to read proc log")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "", info.ModTime(), io.NewSectionReader(f, start, size-start))
+}
+
+// followProcLog streams the log of the proc with `id` until the proc finishes or the client
+// goes away. It waits for queued procs to start.
+func followProcLog(w http.ResponseWriter, r *http.Request, db *sql.DB, id int, tail uint64) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	// offset is where reading starts, which isn't known until the log exists when tailing
+	offset := int64(-1)
+	if lastEventID != "" {
+		after, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || after < 0 {
+			resp.NewBadRequestResponse(w, r, fmt.Sprintf("invalid Last-Event-ID: %s", lastEventID))
+			return
+		}
+		offset = after
+	} else if tail == 0 {
+		offset = 0
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		resp.NewInternalServerErrorResponse(w, r, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	poll := time.NewTicker(procLogPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	lines := procLogLines{offset: offset}
+	buf := make([]byte, 32<<10)
+	for {
+		// The log is complete by the time the state changes, so reading to the end after
+		// seeing a finished state gets everything
+		state, err := procState(r.Context(), db, id)
+		if err != nil {
+			zap.L().Error("failed to get proc state", zap.Int("id", id), zap.Error(err))
+			return
+		}
+		finished := state != tasks.ProcQueued && state != tasks.ProcRunning
+
+		if f == nil {
+			f, err = openProcLog(id, &lines, tail)
+			if err != nil {
+				zap.L().Error("failed to open proc log", zap.Int("id", id), zap.Error(err))
+				return
+			}
+		}
+
+		if f != nil {
+			for {
+				n, err := f.Read(buf)
+				if err := lines.write(w, buf[:n], false); err != nil {
+					return
+				}
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					zap.L().Error("failed to read proc log", zap.Int("id", id), zap.Error(err))
+					return
+				}
+			}
+		}
+
+		if finished {
+			if err := lines.write(w, nil, true); err != nil {
+				return
+			}
+
+			data, err := json.Marshal(ProcState{ID: id, State: state})
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: end\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-poll.C:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// openProcLog opens the log of the proc with `id` at the offset `lines` is at, working it out
+// from `tail` if it's not known yet. It returns nothing if the proc has no log yet.
+func openProcLog(id int, lines *procLogLines, tail uint64) (*os.File, error) {
+	f, err := os.Open(tasks.ProcLogPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if lines.offset < 0 {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		lines.offset, err = tailOffset(f, info.Size(), tail)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := f.Seek(lines.offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// procLogLines splits a log into events a line at a time. Carriage returns end lines as well,
+// since progress bars redraw themselves with them and they'd end the data line of an event
+// anyway.
+type procLogLines struct {
+	// offset is where in the log `partial` starts
+	offset  int64
+	partial []byte
+}
+
+// write sends every complete line of what's been read so far as an event, and everything
+// that's left as well when `last` is set.
+func (l *procLogLines) write(w io.Writer, b []byte, last bool) error {
+	l.partial = append(l.partial, b...)
+	for len(l.partial) > 0 {
+		end := bytes.IndexAny(l.partial, "\r\n")
+		next := end + 1
+		switch {
+		case end < 0 && (last || len(l.partial) >= procLogMaxEvent):
+			end = min(len(l.partial), procLogMaxEvent)
+			next = end
+		case end < 0:
+			return nil
+		case l.partial[end] == '\r' && end+1 == len(l.partial) && !last:
+			// Wait to see whether it's followed by a newline
+			return nil
+		case l.partial[end] == '\r' && end+1 < len(l.partial) && l.partial[end+1] == '\n':
+			next++
+		}
+
+		l.offset += int64(next)
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", l.offset, l.partial[:end]); err != nil {
+			return err
+		}
+		l.partial = l.partial[next:]
+	}
+
+	return nil
+}
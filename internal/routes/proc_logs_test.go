@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTailOffset(t *testing.T) {
+	long := strings.Repeat("x", 40<<10)
+
+	tests := []struct {
+		name    string
+		log     string
+		size    int64
+		lines   uint64
+		want    int64
+		wantErr bool
+	}{
+		{name: "last line", log: "a\nb\nc\n", lines: 1, want: 4},
+		{name: "last two lines", log: "a\nb\nc\n", lines: 2, want: 2},
+		{name: "every line", log: "a\nb\nc\n", lines: 3, want: 0},
+		{name: "more lines than there are", log: "a\nb\nc\n", lines: 10, want: 0},
+		{name: "no trailing newline", log: "a\nb\nc", lines: 1, want: 4},
+		{name: "empty", log: "", lines: 1, want: 0},
+		{name: "blank last line", log: "a\n\n", lines: 1, want: 2},
+		{name: "only up to size", log: "a\nb\nc\nd", size: 6, lines: 1, want: 4},
+		{name: "line longer than a read", log: long + "\ny\n", lines: 1, want: int64(len(long)) + 1},
+		{name: "across reads", log: "a\n" + long + "\ny\n", lines: 2, want: 2},
+		{name: "size past the end", log: "a\nb\n", size: 10, lines: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size
+			if size == 0 {
+				size = int64(len(tt.log))
+			}
+
+			got, err := tailOffset(strings.NewReader(tt.log), size, tt.lines)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got offset %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcLogLines(t *testing.T) {
+	// event is a line sent, and the offset after it
+	type event struct {
+		offset int64
+		data   string
+	}
+
+	long := strings.Repeat("x", procLogMaxEvent)
+
+	tests := []struct {
+		name string
+
+		// offset is where the log is read from
+		offset int64
+
+		// chunks are the reads from the log, and last writes whatever's left at the end
+		chunks []string
+		last   bool
+
+		want []event
+	}{
+		{name: "whole lines", chunks: []string{"a\nb\n"}, want: []event{{2, "a"}, {4, "b"}}},
+		{name: "partial line waits", chunks: []string{"a\nb"}, want: []event{{2, "a"}}},
+		{name: "partial line finished later", chunks: []string{"a", "b", "c\n"}, want: []event{{4, "abc"}}},
+		{name: "partial line at the end", chunks: []string{"a\nb"}, last: true, want: []event{{2, "a"}, {3, "b"}}},
+		{name: "carriage return and newline", chunks: []string{"a\r\nb\n"}, want: []event{{3, "a"}, {5, "b"}}},
+		{name: "carriage return and newline split", chunks: []string{"a\r", "\nb\n"}, want: []event{{3, "a"}, {5, "b"}}},
+		{name: "carriage return alone", chunks: []string{"10%\r20%\r"}, last: true, want: []event{{4, "10%"}, {8, "20%"}}},
+		{name: "blank lines", chunks: []string{"\n\n"}, want: []event{{1, ""}, {2, ""}}},
+		{name: "offset carried on", offset: 100, chunks: []string{"a\n"}, want: []event{{102, "a"}}},
+		{
+			name:   "too long",
+			chunks: []string{long + "yz", "\n"},
+			want:   []event{{procLogMaxEvent, long}, {procLogMaxEvent + 3, "yz"}},
+		},
+		{name: "nothing", last: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			lines := procLogLines{offset: tt.offset}
+			for _, chunk := range tt.chunks {
+				if err := lines.write(&out, []byte(chunk), false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.last {
+				if err := lines.write(&out, nil, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var want strings.Builder
+			for _, e := range tt.want {
+				fmt.Fprintf(&want, "id: %d\ndata: %s\n\n", e.offset, e.data)
+			}
+			if out.String() != want.String() {
+				t.Errorf("got %q, want %q", out.String(), want.String())
+			}
+		})
+	}
+}
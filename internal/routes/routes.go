@@ -11,6 +11,74 @@ func MakeRouter(r chi.Router) {
 		ctrl := MetadataController{}
 		r.Get("/", ctrl.GetMetadata)
 		r.Get("/latest", ctrl.GetLatestMetadata)
+		r.Get("/history", ctrl.GetMetadataHistory)
+	})
+
+	r.Route("/tree", func(r chi.Router) {
+		ctrl := TreeController{}
+		r.Get("/", ctrl.GetTree)
+	})
+
+	r.Route("/duplicates", func(r chi.Router) {
+		ctrl := DuplicatesController{}
+		r.Get("/", ctrl.GetDuplicates)
+	})
+
+	r.Route("/scrub", func(r chi.Router) {
+		ctrl := ScrubController{}
+		r.Get("/", ctrl.GetScrubProgress)
+		r.Get("/results", ctrl.GetScrubResults)
+	})
+
+	r.Route("/fim", func(r chi.Router) {
+		ctrl := FimController{}
+		r.Get("/changes", ctrl.GetFimChanges)
+		r.Post("/baseline", ctrl.CaptureFimBaseline)
+		r.Get("/key", ctrl.GetFimKey)
+		r.Post("/verify", ctrl.VerifyFimReport)
+		r.Route("/reports", func(r chi.Router) {
+			r.Get("/", ctrl.GetFimReports)
+			r.Post("/", ctrl.CreateFimReport)
+			r.Get("/{id}", ctrl.GetFimReport)
+		})
+	})
+
+	r.Route("/usage", func(r chi.Router) {
+		ctrl := UsageController{}
+		r.Route("/users", func(r chi.Router) {
+			r.Get("/", ctrl.GetUserUsage)
+			r.Get("/latest", ctrl.GetLatestUserUsage)
+		})
+		r.Route("/groups", func(r chi.Router) {
+			r.Get("/", ctrl.GetGroupUsage)
+			r.Get("/latest", ctrl.GetLatestGroupUsage)
+		})
+	})
+
+	r.Route("/watches", func(r chi.Router) {
+		ctrl := WatchController{}
+		r.Get("/", ctrl.GetWatches)
+	})
+
+	r.Route("/events", func(r chi.Router) {
+		ctrl := EventsController{}
+		r.Get("/", ctrl.GetEvents)
+		r.Get("/stream", ctrl.StreamEvents)
+	})
+
+	r.Route("/ws", func(r chi.Router) {
+		ctrl := WsController{}
+		r.Get("/", ctrl.Serve)
+	})
+
+	r.Route("/webhooks", func(r chi.Router) {
+		ctrl := WebhookController{}
+		r.Get("/dead_letters", ctrl.GetDeadLetters)
+	})
+
+	r.Route("/ipc", func(r chi.Router) {
+		ctrl := IpcController{}
+		r.Get("/subscribers", ctrl.GetSubscribers)
 	})
 
 	r.Route("/disk", func(r chi.Router) {
@@ -23,8 +91,13 @@ func MakeRouter(r chi.Router) {
 		ctrl := ProcController{}
 		r.Get("/", ctrl.GetProcs)
 		r.Get("/available", ctrl.GetAvailableProcs)
+		r.Get("/queue", ctrl.GetProcQueue)
 		r.Post("/", ctrl.SubmitProc)
 		r.Get("/results", ctrl.GetProcResults)
 		r.Get("/results/{id}", ctrl.GetProcResult)
+		r.Delete("/{id}", ctrl.CancelProc)
+		r.Post("/{id}/cancel", ctrl.CancelProc)
+		r.Get("/{id}/logs", ctrl.GetProcLogs)
+		r.Get("/{id}/dedupe", ctrl.GetDedupeResults)
 	})
 }
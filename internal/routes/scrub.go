@@ -0,0 +1,164 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"fsd/internal/config"
+	"fsd/internal/resp"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type ScrubController struct{}
+
+// ScrubProgress is how far the current scrub pass has got, or how the last one ended.
+type ScrubProgress struct {
+	Pass       int64      `json:"pass"`
+	Running    bool       `json:"running"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+
+	// NextPassAt is when the next pass starts, once this one has finished
+	NextPassAt *time.Time `json:"next_pass_at,omitempty"`
+
+	// Cursor is the last path scrubbed, the pass resumes after it
+	Cursor string `json:"cursor"`
+
+	// FilesTotal is how many files had a checksum when the pass started
+	FilesTotal    int64     `json:"files_total"`
+	FilesScrubbed int64     `json:"files_scrubbed"`
+	FilesSkipped  int64     `json:"files_skipped"`
+	BytesScrubbed int64     `json:"bytes_scrubbed"`
+	CorruptCount  int64     `json:"corrupt_count"`
+	Percent       float64   `json:"percent"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ScrubResult is a file found to be corrupt.
+type ScrubResult struct {
+	ID             int64      `json:"id"`
+	Pass           int64      `json:"pass"`
+	FullPath       string     `json:"full_path"`
+	SizeBytes      int64      `json:"size_bytes"`
+	ModifiedAt     time.Time  `json:"modified_at"`
+	ExpectedSHA256 string     `json:"expected_sha256"`
+	ActualSHA256   string     `json:"actual_sha256"`
+	HashedAt       *time.Time `json:"hashed_at"`
+	DetectedAt     time.Time  `json:"detected_at"`
+}
+
+// GetScrubProgress returns the progress of the current scrub pass, or the last one if none is
+// running.
+func (s *ScrubController) GetScrubProgress(w http.ResponseWriter, r *http.Request) {
+	if !config.GetConfig().ScrubEnabled {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, "scrubbing is not enabled")
+		return
+	}
+
+	db := r.Context().Value("db").(*sql.DB)
+
+	var p ScrubProgress
+	err := db.QueryRowContext(r.Context(), `
+		SELECT pass, started_at, finished_at, cursor, files_total, files_scrubbed, files_skipped,
+			bytes_scrubbed, corrupt_count, updated_at
+		FROM scrub_state WHERE id = 1
+	`).Scan(&p.Pass, &p.StartedAt, &p.FinishedAt, &p.Cursor, &p.FilesTotal, &p.FilesScrubbed,
+		&p.FilesSkipped, &p.BytesScrubbed, &p.CorruptCount, &p.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, "no scrub pass yet")
+		return
+	}
+	if err != nil {
+		zap.L().Error("failed to send database query", zap.String("table name", "scrub_state"), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to send database query")
+		return
+	}
+
+	p.Running = p.FinishedAt == nil
+	if p.FinishedAt != nil {
+		next := p.FinishedAt.Add(config.GetConfig().ScrubInterval)
+		p.NextPassAt = &next
+	}
+
+	// The total is only an estimate, so don't let files added since overshoot it
+	done := p.FilesScrubbed + p.FilesSkipped
+	switch {
+	case p.FinishedAt != nil || p.FilesTotal == 0:
+		p.Percent = 100
+	default:
+		p.Percent = min(100, 100*float64(done)/float64(p.FilesTotal))
+	}
+
+	resp.NewSuccessResponse(w, r, p)
+}
+
+// GetScrubResults returns the files found to be corrupt, newest first.
+//
+//	pass   only the results of this pass
+//	limit  most results to return
+func (s *ScrubController) GetScrubResults(w http.ResponseWriter, r *http.Request) {
+	if !config.GetConfig().ScrubEnabled {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, "scrubbing is not enabled")
+		return
+	}
+
+	db := r.Context().Value("db").(*sql.DB)
+
+	limit, err := parseUintParam(r, "limit", defaultEventsLimit)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+	limit = min(limit, maxEventsLimit)
+
+	pass, err := parseInt64Param(r, "pass")
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, pass, full_path, size_bytes, modified_at, expected_sha256, actual_sha256,
+			hashed_at, detected_at
+		FROM scrub_results
+		WHERE ? IS NULL OR pass = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, pass, pass, limit)
+	if err != nil {
+		zap.L().Error("failed to send database query", zap.String("table name", "scrub_results"), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to send database query")
+		return
+	}
+	defer rows.Close()
+
+	results := []ScrubResult{}
+	for rows.Next() {
+		var result ScrubResult
+		if err := rows.Scan(
+			&result.ID,
+			&result.Pass,
+			&result.FullPath,
+			&result.SizeBytes,
+			&result.ModifiedAt,
+			&result.ExpectedSHA256,
+			&result.ActualSHA256,
+			&result.HashedAt,
+			&result.DetectedAt,
+		); err != nil {
+			zap.L().Error("failed to scan scrub result", zap.Error(err))
+			resp.NewInternalServerErrorResponse(w, r, "failed to scan scrub results")
+			return
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		zap.L().Error("failed to scan scrub result", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to scan scrub results")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, results)
+}
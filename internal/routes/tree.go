@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"fsd/internal/config"
+	"fsd/internal/resp"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTreeDepth = 1
+	maxTreeDepth     = 16
+)
+
+type TreeController struct{}
+
+// TreeNode is a directory along with the totals for everything beneath it, itself included.
+type TreeNode struct {
+	Path             string     `json:"path"`
+	Name             string     `json:"name"`
+	ApparentBytes    int64      `json:"apparent_bytes"`
+	AllocatedBytes   int64      `json:"allocated_bytes"`
+	FileCount        int64      `json:"file_count"`
+	DirCount         int64      `json:"dir_count"`
+	NewestModifiedAt *time.Time `json:"newest_modified_at"`
+	Children         []TreeNode `json:"children,omitempty"`
+}
+
+func scanTreeNode(row interface{ Scan(...any) error }) (TreeNode, error) {
+	var node TreeNode
+	err := row.Scan(
+		&node.Path,
+		&node.ApparentBytes,
+		&node.AllocatedBytes,
+		&node.FileCount,
+		&node.DirCount,
+		&node.NewestModifiedAt,
+	)
+	node.Name = filepath.Base(node.Path)
+	return node, err
+}
+
+// GetTree returns `path` (the watch directory by default) and its subdirectories down to
+// `depth` levels, largest first. The totals are maintained by the metadata index, so this never
+// touches the filesystem.
+func (t *TreeController) GetTree(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		root, err := filepath.Abs(config.GetConfig().WatchDir)
+		if err != nil {
+			resp.NewInternalServerErrorResponse(w, r, "failed to resolve watch directory")
+			return
+		}
+		path = root
+	}
+	path = filepath.Clean(path)
+
+	depth, err := parseUintParam(r, "depth", defaultTreeDepth)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+	if depth > maxTreeDepth {
+		resp.NewBadRequestResponse(w, r, fmt.Sprintf("depth must be at most %d", maxTreeDepth))
+		return
+	}
+
+	node, err := scanTreeNode(db.QueryRowContext(r.Context(), `
+		SELECT full_path, apparent_bytes, allocated_bytes, file_count, dir_count, newest_modified_at
+		FROM metadata_tree WHERE full_path = ?
+	`, path))
+	if errors.Is(err, sql.ErrNoRows) {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, fmt.Sprintf("no indexed directory at %s", path))
+		return
+	}
+	if err != nil {
+		zap.L().Error("failed to query directory totals", zap.String("path", path), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to query directory totals")
+		return
+	}
+
+	if err := loadChildren(r.Context(), db, &node, int(depth)); err != nil {
+		zap.L().Error("failed to query directory totals", zap.String("path", path), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to query directory totals")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, node)
+}
+
+// loadChildren fills in the subdirectories of `node`, recursing `depth` levels.
+func loadChildren(ctx context.Context, db *sql.DB, node *TreeNode, depth int) error {
+	if depth == 0 || node.DirCount == 0 {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT full_path, apparent_bytes, allocated_bytes, file_count, dir_count, newest_modified_at
+		FROM metadata_tree WHERE parent_path = ?
+		ORDER BY apparent_bytes DESC, full_path
+	`, node.Path)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		child, err := scanTreeNode(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		node.Children = append(node.Children, child)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range node.Children {
+		if err := loadChildren(ctx, db, &node.Children[i], depth-1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"fsd/internal/resp"
+	"fsd/pkg/tasks"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type UsageController struct{}
+
+// Usage is what a single user or group owned under the watch directory at the time of a
+// snapshot. Only one of UID and GID is set.
+type Usage struct {
+	ID             int64             `json:"id"`
+	UID            *int64            `json:"uid,omitempty"`
+	GID            *int64            `json:"gid,omitempty"`
+	Name           string            `json:"name"`
+	ApparentBytes  int64             `json:"apparent_bytes"`
+	AllocatedBytes int64             `json:"allocated_bytes"`
+	FileCount      int64             `json:"file_count"`
+	DirCount       int64             `json:"dir_count"`
+	LargestFiles   []tasks.UsageFile `json:"largest_files,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+// usageTable is the history table behind one of the /usage endpoints.
+type usageTable struct {
+	name     string
+	idColumn string
+}
+
+var (
+	userUsage  = usageTable{name: "usage_users", idColumn: "uid"}
+	groupUsage = usageTable{name: "usage_groups", idColumn: "gid"}
+)
+
+func (t usageTable) scan(rows *sql.Rows, withFiles bool) ([]Usage, error) {
+	usage := []Usage{}
+	for rows.Next() {
+		var u Usage
+		var id int64
+		var largest string
+		if err := rows.Scan(
+			&u.ID,
+			&id,
+			&u.Name,
+			&u.ApparentBytes,
+			&u.AllocatedBytes,
+			&u.FileCount,
+			&u.DirCount,
+			&largest,
+			&u.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		if t.idColumn == "uid" {
+			u.UID = &id
+		} else {
+			u.GID = &id
+		}
+
+		if withFiles {
+			if err := json.Unmarshal([]byte(largest), &u.LargestFiles); err != nil {
+				return nil, err
+			}
+		}
+
+		usage = append(usage, u)
+	}
+
+	return usage, rows.Err()
+}
+
+func (t usageTable) columns() string {
+	return fmt.Sprintf(
+		"id, %s, name, apparent_bytes, allocated_bytes, file_count, dir_count, largest_files, created_at",
+		t.idColumn,
+	)
+}
+
+// GetUserUsage returns the history of per-user usage, newest first. Pass `uid` to follow a
+// single user.
+func (u *UsageController) GetUserUsage(w http.ResponseWriter, r *http.Request) {
+	getUsageHistory(w, r, userUsage)
+}
+
+// GetLatestUserUsage returns the most recent per-user snapshot, biggest first, along with each
+// user's largest files.
+func (u *UsageController) GetLatestUserUsage(w http.ResponseWriter, r *http.Request) {
+	getLatestUsage(w, r, userUsage)
+}
+
+// GetGroupUsage returns the history of per-group usage, newest first. Pass `gid` to follow a
+// single group.
+func (u *UsageController) GetGroupUsage(w http.ResponseWriter, r *http.Request) {
+	getUsageHistory(w, r, groupUsage)
+}
+
+// GetLatestGroupUsage returns the most recent per-group snapshot, biggest first, along with
+// each group's largest files.
+func (u *UsageController) GetLatestGroupUsage(w http.ResponseWriter, r *http.Request) {
+	getLatestUsage(w, r, groupUsage)
+}
+
+func getUsageHistory(w http.ResponseWriter, r *http.Request, table usageTable) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	limit, err := parseUintParam(r, "limit", defaultEventsLimit)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+	limit = min(limit, maxEventsLimit)
+
+	owner, err := parseInt64Param(r, table.idColumn)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT %s FROM %s
+		WHERE ? IS NULL OR %s = ?
+		ORDER BY created_at DESC, apparent_bytes DESC
+		LIMIT ?
+	`, table.columns(), table.name, table.idColumn), owner, owner, limit)
+	if err != nil {
+		zap.L().Error("failed to send database query", zap.String("table name", table.name), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to send database query")
+		return
+	}
+	defer rows.Close()
+
+	usage, err := table.scan(rows, false)
+	if err != nil {
+		zap.L().Error("failed to scan usage", zap.String("table name", table.name), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to scan usage")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, usage)
+}
+
+func getLatestUsage(w http.ResponseWriter, r *http.Request, table usageTable) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT %[1]s FROM %[2]s
+		WHERE created_at = (SELECT max(created_at) FROM %[2]s)
+		ORDER BY apparent_bytes DESC, %[3]s
+	`, table.columns(), table.name, table.idColumn))
+	if err != nil {
+		zap.L().Error("failed to send database query", zap.String("table name", table.name), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to send database query")
+		return
+	}
+	defer rows.Close()
+
+	usage, err := table.scan(rows, true)
+	if err != nil {
+		zap.L().Error("failed to scan usage", zap.String("table name", table.name), zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to scan usage")
+		return
+	}
+
+	if len(usage) == 0 {
+		resp.NewErrorResponse(w, r, http.StatusNotFound, "no usage snapshots yet")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, usage)
+}
@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"net/http"
+	"sort"
+
+	"fsd/internal/resp"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type WatchController struct{}
+
+type Watches struct {
+	Count int      `json:"count"`
+	Paths []string `json:"paths"`
+}
+
+// GetWatches reports every directory currently registered with the fsnotify watcher.
+func (wc *WatchController) GetWatches(w http.ResponseWriter, r *http.Request) {
+	watcher := r.Context().Value("watcher").(*fsnotify.Watcher)
+
+	paths := watcher.WatchList()
+	sort.Strings(paths)
+
+	resp.NewSuccessResponse(w, r, Watches{
+		Count: len(paths),
+		Paths: paths,
+	})
+}
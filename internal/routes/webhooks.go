@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"database/sql"
+	"fsd/internal/resp"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type WebhookController struct{}
+
+type WebhookDeadLetter struct {
+	ID        int64     `json:"id"`
+	Webhook   string    `json:"webhook"`
+	URL       string    `json:"url"`
+	Seq       int64     `json:"seq"`
+	Payload   string    `json:"payload"`
+	Attempts  int       `json:"attempts"`
+	LastError *string   `json:"last_error"`
+	CreatedAt time.Time `json:"created_at"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// GetDeadLetters lists the webhook deliveries that ran out of attempts, newest first. Pass
+// `webhook` to narrow it down to a single target.
+func (wc *WebhookController) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value("db").(*sql.DB)
+
+	limit, err := parseUintParam(r, "limit", defaultEventsLimit)
+	if err != nil {
+		resp.NewBadRequestResponse(w, r, err.Error())
+		return
+	}
+	limit = min(limit, maxEventsLimit)
+
+	webhook := r.URL.Query().Get("webhook")
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, webhook, url, seq, payload, attempts, last_error, created_at, failed_at
+		FROM webhook_dead_letters
+		WHERE ? = '' OR webhook = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, webhook, webhook, limit)
+	if err != nil {
+		zap.L().Error("failed to send database query", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "failed to send database query")
+		return
+	}
+	defer rows.Close()
+
+	letters := []WebhookDeadLetter{}
+	for rows.Next() {
+		var letter WebhookDeadLetter
+		if err := rows.Scan(
+			&letter.ID,
+			&letter.Webhook,
+			&letter.URL,
+			&letter.Seq,
+			&letter.Payload,
+			&letter.Attempts,
+			&letter.LastError,
+			&letter.CreatedAt,
+			&letter.FailedAt,
+		); err != nil {
+			zap.L().Error("failed to scan dead letter", zap.Error(err))
+			resp.NewInternalServerErrorResponse(w, r, "failed to scan dead letter")
+			return
+		}
+		letters = append(letters, letter)
+	}
+
+	if err := rows.Err(); err != nil {
+		zap.L().Error("error iterating over dead letter rows", zap.Error(err))
+		resp.NewInternalServerErrorResponse(w, r, "error iterating over dead letter rows")
+		return
+	}
+
+	resp.NewSuccessResponse(w, r, letters)
+}
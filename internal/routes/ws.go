@@ -0,0 +1,361 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"fsd/internal/config"
+	"fsd/pkg/ipc"
+	"fsd/pkg/tasks"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// wsWriteTimeout bounds how long a single frame may take to go out
+	wsWriteTimeout = 10 * time.Second
+
+	// wsPongTimeout is how long a connection may go without answering a ping
+	wsPongTimeout = 60 * time.Second
+
+	// wsPingInterval must be shorter than wsPongTimeout
+	wsPingInterval = 25 * time.Second
+
+	// wsMaxCommandSize caps the size of a single client command
+	wsMaxCommandSize = 64 * 1024
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: allowedOrigin,
+}
+
+type WsController struct{}
+
+// WsCommand is a message from the client. `ID` is echoed back in the reply so the client can
+// match them up.
+type WsCommand struct {
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type"`
+
+	// Subscription is the subscription to add or remove, for subscribe and unsubscribe
+	Subscription string `json:"subscription,omitempty"`
+
+	// Prefixes, Globs and Ops make up the filter for subscribe
+	Prefixes []string `json:"prefixes,omitempty"`
+	Globs    []string `json:"globs,omitempty"`
+	Ops      []string `json:"ops,omitempty"`
+
+	// Proc is the request for submit_proc
+	Proc *ProcSubmitRequest `json:"proc,omitempty"`
+
+	// Path is the path for rescan, defaulting to the whole watch directory
+	Path string `json:"path,omitempty"`
+}
+
+// WsReply answers a single command.
+type WsReply struct {
+	Type  string      `json:"type"`
+	ID    string      `json:"id,omitempty"`
+	Ok    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// WsEvent carries a broadcast message along with the subscriptions it matched.
+type WsEvent struct {
+	Type          string    `json:"type"`
+	Subscriptions []string  `json:"subscriptions"`
+	Event         ipc.Event `json:"event"`
+}
+
+// wsConnection is the state for a single websocket client.
+type wsConnection struct {
+	id          string
+	conn        *websocket.Conn
+	broadcaster *ipc.Broadcaster
+
+	// replies are written by the same goroutine as events, since gorilla connections only
+	// support one concurrent writer
+	replies chan WsReply
+
+	// limiter paces outgoing events. When it holds us back the subscriber queue fills up and
+	// the broadcaster drops the oldest events, which shows up in the subscriber stats.
+	limiter *rate.Limiter
+
+	// lock guards subscriptions, which the reader changes while the writer matches against
+	// them
+	lock          sync.RWMutex
+	subscriptions map[string]ipc.Filter
+	nextSub       int
+}
+
+// Serve upgrades the request to a websocket. Clients get nothing until they subscribe, and
+// may add or drop subscriptions, submit procs and trigger rescans at any time.
+func (ws *WsController) Serve(w http.ResponseWriter, r *http.Request) {
+	broadcaster := r.Context().Value("broadcaster").(*ipc.Broadcaster)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an error response
+		zap.L().Error("failed to upgrade websocket", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	limit := rate.Inf
+	if config.GetConfig().WebsocketEventRate > 0 {
+		limit = rate.Limit(config.GetConfig().WebsocketEventRate)
+	}
+
+	c := &wsConnection{
+		id:            nextConnectionID("ws"),
+		conn:          conn,
+		broadcaster:   broadcaster,
+		replies:       make(chan WsReply, 16),
+		limiter:       rate.NewLimiter(limit, max(config.GetConfig().WebsocketEventBurst, 1)),
+		subscriptions: make(map[string]ipc.Filter),
+	}
+
+	ch := broadcaster.SubscribeWithPolicy(c.id, ipc.DropOldest)
+	defer broadcaster.Unsubscribe(ch)
+
+	zap.L().Info("websocket opened", zap.String("receiver", c.id), zap.String("remote", r.RemoteAddr))
+
+	// The request context is not cancelled when a hijacked connection goes away, so the reader
+	// tells the writer when the client is gone.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		c.readLoop(ctx)
+	}()
+
+	c.writeLoop(ctx, ch)
+	cancel()
+
+	zap.L().Info("websocket closed", zap.String("receiver", c.id))
+}
+
+func (c *wsConnection) readLoop(ctx context.Context) {
+	c.conn.SetReadLimit(wsMaxCommandSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		var cmd WsCommand
+		if err := c.conn.ReadJSON(&cmd); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				zap.L().Warn("websocket read failed", zap.String("receiver", c.id), zap.Error(err))
+			}
+			return
+		}
+
+		reply := c.handleCommand(ctx, cmd)
+		select {
+		case c.replies <- reply:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *wsConnection) writeLoop(ctx context.Context, ch chan ipc.Message) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			matched := c.match(msg)
+			if len(matched) == 0 {
+				continue
+			}
+
+			if err := c.limiter.Wait(ctx); err != nil {
+				return
+			}
+
+			event, ok := msg.(ipc.Event)
+			if !ok {
+				event = ipc.Event{Timestamp: time.Now(), Message: msg}
+			}
+
+			if err := c.write(WsEvent{Type: "event", Subscriptions: matched, Event: event}); err != nil {
+				return
+			}
+		case reply := <-c.replies:
+			if err := c.write(reply); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *wsConnection) write(v interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := c.conn.WriteJSON(v); err != nil {
+		zap.L().Warn("websocket write failed", zap.String("receiver", c.id), zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// match returns the sorted names of the subscriptions that `msg` passes.
+func (c *wsConnection) match(msg ipc.Message) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var matched []string
+	for name, filter := range c.subscriptions {
+		if filter.Match(msg) {
+			matched = append(matched, name)
+		}
+	}
+	sort.Strings(matched)
+
+	return matched
+}
+
+func (c *wsConnection) handleCommand(ctx context.Context, cmd WsCommand) WsReply {
+	reply := WsReply{Type: "reply", ID: cmd.ID, Ok: true}
+
+	var err error
+	switch cmd.Type {
+	case "subscribe":
+		reply.Data, err = c.subscribe(cmd)
+	case "unsubscribe":
+		reply.Data, err = c.unsubscribe(cmd)
+	case "submit_proc":
+		reply.Data, err = c.submitProc(ctx, cmd)
+	case "rescan":
+		reply.Data, err = c.rescan(cmd)
+	case "ping":
+		reply.Data = "pong"
+	default:
+		err = fmt.Errorf("unknown command: %q", cmd.Type)
+	}
+
+	if err != nil {
+		reply.Ok = false
+		reply.Error = err.Error()
+	}
+
+	return reply
+}
+
+func (c *wsConnection) subscribe(cmd WsCommand) (interface{}, error) {
+	filter := ipc.Filter{
+		Prefixes: cmd.Prefixes,
+		Globs:    cmd.Globs,
+	}
+
+	for _, name := range cmd.Ops {
+		op, err := ipc.ParseFsdOp(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if filter.Operations == nil {
+			filter.Operations = make(map[ipc.FsdOp]bool)
+		}
+		filter.Operations[op] = true
+	}
+
+	for _, glob := range filter.Globs {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	name := cmd.Subscription
+	if name == "" {
+		c.nextSub++
+		name = fmt.Sprintf("sub-%d", c.nextSub)
+	}
+	c.subscriptions[name] = filter
+
+	return map[string]string{"subscription": name}, nil
+}
+
+// unsubscribe drops the named subscription, or all of them if none is named.
+func (c *wsConnection) unsubscribe(cmd WsCommand) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cmd.Subscription == "" {
+		c.subscriptions = make(map[string]ipc.Filter)
+		return nil, nil
+	}
+
+	if _, ok := c.subscriptions[cmd.Subscription]; !ok {
+		return nil, fmt.Errorf("no such subscription: %s", cmd.Subscription)
+	}
+	delete(c.subscriptions, cmd.Subscription)
+
+	return nil, nil
+}
+
+func (c *wsConnection) submitProc(ctx context.Context, cmd WsCommand) (interface{}, error) {
+	if cmd.Proc == nil {
+		return nil, errors.New("proc is required")
+	}
+
+	// Bind only validates, the request itself isn't used
+	if err := cmd.Proc.Bind(nil); err != nil {
+		return nil, err
+	}
+
+	proc, err := createProc(ctx, *cmd.Proc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s proc", cmd.Proc.Command)
+	}
+
+	return proc, nil
+}
+
+// rescan asks the metadata task to re-read a path, relative paths being taken from the watch
+// directory.
+func (c *wsConnection) rescan(cmd WsCommand) (interface{}, error) {
+	root, err := filepath.Abs(config.GetConfig().WatchDir)
+	if err != nil {
+		return nil, err
+	}
+
+	path := root
+	if cmd.Path != "" {
+		path = filepath.Clean(cmd.Path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+	}
+
+	if path != root && !strings.HasPrefix(path, root+"/") {
+		return nil, fmt.Errorf("%s is outside of %s", path, root)
+	}
+
+	c.broadcaster.Broadcast(tasks.MetadataMessage{Name: path, Operation: ipc.Rescan})
+	return map[string]string{"path": path}, nil
+}
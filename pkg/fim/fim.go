@@ -0,0 +1,159 @@
+package fim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fsd/pkg/hashing"
+	"io/fs"
+	"maps"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The attributes of an entry that can change, as named in reports
+const (
+	FieldType       = "type"
+	FieldMode       = "mode"
+	FieldOwner      = "owner"
+	FieldGroup      = "group"
+	FieldSize       = "size"
+	FieldSHA256     = "sha256"
+	FieldLinkTarget = "link_target"
+	FieldXattrs     = "xattrs"
+)
+
+// Entry is everything integrity monitoring tracks about a single path.
+type Entry struct {
+	Path string `json:"path"`
+
+	// Mode includes the file type bits as well as the permissions
+	Mode fs.FileMode `json:"mode"`
+	UID  uint32      `json:"uid"`
+	GID  uint32      `json:"gid"`
+	Size int64       `json:"size"`
+
+	// SHA256 is the hash of the contents of regular files, and empty for everything else
+	SHA256 string `json:"sha256,omitempty"`
+
+	// LinkTarget is only set for symlinks
+	LinkTarget string `json:"link_target,omitempty"`
+
+	// Xattrs are the extended attributes by name, their values base64 encoded as JSON
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Capture reads the entry at `path` without following symlinks, hashing regular files with
+// `hasher`.
+func Capture(ctx context.Context, hasher *hashing.Hasher, path string) (Entry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entry := Entry{
+		Path: path,
+		Mode: info.Mode(),
+		Size: info.Size(),
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.UID = st.Uid
+		entry.GID = st.Gid
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		sums, err := hasher.HashFile(ctx, path)
+		if err != nil {
+			return entry, err
+		}
+		entry.SHA256 = sums.SHA256
+	case info.Mode()&fs.ModeSymlink != 0:
+		entry.LinkTarget, err = os.Readlink(path)
+		if err != nil {
+			return entry, err
+		}
+	}
+
+	entry.Xattrs, err = xattrs(path)
+	return entry, err
+}
+
+// xattrs reads every extended attribute of `path`, or none if the filesystem doesn't have them.
+func xattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if errors.Is(err, unix.ENODATA) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, value)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = value[:size]
+	}
+
+	return attrs, nil
+}
+
+// Diff returns the names of the fields that differ between `baseline` and `current`, or
+// nothing if they match.
+func Diff(baseline, current Entry) []string {
+	var fields []string
+	if baseline.Mode.Type() != current.Mode.Type() {
+		fields = append(fields, FieldType)
+	}
+	if permissions(baseline.Mode) != permissions(current.Mode) {
+		fields = append(fields, FieldMode)
+	}
+	if baseline.UID != current.UID {
+		fields = append(fields, FieldOwner)
+	}
+	if baseline.GID != current.GID {
+		fields = append(fields, FieldGroup)
+	}
+
+	// Directory sizes change whenever their entries do, which the entries themselves cover
+	if !baseline.Mode.IsDir() && baseline.Size != current.Size {
+		fields = append(fields, FieldSize)
+	}
+	if baseline.SHA256 != current.SHA256 {
+		fields = append(fields, FieldSHA256)
+	}
+	if baseline.LinkTarget != current.LinkTarget {
+		fields = append(fields, FieldLinkTarget)
+	}
+	if !maps.EqualFunc(baseline.Xattrs, current.Xattrs, bytes.Equal) {
+		fields = append(fields, FieldXattrs)
+	}
+
+	return fields
+}
+
+// permissions are the bits of `mode` that chmod can change.
+func permissions(mode fs.FileMode) fs.FileMode {
+	return mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+}
@@ -0,0 +1,86 @@
+package fim
+
+import (
+	"io/fs"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	file := Entry{
+		Path:   "/w/file",
+		Mode:   0644,
+		UID:    1000,
+		GID:    1000,
+		Size:   10,
+		SHA256: "aa",
+		Xattrs: map[string][]byte{"user.a": []byte("1")},
+	}
+	dir := Entry{Path: "/w/dir", Mode: fs.ModeDir | 0755, Size: 4096}
+	link := Entry{Path: "/w/link", Mode: fs.ModeSymlink | 0777, Size: 4, LinkTarget: "file"}
+
+	// with returns `e` changed by `change`
+	with := func(e Entry, change func(*Entry)) Entry {
+		e.Xattrs = maps.Clone(e.Xattrs)
+		change(&e)
+		return e
+	}
+
+	tests := []struct {
+		name     string
+		baseline Entry
+		current  Entry
+		want     []string
+	}{
+		{name: "unchanged", baseline: file, current: with(file, func(e *Entry) {})},
+		{name: "contents", baseline: file, current: with(file, func(e *Entry) { e.SHA256 = "bb" }), want: []string{FieldSHA256}},
+		{
+			name:     "grown",
+			baseline: file,
+			current:  with(file, func(e *Entry) { e.Size, e.SHA256 = 20, "bb" }),
+			want:     []string{FieldSize, FieldSHA256},
+		},
+		{name: "chmod", baseline: file, current: with(file, func(e *Entry) { e.Mode = 0600 }), want: []string{FieldMode}},
+		{name: "setuid", baseline: file, current: with(file, func(e *Entry) { e.Mode |= fs.ModeSetuid }), want: []string{FieldMode}},
+		{
+			name:     "chown",
+			baseline: file,
+			current:  with(file, func(e *Entry) { e.UID, e.GID = 0, 0 }),
+			want:     []string{FieldOwner, FieldGroup},
+		},
+		{
+			name:     "xattr changed",
+			baseline: file,
+			current:  with(file, func(e *Entry) { e.Xattrs["user.a"] = []byte("2") }),
+			want:     []string{FieldXattrs},
+		},
+		{
+			name:     "xattr removed",
+			baseline: file,
+			current:  with(file, func(e *Entry) { e.Xattrs = nil }),
+			want:     []string{FieldXattrs},
+		},
+		{name: "directory grown", baseline: dir, current: with(dir, func(e *Entry) { e.Size = 8192 })},
+		{
+			name:     "relinked",
+			baseline: link,
+			current:  with(link, func(e *Entry) { e.LinkTarget, e.Size = "other", 5 }),
+			want:     []string{FieldSize, FieldLinkTarget},
+		},
+		{
+			name:     "replaced by a directory",
+			baseline: file,
+			current:  with(dir, func(e *Entry) { e.Mode = fs.ModeDir | 0644 }),
+			want:     []string{FieldType, FieldOwner, FieldGroup, FieldSize, FieldSHA256, FieldXattrs},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff(tt.baseline, tt.current); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
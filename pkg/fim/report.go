@@ -0,0 +1,136 @@
+package fim
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Change is a path that no longer matches the baseline. Added paths only have Current, and
+// removed paths only have Baseline.
+type Change struct {
+	Path       string    `json:"path"`
+	Fields     []string  `json:"fields,omitempty"`
+	Baseline   *Entry    `json:"baseline,omitempty"`
+	Current    *Entry    `json:"current,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// Report is everything that differs from the baseline at the time it was generated.
+type Report struct {
+	Hostname           string     `json:"hostname"`
+	GeneratedAt        time.Time  `json:"generated_at"`
+	BaselineCapturedAt *time.Time `json:"baseline_captured_at"`
+	Paths              []string   `json:"paths"`
+	Added              []Change   `json:"added"`
+	Removed            []Change   `json:"removed"`
+	Modified           []Change   `json:"modified"`
+}
+
+// SignedReport is a report as it was signed. The signature covers the exact bytes of Report,
+// so it has to be passed back as it came for the signature to verify.
+type SignedReport struct {
+	Report    json.RawMessage   `json:"report"`
+	Signature []byte            `json:"signature"`
+	PublicKey ed25519.PublicKey `json:"public_key"`
+}
+
+// Sign serializes `report` and signs it with `key`.
+func Sign(key ed25519.PrivateKey, report Report) (SignedReport, error) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return SignedReport{}, err
+	}
+
+	return SignedReport{
+		Report:    body,
+		Signature: ed25519.Sign(key, body),
+		PublicKey: key.Public().(ed25519.PublicKey),
+	}, nil
+}
+
+// Verify reports whether `signature` is `key`'s signature of `report`. Whitespace in the report
+// is ignored, so it survives being pretty printed.
+func Verify(key ed25519.PublicKey, report []byte, signature []byte) (bool, error) {
+	var body bytes.Buffer
+	if err := json.Compact(&body, report); err != nil {
+		return false, err
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("public key is %d bytes, wanted %d", len(key), ed25519.PublicKeySize)
+	}
+
+	return ed25519.Verify(key, body.Bytes(), signature), nil
+}
+
+// LoadOrCreateKey reads the PEM encoded ed25519 key at `path`, generating one there if it
+// doesn't exist yet.
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return createKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+
+	return key, nil
+}
+
+func createKey(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// Never overwrite a key that turned up in the meantime, reports signed with it would no
+	// longer verify
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return LoadOrCreateKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, err
+	}
+
+	return key, f.Close()
+}
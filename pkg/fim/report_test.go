@@ -0,0 +1,112 @@
+package fim
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generatedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	signed, err := Sign(key, Report{
+		Hostname:    "host-a",
+		GeneratedAt: generatedAt,
+		Paths:       []string{"/w/etc"},
+		Modified: []Change{{
+			Path:       "/w/etc/passwd",
+			Fields:     []string{FieldSHA256},
+			Baseline:   &Entry{Path: "/w/etc/passwd", Mode: 0644, Size: 10, SHA256: "aa"},
+			Current:    &Entry{Path: "/w/etc/passwd", Mode: 0644, Size: 10, SHA256: "bb"},
+			DetectedAt: generatedAt,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The report as it comes back from a client that decoded it and sent it on as it was
+	var passedOn SignedReport
+	encoded, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, &passedOn); err != nil {
+		t.Fatal(err)
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, signed.Report, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       ed25519.PublicKey
+		report    []byte
+		signature []byte
+		want      bool
+		wantErr   bool
+	}{
+		{name: "as signed", key: signed.PublicKey, report: signed.Report, signature: signed.Signature, want: true},
+		{name: "passed on", key: passedOn.PublicKey, report: passedOn.Report, signature: passedOn.Signature, want: true},
+		{name: "pretty printed", key: signed.PublicKey, report: pretty.Bytes(), signature: signed.Signature, want: true},
+		{
+			name:      "tampered",
+			key:       signed.PublicKey,
+			report:    bytes.Replace(signed.Report, []byte("host-a"), []byte("host-b"), 1),
+			signature: signed.Signature,
+		},
+		{
+			name:      "tampered and pretty printed",
+			key:       signed.PublicKey,
+			report:    bytes.Replace(pretty.Bytes(), []byte(`"bb"`), []byte(`"aa"`), 1),
+			signature: signed.Signature,
+		},
+		{name: "someone else's key", key: other, report: signed.Report, signature: signed.Signature},
+		{name: "no signature", key: signed.PublicKey, report: signed.Report},
+		{name: "short key", key: signed.PublicKey[:16], report: signed.Report, signature: signed.Signature, wantErr: true},
+		{name: "not JSON", key: signed.PublicKey, report: []byte("host-a"), signature: signed.Signature, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Verify(tt.key, tt.report, tt.signature)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "fim_ed25519.pem")
+
+	created, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.Equal(loaded) {
+		t.Error("got a different key the second time")
+	}
+}
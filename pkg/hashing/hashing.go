@@ -0,0 +1,86 @@
+package hashing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/time/rate"
+)
+
+// chunkSize is how much is read at a time, and so the most the limiter is asked for at once.
+const chunkSize = 1 << 20
+
+// Sums are the digests of a file's contents, hex encoded.
+type Sums struct {
+	SHA256 string
+	XXHash string
+}
+
+// Hasher computes Sums, reading no faster than its rate limit. A single Hasher is meant to be
+// shared, so that the limit holds across everything it hashes.
+type Hasher struct {
+	limiter *rate.Limiter
+}
+
+// NewHasher creates a Hasher that reads at most `bytesPerSecond`, or as fast as it can if that's
+// zero or less.
+func NewHasher(bytesPerSecond int) *Hasher {
+	if bytesPerSecond <= 0 {
+		return &Hasher{limiter: rate.NewLimiter(rate.Inf, chunkSize)}
+	}
+
+	return &Hasher{limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), min(bytesPerSecond, chunkSize))}
+}
+
+// HashFile hashes the contents of the file at `path`.
+func (h *Hasher) HashFile(ctx context.Context, path string) (Sums, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Sums{}, err
+	}
+	defer f.Close()
+
+	return h.Hash(ctx, f)
+}
+
+// Hash hashes everything read from `r`, stopping early if `ctx` is cancelled.
+func (h *Hasher) Hash(ctx context.Context, r io.Reader) (Sums, error) {
+	sha := sha256.New()
+	xx := xxhash.New()
+
+	reader := &limitedReader{ctx: ctx, r: r, limiter: h.limiter}
+	if _, err := io.Copy(io.MultiWriter(sha, xx), reader); err != nil {
+		return Sums{}, err
+	}
+
+	return Sums{
+		SHA256: hex.EncodeToString(sha.Sum(nil)),
+		XXHash: fmt.Sprintf("%016x", xx.Sum64()),
+	}, nil
+}
+
+// limitedReader waits on the limiter for every read, so the bytes come through no faster than
+// it allows.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// Never ask the limiter for more than it can hand out at once
+	if burst := l.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+
+	if err := l.limiter.WaitN(l.ctx, len(p)); err != nil {
+		return 0, err
+	}
+
+	return l.r.Read(p)
+}
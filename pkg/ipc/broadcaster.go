@@ -1,59 +1,557 @@
 package ipc
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"fsd/internal/config"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	_ "github.com/mattn/go-sqlite3"
 	"go.uber.org/zap"
 )
 
-// Maps the broadcast channel to the identifier.
-type SubscriberMap map[chan Message]string
+// DeliveryPolicy decides what happens when a subscriber's channel is full.
+type DeliveryPolicy string
+
+const (
+	// Block waits for the subscriber to make room, holding up every other subscriber, for up to
+	// `broadcast_block_timeout` before dropping the message.
+	Block DeliveryPolicy = "block"
+
+	// DropOldest throws away the oldest queued message to make room for the new one.
+	DropOldest DeliveryPolicy = "drop-oldest"
+
+	// DropNewest throws away the new message.
+	DropNewest DeliveryPolicy = "drop-newest"
+
+	// SpillToDisk queues messages in a file until the subscriber catches up.
+	SpillToDisk DeliveryPolicy = "spill-to-disk"
+)
+
+func ParseDeliveryPolicy(policy string) (DeliveryPolicy, error) {
+	switch p := DeliveryPolicy(policy); p {
+	case Block, DropOldest, DropNewest, SpillToDisk:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid delivery policy: %s", policy)
+	}
+}
+
+// Subscriber is a single receiver of broadcast messages.
+type Subscriber struct {
+	identifier string
+	policy     DeliveryPolicy
+	ch         chan Message
+
+	// delivered and dropped count messages handed to, and thrown away for, this subscriber
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+
+	// spill is only set for the SpillToDisk policy
+	spill *spillQueue
+
+	// wake nudges the spill drainer when something new is spilled
+	wake chan struct{}
+
+	// lock guards replaying and backlog. While the subscriber is catching up from the event
+	// log, live messages are held in the backlog so they can't overtake the replay.
+	lock      sync.Mutex
+	replaying bool
+	backlog   []Message
+
+	// done stops the subscriber's background workers (spill drainer, replay) and any blocked
+	// sends, and workers tracks the workers so that Unsubscribe can wait for them to exit
+	done     chan struct{}
+	doneOnce sync.Once
+	workers  sync.WaitGroup
+}
+
+// SubscriberStats is a point-in-time view of a subscriber's delivery counters.
+type SubscriberStats struct {
+	Identifier    string         `json:"identifier"`
+	Policy        DeliveryPolicy `json:"policy"`
+	Delivered     uint64         `json:"delivered"`
+	Dropped       uint64         `json:"dropped"`
+	QueueDepth    int            `json:"queue_depth"`
+	QueueCapacity int            `json:"queue_capacity"`
+	Spilled       int            `json:"spilled"`
+}
+
+func (s *Subscriber) Stats() SubscriberStats {
+	spilled := 0
+	if s.spill != nil {
+		spilled = s.spill.Len()
+	}
+
+	return SubscriberStats{
+		Identifier:    s.identifier,
+		Policy:        s.policy,
+		Delivered:     s.delivered.Load(),
+		Dropped:       s.dropped.Load(),
+		QueueDepth:    len(s.ch) + spilled,
+		QueueCapacity: cap(s.ch),
+		Spilled:       spilled,
+	}
+}
+
+// deliver hands `msg` to the subscriber, unless it's still replaying in which case the message
+// waits its turn.
+func (s *Subscriber) deliver(msg Message) {
+	s.lock.Lock()
+	if s.replaying {
+		s.backlog = append(s.backlog, msg)
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+
+	s.send(msg)
+}
+
+// send hands `msg` to the subscriber according to its delivery policy.
+func (s *Subscriber) send(msg Message) {
+	switch s.policy {
+	case Block:
+		// Broadcasts are serialized, so this holds up everyone. It has to give up eventually,
+		// or a subscriber that broadcasts itself could never make room.
+		timeout := config.GetConfig().BroadcastBlockTimeout
+		giveUp := time.NewTimer(timeout)
+		defer giveUp.Stop()
+		warn := time.NewTimer(1 * time.Second)
+		defer warn.Stop()
+
+		for {
+			select {
+			case s.ch <- msg:
+				s.delivered.Add(1)
+				return
+			case <-warn.C:
+				zap.L().Warn("Subscriber delayed in processing for over a second!", zap.String("receiver", s.identifier))
+			case <-giveUp.C:
+				zap.L().Error("subscriber blocked for too long, dropping message", zap.String("receiver", s.identifier),
+					zap.Duration("timeout", timeout))
+				s.dropped.Add(1)
+				return
+			case <-s.done:
+				return
+			}
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- msg:
+				s.delivered.Add(1)
+				return
+			default:
+			}
+
+			// Make room, the subscriber may have beaten us to it
+			select {
+			case <-s.ch:
+				s.dropped.Add(1)
+			default:
+			}
+		}
+	case DropNewest:
+		select {
+		case s.ch <- msg:
+			s.delivered.Add(1)
+		default:
+			s.dropped.Add(1)
+		}
+	case SpillToDisk:
+		// Once anything is spilled, everything after it has to queue up behind it
+		if s.spill.Len() == 0 {
+			select {
+			case s.ch <- msg:
+				s.delivered.Add(1)
+				return
+			default:
+			}
+		}
+
+		if err := s.spill.Push(msg); err != nil {
+			zap.L().Error("failed to spill message", zap.String("receiver", s.identifier), zap.Error(err))
+			s.dropped.Add(1)
+			return
+		}
+
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// drainSpill feeds spilled messages back into the subscriber's channel as it makes room.
+func (s *Subscriber) drainSpill() {
+	defer s.workers.Done()
+
+	for {
+		msg, size, ok, err := s.spill.Peek()
+		if err != nil {
+			zap.L().Error("failed to read spilled message", zap.String("receiver", s.identifier), zap.Error(err))
+			if size > 0 {
+				// Unreadable, skip past it
+				s.spill.Advance(size)
+				s.dropped.Add(1)
+				continue
+			}
+			ok = false
+		}
+
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		select {
+		case s.ch <- msg:
+			s.delivered.Add(1)
+			if err := s.spill.Advance(size); err != nil {
+				zap.L().Error("failed to advance spill queue", zap.String("receiver", s.identifier), zap.Error(err))
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// replay sends the logged events after `after` up to and including `upTo`, then whatever was
+// broadcast in the meantime, before switching the subscriber over to live delivery.
+func (s *Subscriber) replay(b *Broadcaster, after uint64, upTo uint64) {
+	defer s.workers.Done()
+
+	b.waitLogged(upTo)
+
+	replayed := 0
+	for after < upTo {
+		events, err := b.readLog(context.Background(), after, upTo, 500)
+		if err != nil {
+			zap.L().Error("failed to read event log, skipping the rest of the replay", zap.String("receiver", s.identifier), zap.Error(err))
+			break
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		for _, e := range events {
+			select {
+			case s.ch <- e:
+				s.delivered.Add(1)
+				replayed++
+			case <-s.done:
+				return
+			}
+		}
+		after = events[len(events)-1].Seq
+	}
+
+	zap.L().Info("replayed events", zap.String("receiver", s.identifier), zap.Int("count", replayed))
+
+	for {
+		s.lock.Lock()
+		if len(s.backlog) == 0 {
+			s.replaying = false
+			s.lock.Unlock()
+			return
+		}
+		backlog := s.backlog
+		s.backlog = nil
+		s.lock.Unlock()
+
+		for _, msg := range backlog {
+			select {
+			case <-s.done:
+				return
+			default:
+				s.send(msg)
+			}
+		}
+	}
+}
+
+// Maps the broadcast channel to its subscriber.
+type SubscriberMap map[chan Message]*Subscriber
 
 type Broadcaster struct {
 	subscribers SubscriberMap
 	lock        sync.RWMutex
+
+	// broadcastLock serializes broadcasts so that messages reach every subscriber in the same
+	// order they were logged.
+	broadcastLock sync.Mutex
+
+	// lastSeq is the sequence number of the most recently broadcast message
+	lastSeq uint64
+
+	// pending are the messages waiting for writeLog, which signals logCond as it gets through
+	// them. logged is the last sequence number it's been through.
+	pending []logEntry
+	logged  uint64
+	logLock sync.Mutex
+	logCond *sync.Cond
+	logWake chan struct{}
+
+	// offsets are the last acknowledged sequence number for each subscriber
+	offsets     map[string]offset
+	offsetsLock sync.Mutex
+
+	// db is the sqlite database handle for the event log
+	db *sql.DB
 }
 
 func NewBroadcaster() *Broadcaster {
-	return &Broadcaster{
+	// The log writer shares the database with every task, so wait for the write lock rather
+	// than failing straight away
+	db, err := sql.Open("sqlite3", config.GetDBPath()+"?_busy_timeout=5000")
+	if err != nil {
+		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
+	}
+
+	return NewBroadcasterWithDB(db)
+}
+
+// NewBroadcasterWithDB is NewBroadcaster with the event log kept in `db` instead of fsd's own
+// database.
+func NewBroadcasterWithDB(db *sql.DB) *Broadcaster {
+	_, err := db.Exec(EVENT_LOG_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create event_log table", zap.Error(err))
+	}
+
+	_, err = db.Exec(EVENT_OFFSETS_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create event_offsets table", zap.Error(err))
+	}
+
+	// Sequence numbers are handed out here rather than by sqlite now, so carry on from the
+	// highest one it ever gave out, even if that entry has been trimmed since
+	var lastSeq uint64
+	err = db.QueryRow(`
+		SELECT MAX(
+			COALESCE((SELECT MAX(seq) FROM event_log), 0),
+			COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'event_log'), 0)
+		)
+	`).Scan(&lastSeq)
+	if err != nil {
+		zap.L().Fatal("failed to read event log position", zap.Error(err))
+	}
+
+	b := &Broadcaster{
 		subscribers: make(SubscriberMap),
+		lastSeq:     lastSeq,
+		logged:      lastSeq,
+		logWake:     make(chan struct{}, 1),
+		offsets:     make(map[string]offset),
+		db:          db,
+	}
+	b.logCond = sync.NewCond(&b.logLock)
+	go b.writeLog()
+
+	return b
+}
+
+// LastSeq returns the sequence number of the most recently broadcast message.
+func (b *Broadcaster) LastSeq() uint64 {
+	b.broadcastLock.Lock()
+	defer b.broadcastLock.Unlock()
+	return b.lastSeq
+}
+
+// ValidatePolicies reports every configured delivery policy that isn't one. It's kept apart
+// from Config.Validate since the config package can't import this one.
+func ValidatePolicies(c *config.Config) error {
+	var errs []error
+	if _, err := ParseDeliveryPolicy(c.BroadcastPolicy); err != nil {
+		errs = append(errs, fmt.Errorf("broadcast_policy: %w", err))
 	}
+	for identifier, policy := range c.SubscriberPolicies {
+		if _, err := ParseDeliveryPolicy(policy); err != nil {
+			errs = append(errs, fmt.Errorf("subscriber_policies.%s: %w", identifier, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// policyFor returns the configured delivery policy for `identifier`, falling back to the
+// default broadcast policy.
+func policyFor(identifier string) DeliveryPolicy {
+	policy, ok := config.GetConfig().SubscriberPolicies[identifier]
+	if !ok {
+		policy = config.GetConfig().BroadcastPolicy
+	}
+
+	p, err := ParseDeliveryPolicy(policy)
+	if err != nil {
+		zap.L().Warn("invalid delivery policy, dropping oldest instead", zap.String("receiver", identifier), zap.Error(err))
+		return DropOldest
+	}
+
+	return p
 }
 
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
 // Subscribe adds a new subscriber channel to the broadcaster which can
 // listen for any message type
 func (b *Broadcaster) Subscribe(identifier string) chan Message {
-	ch := make(chan Message, config.GetConfig().BroadcastBufferDepth)
+	return b.SubscribeWithPolicy(identifier, policyFor(identifier))
+}
+
+// SubscribeWithPolicy is Subscribe with an explicit delivery policy rather than the configured
+// one.
+func (b *Broadcaster) SubscribeWithPolicy(identifier string, policy DeliveryPolicy) chan Message {
+	sub := b.newSubscriber(identifier, policy)
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	b.subscribers[ch] = identifier
-	return ch
+	b.subscribers[sub.ch] = sub
+	return sub.ch
+}
+
+// SubscribeFrom subscribes like SubscribeWithPolicy, but first replays every logged message
+// with a sequence number greater than `after`. Messages that have already been trimmed from
+// the log are lost.
+func (b *Broadcaster) SubscribeFrom(identifier string, policy DeliveryPolicy, after uint64) chan Message {
+	sub := b.newSubscriber(identifier, policy)
+	sub.replaying = true
+
+	// Holding the broadcast lock means everything up to lastSeq is queued for the log, and
+	// everything after it will land in the backlog.
+	b.broadcastLock.Lock()
+	upTo := b.lastSeq
+	b.lock.Lock()
+	b.subscribers[sub.ch] = sub
+	b.lock.Unlock()
+	b.broadcastLock.Unlock()
+
+	sub.workers.Add(1)
+	go sub.replay(b, after, upTo)
+
+	return sub.ch
+}
+
+// Resume subscribes `identifier` from the last message it acknowledged, or from now if it
+// has never acknowledged anything.
+func (b *Broadcaster) Resume(identifier string) chan Message {
+	seq, ok := b.storedOffset(identifier)
+	if !ok {
+		return b.Subscribe(identifier)
+	}
+
+	zap.L().Info("resuming subscriber", zap.String("receiver", identifier), zap.Uint64("after", seq))
+	return b.SubscribeFrom(identifier, policyFor(identifier), seq)
+}
+
+func (b *Broadcaster) newSubscriber(identifier string, policy DeliveryPolicy) *Subscriber {
+	sub := &Subscriber{
+		identifier: identifier,
+		policy:     policy,
+		ch:         make(chan Message, config.GetConfig().BroadcastBufferDepth),
+		done:       make(chan struct{}),
+	}
+
+	if policy == SpillToDisk {
+		path := filepath.Join(config.GetSpillDir(), unsafeFileChars.ReplaceAllString(identifier, "_")+".jsonl")
+		spill, err := newSpillQueue(path)
+		if err != nil {
+			zap.L().Error("failed to create spill queue, dropping newest instead", zap.String("receiver", identifier), zap.Error(err))
+			sub.policy = DropNewest
+		} else {
+			sub.spill = spill
+			sub.wake = make(chan struct{}, 1)
+			sub.workers.Add(1)
+			go sub.drainSpill()
+		}
+	}
+
+	return sub
 }
 
 // Unsubscribe removes a subscriber channel from the broadcaster
 func (b *Broadcaster) Unsubscribe(ch chan Message) {
+	b.lock.RLock()
+	sub, ok := b.subscribers[ch]
+	b.lock.RUnlock()
+	if !ok {
+		return
+	}
+
+	// Release anything blocked sending to this subscriber first, otherwise a blocking
+	// Broadcast would hold the lock we need forever.
+	sub.doneOnce.Do(func() { close(sub.done) })
+
 	b.lock.Lock()
-	defer b.lock.Unlock()
-	if _, ok := b.subscribers[ch]; ok {
-		delete(b.subscribers, ch)
-		close(ch)
+	if _, ok := b.subscribers[ch]; !ok {
+		b.lock.Unlock()
+		return
+	}
+	delete(b.subscribers, ch)
+	b.lock.Unlock()
+
+	// Background workers have to be gone before the channel is closed under them
+	sub.workers.Wait()
+	if sub.spill != nil {
+		if err := sub.spill.Close(); err != nil {
+			zap.L().Warn("failed to clean up spill queue", zap.String("receiver", sub.identifier), zap.Error(err))
+		}
 	}
+	close(ch)
+}
+
+// Stats returns the delivery counters for every subscriber, ordered by identifier.
+func (b *Broadcaster) Stats() []SubscriberStats {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	stats := make([]SubscriberStats, 0, len(b.subscribers))
+	for _, sub := range b.subscribers {
+		stats = append(stats, sub.Stats())
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Identifier < stats[j].Identifier
+	})
+
+	return stats
 }
 
-// Broadcast sends a broadcast message to all subscriber channels
+// Broadcast queues the message for the log and sends it to all subscriber channels
 func (b *Broadcaster) Broadcast(msg Message) {
+	b.broadcastLock.Lock()
+	defer b.broadcastLock.Unlock()
+
+	event := Event{
+		Timestamp: time.Now(),
+		Message:   Unwrap(msg),
+	}
+
+	seq := b.lastSeq + 1
+	if err := b.queueLog(seq, event.Message, event.Timestamp); err != nil {
+		// Still worth delivering, it just can't be replayed
+		zap.L().Error("failed to append to event log", zap.Error(err))
+	} else {
+		event.Seq = seq
+		b.lastSeq = seq
+	}
+
 	b.lock.RLock()
 	defer b.lock.RUnlock()
-	for ch, receiver := range b.subscribers {
-		// Send the message to everyone
-		select {
-		case ch <- msg:
-		case <-time.After(1 * time.Second):
-			// default allows for non-blocking I/O, but we still want to warn for lag
-			zap.L().Warn("Subscriber dealyed in processing for over a second!", zap.String("receiver", receiver))
-		default:
-		}
+	for _, sub := range b.subscribers {
+		sub.deliver(event)
 	}
 }
@@ -0,0 +1,69 @@
+package ipc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	messageTypes     = make(map[string]reflect.Type)
+	messageTypesLock sync.RWMutex
+)
+
+// RegisterMessage makes a message type known so that it can be decoded again after being
+// written out (e.g. spilled to disk). Message types should register themselves in init().
+func RegisterMessage(msg Message) {
+	t := reflect.TypeOf(msg)
+	messageTypesLock.Lock()
+	defer messageTypesLock.Unlock()
+	messageTypes[t.Name()] = t
+}
+
+// MessageKind returns the name a message is registered under.
+func MessageKind(msg Message) string {
+	return reflect.TypeOf(msg).Name()
+}
+
+// EncodedMessage is a message along with the name of its type, so it can be decoded without
+// knowing what it is ahead of time.
+type EncodedMessage struct {
+	Kind    string          `json:"kind"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// EncodeMessage serializes `msg` along with its type.
+func EncodeMessage(msg Message) (EncodedMessage, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return EncodedMessage{}, err
+	}
+
+	return EncodedMessage{
+		Kind:    MessageKind(msg),
+		Payload: payload,
+	}, nil
+}
+
+// DecodeMessage turns an encoded message back into its original type.
+func DecodeMessage(encoded EncodedMessage) (Message, error) {
+	messageTypesLock.RLock()
+	t, ok := messageTypes[encoded.Kind]
+	messageTypesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown message kind: %s", encoded.Kind)
+	}
+
+	v := reflect.New(t)
+	if err := json.Unmarshal(encoded.Payload, v.Interface()); err != nil {
+		return nil, err
+	}
+
+	msg, ok := v.Elem().Interface().(Message)
+	if !ok {
+		return nil, fmt.Errorf("registered kind %s is not a message", encoded.Kind)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,71 @@
+package ipc
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Event is a message as it was broadcast, stamped with its position in the event log. The
+// broadcaster wraps every message in one, so subscribers that need the concrete message type
+// should go through Unwrap.
+type Event struct {
+	// Seq is the message's sequence number in the event log. It only ever increases, and is
+	// zero if the message couldn't be logged.
+	Seq uint64
+
+	// Timestamp is when the message was broadcast
+	Timestamp time.Time
+
+	// Message is the message that was broadcast
+	Message Message
+}
+
+func (e Event) String() (string, error) {
+	return e.Message.String()
+}
+
+func (e Event) EventName() string {
+	return e.Message.EventName()
+}
+
+func (e Event) EventOperation() FsdOp {
+	return e.Message.EventOperation()
+}
+
+// MarshalJSON renders the event with its envelope, which is what API clients see.
+func (e Event) MarshalJSON() ([]byte, error) {
+	payload, err := json.Marshal(e.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		Seq       uint64          `json:"seq"`
+		Timestamp time.Time       `json:"timestamp"`
+		Kind      string          `json:"kind"`
+		Operation string          `json:"operation"`
+		Message   json.RawMessage `json:"message"`
+	}{
+		Seq:       e.Seq,
+		Timestamp: e.Timestamp,
+		Kind:      MessageKind(e.Message),
+		Operation: e.Message.EventOperation().String(),
+		Message:   payload,
+	})
+}
+
+// Unwrap returns the message inside an Event, or `msg` itself if it isn't one.
+func Unwrap(msg Message) Message {
+	if e, ok := msg.(Event); ok {
+		return e.Message
+	}
+	return msg
+}
+
+// Sequence returns the sequence number of `msg`, or zero if it wasn't broadcast.
+func Sequence(msg Message) uint64 {
+	if e, ok := msg.(Event); ok {
+		return e.Seq
+	}
+	return 0
+}
@@ -0,0 +1,268 @@
+package ipc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EVENT_LOG_CREATE creates the durable log of every broadcast message. AUTOINCREMENT keeps
+// sequence numbers from ever being reused, even after old entries are trimmed.
+const EVENT_LOG_CREATE string = `
+	CREATE TABLE IF NOT EXISTS event_log (
+		seq INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		operation INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	)
+`
+
+// EVENT_OFFSETS_CREATE creates the table of the last sequence number each subscriber has
+// processed, so it can pick up where it left off after a restart.
+const EVENT_OFFSETS_CREATE string = `
+	CREATE TABLE IF NOT EXISTS event_offsets (
+		subscriber TEXT NOT NULL PRIMARY KEY,
+		seq INTEGER NOT NULL,
+		updated_at DATETIME NOT NULL
+	)
+`
+
+// offsetFlushInterval is how often a subscriber's acknowledged offset is written out. Losing
+// up to this much on a crash just means a few messages are replayed.
+const offsetFlushInterval = 1 * time.Second
+
+type offset struct {
+	seq     uint64
+	flushed time.Time
+}
+
+// logEntry is a broadcast message waiting to be written to the event log.
+type logEntry struct {
+	seq     uint64
+	encoded EncodedMessage
+	name    string
+	op      FsdOp
+	created time.Time
+}
+
+// queueLog hands `msg` to the log writer under `seq`. It doesn't wait for the write, so a slow
+// database doesn't hold up broadcasts.
+func (b *Broadcaster) queueLog(seq uint64, msg Message, timestamp time.Time) error {
+	encoded, err := EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	b.logLock.Lock()
+	b.pending = append(b.pending, logEntry{
+		seq:     seq,
+		encoded: encoded,
+		name:    msg.EventName(),
+		op:      msg.EventOperation(),
+		created: timestamp,
+	})
+	b.logLock.Unlock()
+
+	select {
+	case b.logWake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// writeLog writes queued messages to the event log as they come in, everything that's queued
+// up at once in a single transaction.
+func (b *Broadcaster) writeLog() {
+	for range b.logWake {
+		b.logLock.Lock()
+		batch := b.pending
+		b.pending = nil
+		b.logLock.Unlock()
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		if err := b.insertLog(batch); err != nil {
+			// They've still been delivered, they just can't be replayed
+			zap.L().Error("failed to append to event log", zap.Int("count", len(batch)), zap.Error(err))
+		}
+
+		b.logLock.Lock()
+		b.logged = batch[len(batch)-1].seq
+		b.logCond.Broadcast()
+		b.logLock.Unlock()
+	}
+}
+
+func (b *Broadcaster) insertLog(batch []logEntry) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range batch {
+		_, err := tx.Exec(`
+			INSERT INTO event_log (seq, kind, name, operation, payload, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		`, e.seq, e.encoded.Kind, e.name, e.op, string(e.encoded.Payload), e.created)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// waitLogged waits until every message up to and including `seq` has been through the writer.
+func (b *Broadcaster) waitLogged(seq uint64) {
+	b.logLock.Lock()
+	defer b.logLock.Unlock()
+	for b.logged < seq {
+		b.logCond.Wait()
+	}
+}
+
+// FlushLog waits for everything broadcast so far to be written to the event log. Call this on
+// shutdown so that nothing is lost from the replay.
+func (b *Broadcaster) FlushLog() {
+	b.waitLogged(b.LastSeq())
+}
+
+// ReadLog returns up to `limit` logged events with a sequence number greater than `after`,
+// oldest first.
+func (b *Broadcaster) ReadLog(ctx context.Context, after uint64, limit int) ([]Event, error) {
+	b.waitLogged(b.LastSeq())
+	return b.readLog(ctx, after, 0, limit)
+}
+
+// readLog is ReadLog, optionally stopping at `upTo` (inclusive) if it's non-zero.
+func (b *Broadcaster) readLog(ctx context.Context, after uint64, upTo uint64, limit int) ([]Event, error) {
+	query := `
+		SELECT seq, kind, payload, created_at FROM event_log
+		WHERE seq > ? AND (? = 0 OR seq <= ?)
+		ORDER BY seq
+		LIMIT ?
+	`
+
+	rows, err := b.db.QueryContext(ctx, query, after, upTo, upTo, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		var encoded EncodedMessage
+		var payload string
+		if err := rows.Scan(&e.Seq, &encoded.Kind, &payload, &e.Timestamp); err != nil {
+			return nil, err
+		}
+
+		encoded.Payload = json.RawMessage(payload)
+		e.Message, err = DecodeMessage(encoded)
+		if err != nil {
+			// Most likely a message type that no longer exists, not worth stopping over
+			zap.L().Warn("skipping undecodable event", zap.Uint64("seq", e.Seq), zap.Error(err))
+			continue
+		}
+
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// TrimLog deletes logged events older than `retention`.
+func (b *Broadcaster) TrimLog(ctx context.Context, retention time.Duration) (int64, error) {
+	result, err := b.db.ExecContext(ctx, `
+		DELETE FROM event_log WHERE created_at < ?
+	`, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Ack records that `identifier` has finished processing `msg`, so that Resume can pick up
+// after it.
+func (b *Broadcaster) Ack(identifier string, msg Message) {
+	seq := Sequence(msg)
+	if seq == 0 {
+		return
+	}
+
+	b.offsetsLock.Lock()
+	defer b.offsetsLock.Unlock()
+
+	o := b.offsets[identifier]
+	if seq <= o.seq {
+		return
+	}
+	o.seq = seq
+
+	if time.Since(o.flushed) >= offsetFlushInterval {
+		_, err := b.db.Exec(`
+			INSERT INTO event_offsets (subscriber, seq, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT(subscriber) DO UPDATE SET seq = excluded.seq, updated_at = excluded.updated_at
+		`, identifier, seq, time.Now())
+		if err != nil {
+			zap.L().Error("failed to store event offset", zap.String("receiver", identifier), zap.Error(err))
+		} else {
+			o.flushed = time.Now()
+		}
+	}
+
+	b.offsets[identifier] = o
+}
+
+// FlushOffsets writes out every acknowledged offset that hasn't been stored yet. Call this on
+// shutdown so that subscribers don't replay more than they need to.
+func (b *Broadcaster) FlushOffsets() {
+	b.offsetsLock.Lock()
+	defer b.offsetsLock.Unlock()
+
+	for identifier, o := range b.offsets {
+		_, err := b.db.Exec(`
+			INSERT INTO event_offsets (subscriber, seq, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT(subscriber) DO UPDATE SET seq = excluded.seq, updated_at = excluded.updated_at
+		`, identifier, o.seq, time.Now())
+		if err != nil {
+			zap.L().Error("failed to store event offset", zap.String("receiver", identifier), zap.Error(err))
+			continue
+		}
+
+		o.flushed = time.Now()
+		b.offsets[identifier] = o
+	}
+}
+
+// storedOffset returns the last acknowledged sequence number for `identifier`, if any.
+func (b *Broadcaster) storedOffset(identifier string) (uint64, bool) {
+	var seq uint64
+	err := b.db.QueryRow(`
+		SELECT seq FROM event_offsets WHERE subscriber = ?
+	`, identifier).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false
+	}
+	if err != nil {
+		zap.L().Error("failed to load event offset", zap.String("receiver", identifier), zap.Error(err))
+		return 0, false
+	}
+
+	return seq, true
+}
@@ -0,0 +1,96 @@
+package ipc
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// MultiPathMessage is implemented by messages that concern more than one path, such as moves.
+type MultiPathMessage interface {
+	EventPaths() []string
+}
+
+// ParseFsdOp is the inverse of FsdOp.String, ignoring case. Invalid isn't something that can
+// be asked for, so its name is rejected like any other unknown one.
+func ParseFsdOp(name string) (FsdOp, error) {
+	for op := Create; op <= maxFsdOp; op++ {
+		if op == Invalid {
+			continue
+		}
+		if strings.EqualFold(op.String(), name) {
+			return op, nil
+		}
+	}
+
+	return Invalid, fmt.Errorf("invalid operation: %s", name)
+}
+
+// Filter selects messages by path and operation. Empty fields match everything.
+type Filter struct {
+	// Prefixes match when a message path is one of them or sits underneath one of them
+	Prefixes []string
+
+	// Globs are matched against both the full path and the file name
+	Globs []string
+
+	// Operations is the set of operations to let through
+	Operations map[FsdOp]bool
+}
+
+// Match reports whether `msg` passes the filter.
+func (f Filter) Match(msg Message) bool {
+	if len(f.Operations) > 0 && !f.Operations[msg.EventOperation()] {
+		return false
+	}
+
+	if len(f.Prefixes) == 0 && len(f.Globs) == 0 {
+		return true
+	}
+
+	paths := []string{msg.EventName()}
+	if mp, ok := Unwrap(msg).(MultiPathMessage); ok {
+		paths = mp.EventPaths()
+	}
+
+	for _, path := range paths {
+		if f.MatchPath(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchPath reports whether `path` passes the prefix and glob parts of the filter.
+func (f Filter) MatchPath(path string) bool {
+	if len(f.Prefixes) > 0 {
+		matched := false
+		for _, prefix := range f.Prefixes {
+			prefix = strings.TrimSuffix(prefix, "/")
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(f.Globs) > 0 {
+		for _, glob := range f.Globs {
+			if ok, _ := filepath.Match(glob, path); ok {
+				return true
+			}
+			if ok, _ := filepath.Match(glob, filepath.Base(path)); ok {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
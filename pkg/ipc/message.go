@@ -28,8 +28,26 @@ const (
 
 	// A compaction operation needs to happen
 	Compact
+
+	// A path was moved, and both the old and new paths are known.
+	Move
+
+	// A file has stopped being written to.
+	Settled
+
+	// A path should be re-read from disk and the index brought up to date.
+	Rescan
+
+	// A proc finished running, successfully or otherwise.
+	ProcCompleted
+
+	// A file's contents no longer match its checksum, though its size and mtime haven't changed.
+	Corrupt
 )
 
+// maxFsdOp is the last valid operation, for iterating over all of them.
+const maxFsdOp = Corrupt
+
 func (o FsdOp) String() string {
 	switch o {
 	case Create:
@@ -44,6 +62,16 @@ func (o FsdOp) String() string {
 		return "Write"
 	case Compact:
 		return "Compact"
+	case Move:
+		return "Move"
+	case Settled:
+		return "Settled"
+	case Rescan:
+		return "Rescan"
+	case ProcCompleted:
+		return "ProcCompleted"
+	case Corrupt:
+		return "Corrupt"
 	default:
 		return "InvalidOperation"
 	}
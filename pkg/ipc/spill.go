@@ -0,0 +1,158 @@
+package ipc
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// spilledMessage is a line of the spill file. Events are spilled as the message inside them
+// along with their envelope, since only the inner message has a kind that can be decoded.
+type spilledMessage struct {
+	Message EncodedMessage `json:"message"`
+
+	// Event is set if the message was broadcast, and Seq and Timestamp are its envelope
+	Event     bool      `json:"event,omitempty"`
+	Seq       uint64    `json:"seq,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// spillQueue is an append-only FIFO of messages backed by a file. Messages are only removed
+// once they've been handed to the subscriber, so a queue with a non-zero length always has
+// something in flight and new messages must go behind it.
+type spillQueue struct {
+	lock sync.Mutex
+
+	path string
+	file *os.File
+
+	// readOffset and writeOffset are the byte offsets of the next message to read, and the
+	// end of the file respectively.
+	readOffset  int64
+	writeOffset int64
+
+	// count is the number of messages not yet handed off
+	count int
+}
+
+func newSpillQueue(path string) (*spillQueue, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// Anything left over from a previous run belonged to a subscriber that no longer exists
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &spillQueue{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// Len returns the number of messages waiting in the queue.
+func (q *spillQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.count
+}
+
+// Push appends `msg` to the end of the queue.
+func (q *spillQueue) Push(msg Message) error {
+	var spilled spilledMessage
+	if e, ok := msg.(Event); ok {
+		spilled = spilledMessage{Event: true, Seq: e.Seq, Timestamp: e.Timestamp}
+	}
+
+	var err error
+	spilled.Message, err = EncodeMessage(Unwrap(msg))
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(spilled)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n, err := q.file.WriteAt(line, q.writeOffset)
+	if err != nil {
+		return err
+	}
+
+	q.writeOffset += int64(n)
+	q.count++
+	return nil
+}
+
+// Peek returns the message at the front of the queue without removing it, along with its size
+// on disk which must be passed to Advance once it has been handed off.
+func (q *spillQueue) Peek() (Message, int64, bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.count == 0 {
+		return nil, 0, false, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(q.file, q.readOffset, q.writeOffset-q.readOffset))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	var spilled spilledMessage
+	if err := json.Unmarshal(line, &spilled); err != nil {
+		return nil, int64(len(line)), false, err
+	}
+
+	msg, err := DecodeMessage(spilled.Message)
+	if err != nil {
+		return nil, int64(len(line)), false, err
+	}
+
+	if spilled.Event {
+		msg = Event{Seq: spilled.Seq, Timestamp: spilled.Timestamp, Message: msg}
+	}
+
+	return msg, int64(len(line)), true, nil
+}
+
+// Advance removes the message at the front of the queue.
+func (q *spillQueue) Advance(size int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.readOffset += size
+	q.count--
+	if q.count > 0 {
+		return nil
+	}
+
+	// Drained, so start the file over rather than letting it grow forever
+	q.readOffset = 0
+	q.writeOffset = 0
+	return q.file.Truncate(0)
+}
+
+// Close closes and removes the backing file.
+func (q *spillQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(q.path)
+}
@@ -0,0 +1,74 @@
+package ipc
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	Name string `json:"name"`
+}
+
+func (m testMessage) String() (string, error) {
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+func (m testMessage) EventName() string {
+	return m.Name
+}
+
+func (m testMessage) EventOperation() FsdOp {
+	return Write
+}
+
+func TestSpillQueue(t *testing.T) {
+	RegisterMessage(testMessage{})
+
+	q, err := newSpillQueue(filepath.Join(t.TempDir(), "spill", "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	timestamp := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	in := []Message{
+		Event{Seq: 7, Timestamp: timestamp, Message: testMessage{Name: "/a"}},
+		testMessage{Name: "/b"},
+		Event{Seq: 8, Timestamp: timestamp.Add(time.Second), Message: testMessage{Name: "/c"}},
+	}
+	for _, msg := range in {
+		if err := q.Push(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range in {
+		got, size, ok, err := q.Peek()
+		if err != nil || !ok {
+			t.Fatalf("%d: got ok %v, error %v", i, ok, err)
+		}
+
+		if e, isEvent := want.(Event); isEvent {
+			ge, ok := got.(Event)
+			if !ok {
+				t.Fatalf("%d: got %T, want an Event", i, got)
+			}
+			if ge.Seq != e.Seq || !ge.Timestamp.Equal(e.Timestamp) || ge.Message != e.Message {
+				t.Errorf("%d: got %+v, want %+v", i, ge, e)
+			}
+		} else if got != want {
+			t.Errorf("%d: got %+v, want %+v", i, got, want)
+		}
+
+		if err := q.Advance(size); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, ok, err := q.Peek(); ok || err != nil {
+		t.Errorf("got ok %v, error %v from an empty queue", ok, err)
+	}
+}
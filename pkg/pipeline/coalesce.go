@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"context"
+	"fsd/pkg/ipc"
+	"fsd/pkg/tasks"
+	"slices"
+	"time"
+)
+
+type pendingEvent struct {
+	msg   tasks.FsMessage
+	first time.Time
+}
+
+// Coalescer merges bursts of Write and Chmod events for the same path into a single message.
+// The first event for a path opens a window, and any repeats that arrive before it closes are
+// folded into it, with Count tracking how many raw events the emitted message stands for. Any
+// other operation on the path flushes what's pending first so ordering per path is preserved.
+type Coalescer struct {
+	// window is how long repeated events are collected before being emitted
+	window time.Duration
+
+	// pending are the merged events waiting for their window to close, by path
+	pending map[string]*pendingEvent
+
+	// order is the paths in pending, in the order they were first seen
+	order []string
+}
+
+func NewCoalescer(window time.Duration) *Coalescer {
+	return &Coalescer{
+		window:  window,
+		pending: make(map[string]*pendingEvent),
+	}
+}
+
+func (c *Coalescer) Run(ctx context.Context, in <-chan tasks.FsMessage, out chan<- tasks.FsMessage) {
+	ticker := time.NewTicker(c.window / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-in:
+			c.handle(ctx, msg, out)
+		case now := <-ticker.C:
+			c.expire(ctx, now, out)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Coalescer) handle(ctx context.Context, msg tasks.FsMessage, out chan<- tasks.FsMessage) {
+	switch msg.Operation {
+	case ipc.Write, ipc.Chmod:
+		if p, ok := c.pending[msg.Name]; ok {
+			if p.msg.Operation == msg.Operation {
+				p.msg.Count += msg.Count
+				return
+			}
+
+			c.flush(ctx, msg.Name, out)
+		}
+
+		c.pending[msg.Name] = &pendingEvent{msg: msg, first: time.Now()}
+		c.order = append(c.order, msg.Name)
+	case ipc.Move:
+		c.flush(ctx, msg.From, out)
+		c.flush(ctx, msg.To, out)
+		emit(ctx, out, msg)
+	default:
+		c.flush(ctx, msg.Name, out)
+		emit(ctx, out, msg)
+	}
+}
+
+// flush emits whatever is pending for `path` right away.
+func (c *Coalescer) flush(ctx context.Context, path string, out chan<- tasks.FsMessage) {
+	p, ok := c.pending[path]
+	if !ok {
+		return
+	}
+
+	delete(c.pending, path)
+	if i := slices.Index(c.order, path); i >= 0 {
+		c.order = slices.Delete(c.order, i, i+1)
+	}
+	emit(ctx, out, p.msg)
+}
+
+// expire emits everything whose window has closed, oldest first.
+func (c *Coalescer) expire(ctx context.Context, now time.Time, out chan<- tasks.FsMessage) {
+	remaining := c.order[:0]
+	for _, path := range c.order {
+		p := c.pending[path]
+		if now.Sub(p.first) < c.window {
+			remaining = append(remaining, path)
+			continue
+		}
+
+		delete(c.pending, path)
+		emit(ctx, out, p.msg)
+	}
+
+	c.order = remaining
+}
@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"context"
+	"fsd/pkg/ipc"
+	"fsd/pkg/tasks"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	const window = time.Second
+
+	write := func(path string) tasks.FsMessage {
+		return tasks.FsMessage{Name: path, Operation: ipc.Write, Count: 1}
+	}
+	chmod := func(path string) tasks.FsMessage {
+		return tasks.FsMessage{Name: path, Operation: ipc.Chmod, Count: 1}
+	}
+
+	// event is what's expected to come out, as the op, path and count
+	type event struct {
+		op    ipc.FsdOp
+		path  string
+		count int
+	}
+
+	tests := []struct {
+		name string
+		in   []tasks.FsMessage
+
+		// early is what comes out before any window closes, and late is what comes out once
+		// they all have
+		early []event
+		late  []event
+	}{
+		{
+			name: "merged",
+			in:   []tasks.FsMessage{write("/a"), write("/a"), write("/a")},
+			late: []event{{ipc.Write, "/a", 3}},
+		},
+		{
+			name: "separate paths",
+			in:   []tasks.FsMessage{write("/a"), write("/b"), write("/a")},
+			late: []event{{ipc.Write, "/a", 2}, {ipc.Write, "/b", 1}},
+		},
+		{
+			name:  "op switch",
+			in:    []tasks.FsMessage{write("/a"), write("/a"), chmod("/a"), write("/b"), write("/a")},
+			early: []event{{ipc.Write, "/a", 2}, {ipc.Chmod, "/a", 1}},
+			late:  []event{{ipc.Write, "/b", 1}, {ipc.Write, "/a", 1}},
+		},
+		{
+			name:  "other ops flush",
+			in:    []tasks.FsMessage{write("/a"), {Name: "/a", Operation: ipc.Remove, Count: 1}, write("/a")},
+			early: []event{{ipc.Write, "/a", 1}, {ipc.Remove, "/a", 1}},
+			late:  []event{{ipc.Write, "/a", 1}},
+		},
+		{
+			name: "move flushes both paths",
+			in:   []tasks.FsMessage{write("/a"), write("/b"), write("/c"), tasks.NewMoveMessage("/a", "/b")},
+			early: []event{
+				{ipc.Write, "/a", 1},
+				{ipc.Write, "/b", 1},
+				{ipc.Move, "/b", 2},
+			},
+			late: []event{{ipc.Write, "/c", 1}},
+		},
+	}
+
+	collect := func(out chan tasks.FsMessage) []event {
+		var got []event
+		for _, msg := range drain(out) {
+			got = append(got, event{msg.Operation, msg.Name, msg.Count})
+		}
+		return got
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := NewCoalescer(window)
+			out := make(chan tasks.FsMessage, 10)
+			for _, msg := range tt.in {
+				c.handle(ctx, msg, out)
+			}
+
+			c.expire(ctx, time.Now().Add(window/2), out)
+			if got := collect(out); !slices.Equal(got, tt.early) {
+				t.Errorf("got %v before the window closed, want %v", got, tt.early)
+			}
+
+			c.expire(ctx, time.Now().Add(2*window), out)
+			if got := collect(out); !slices.Equal(got, tt.late) {
+				t.Errorf("got %v after the window closed, want %v", got, tt.late)
+			}
+
+			if len(c.pending) != 0 || len(c.order) != 0 {
+				t.Errorf("got %d pending and %d in order, want nothing left", len(c.pending), len(c.order))
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package pipeline
+
+import (
+	"context"
+	"fsd/internal/config"
+	"fsd/pkg/ipc"
+	"fsd/pkg/tasks"
+
+	"go.uber.org/zap"
+)
+
+// Stage is a single step between the fsnotify watcher and the broadcaster. A stage may hold,
+// merge or rewrite messages, but anything it doesn't consume must eventually be passed on.
+type Stage interface {
+	// Run reads messages from `in` and writes its output to `out` until `ctx` is done.
+	Run(ctx context.Context, in <-chan tasks.FsMessage, out chan<- tasks.FsMessage)
+}
+
+// Run chains `stages` together in order and broadcasts whatever comes out of the last one. The
+// returned channel is the head of the pipeline, which raw filesystem events should be sent to.
+func Run(ctx context.Context, broadcaster *ipc.Broadcaster, stages ...Stage) chan<- tasks.FsMessage {
+	depth := config.GetConfig().BroadcastBufferDepth
+
+	head := make(chan tasks.FsMessage, depth)
+	var in <-chan tasks.FsMessage = head
+	for _, stage := range stages {
+		out := make(chan tasks.FsMessage, depth)
+		go stage.Run(ctx, in, out)
+		in = out
+	}
+
+	go func() {
+		for {
+			select {
+			case msg := <-in:
+				broadcaster.Broadcast(msg)
+			case <-ctx.Done():
+				zap.L().Info("got shutdown signal, exiting", zap.String("task name", "Pipeline"))
+				return
+			}
+		}
+	}()
+
+	return head
+}
+
+// emit sends `msg` to the next stage, giving up if we're shutting down.
+func emit(ctx context.Context, out chan<- tasks.FsMessage, msg tasks.FsMessage) {
+	select {
+	case out <- msg:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,187 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"fsd/internal/config"
+	"fsd/pkg/ipc"
+	"fsd/pkg/tasks"
+	"os"
+	"syscall"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+// recentTTL is how long we remember the inode of a freshly created path. It only has to cover
+// the gap until the metadata index catches up with the Create.
+const recentTTL = 5 * time.Second
+
+type recentInode struct {
+	inode    uint64
+	deadline time.Time
+}
+
+type pendingRename struct {
+	msg      tasks.FsMessage
+	inode    uint64
+	deadline time.Time
+}
+
+// RenamePairer joins the two halves of a rename into a single Move event. inotify reports a
+// rename as a Rename for the old path followed by a Create for the new one, so we hold on to
+// each Rename for a short window and pair it with a Create for the same inode. Renames that
+// never find a partner (e.g. moved out of the root) are passed on unchanged.
+type RenamePairer struct {
+	// window is how long a Rename waits for its Create
+	window time.Duration
+
+	// db is used to look up the inode of the old path, which no longer exists to stat
+	db *sql.DB
+
+	// pending are renames waiting for their Create, oldest first
+	pending []pendingRename
+
+	// paired remembers recently paired old paths so that the extra Rename inotify sends for a
+	// moved directory (IN_MOVE_SELF) doesn't show up as a second, unpaired rename.
+	paired map[string]time.Time
+
+	// recent holds inodes of paths created in the last few seconds, which may not have made it
+	// into the index yet
+	recent map[string]recentInode
+}
+
+func NewRenamePairer(window time.Duration) *RenamePairer {
+	db, err := sql.Open("sqlite3", config.GetDBPath())
+	if err != nil {
+		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
+	}
+
+	return &RenamePairer{
+		window: window,
+		db:     db,
+		paired: make(map[string]time.Time),
+		recent: make(map[string]recentInode),
+	}
+}
+
+func (rp *RenamePairer) Run(ctx context.Context, in <-chan tasks.FsMessage, out chan<- tasks.FsMessage) {
+	ticker := time.NewTicker(rp.window / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-in:
+			rp.handle(ctx, msg, out)
+		case now := <-ticker.C:
+			rp.expire(ctx, now, out)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (rp *RenamePairer) handle(ctx context.Context, msg tasks.FsMessage, out chan<- tasks.FsMessage) {
+	switch msg.Operation {
+	case ipc.Rename:
+		if _, ok := rp.paired[msg.Name]; ok {
+			return
+		}
+
+		for _, p := range rp.pending {
+			if p.msg.Name == msg.Name {
+				return
+			}
+		}
+
+		inode, ok := rp.lookupInode(ctx, msg.Name)
+		if !ok {
+			// We never indexed it, so there's nothing to pair on
+			emit(ctx, out, msg)
+			return
+		}
+
+		rp.pending = append(rp.pending, pendingRename{
+			msg:      msg,
+			inode:    inode,
+			deadline: time.Now().Add(rp.window),
+		})
+	case ipc.Create:
+		inode, ok := statInode(msg.Name)
+		if ok {
+			rp.recent[msg.Name] = recentInode{inode: inode, deadline: time.Now().Add(recentTTL)}
+
+			for i, p := range rp.pending {
+				if p.inode != inode {
+					continue
+				}
+
+				rp.pending = append(rp.pending[:i], rp.pending[i+1:]...)
+				rp.paired[p.msg.Name] = time.Now().Add(rp.window)
+
+				zap.L().Debug("paired rename", zap.String("from", p.msg.Name), zap.String("to", msg.Name))
+				emit(ctx, out, tasks.NewMoveMessage(p.msg.Name, msg.Name))
+				return
+			}
+		}
+
+		emit(ctx, out, msg)
+	default:
+		emit(ctx, out, msg)
+	}
+}
+
+// expire passes on any renames that have waited longer than the window.
+func (rp *RenamePairer) expire(ctx context.Context, now time.Time, out chan<- tasks.FsMessage) {
+	for len(rp.pending) > 0 && now.After(rp.pending[0].deadline) {
+		emit(ctx, out, rp.pending[0].msg)
+		rp.pending = rp.pending[1:]
+	}
+
+	for path, deadline := range rp.paired {
+		if now.After(deadline) {
+			delete(rp.paired, path)
+		}
+	}
+
+	for path, recent := range rp.recent {
+		if now.After(recent.deadline) {
+			delete(rp.recent, path)
+		}
+	}
+}
+
+func (rp *RenamePairer) lookupInode(ctx context.Context, path string) (uint64, bool) {
+	if recent, ok := rp.recent[path]; ok {
+		delete(rp.recent, path)
+		return recent.inode, true
+	}
+
+	var inode uint64
+	err := rp.db.QueryRowContext(ctx, `
+		SELECT inode FROM metadata_current WHERE full_path = ?
+	`, path).Scan(&inode)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			zap.L().Error("failed to look up inode", zap.String("path", path), zap.Error(err))
+		}
+		return 0, false
+	}
+
+	return inode, inode != 0
+}
+
+func statInode(path string) (uint64, bool) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, false
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return st.Ino, true
+}
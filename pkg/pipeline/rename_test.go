@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"context"
+	"fsd/pkg/ipc"
+	"fsd/pkg/tasks"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestPairer returns a pairer that never needs the database, since every path it's asked
+// about was created through it first.
+func newTestPairer(window time.Duration) *RenamePairer {
+	return &RenamePairer{
+		window: window,
+		paired: make(map[string]time.Time),
+		recent: make(map[string]recentInode),
+	}
+}
+
+// drain returns everything that's been emitted to `out` so far.
+func drain(out chan tasks.FsMessage) []tasks.FsMessage {
+	var msgs []tasks.FsMessage
+	for {
+		select {
+		case msg := <-out:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestRenamePairer(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// rename moves the file on disk between the Rename and the Create, otherwise the
+		// Create is for an unrelated file
+		rename bool
+
+		// expire is how long after the events the pending renames are expired
+		expire time.Duration
+		want   []ipc.FsdOp
+	}{
+		{name: "paired", rename: true, want: []ipc.FsdOp{ipc.Create, ipc.Move}},
+		{name: "unrelated create", expire: time.Second, want: []ipc.FsdOp{ipc.Create, ipc.Create, ipc.Rename}},
+		{name: "unpaired within window", want: []ipc.FsdOp{ipc.Create, ipc.Create}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			from := filepath.Join(dir, "from")
+			to := filepath.Join(dir, "to")
+			if err := os.WriteFile(from, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			rp := newTestPairer(100 * time.Millisecond)
+			out := make(chan tasks.FsMessage, 10)
+			rp.handle(ctx, tasks.FsMessage{Name: from, Operation: ipc.Create}, out)
+
+			if tt.rename {
+				if err := os.Rename(from, to); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.WriteFile(to, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			rp.handle(ctx, tasks.FsMessage{Name: from, Operation: ipc.Rename}, out)
+			rp.handle(ctx, tasks.FsMessage{Name: to, Operation: ipc.Create}, out)
+			if tt.expire > 0 {
+				rp.expire(ctx, time.Now().Add(tt.expire), out)
+			}
+
+			var got []ipc.FsdOp
+			for _, msg := range drain(out) {
+				got = append(got, msg.Operation)
+				if msg.Operation == ipc.Move && (msg.From != from || msg.To != to) {
+					t.Errorf("got move %s -> %s, want %s -> %s", msg.From, msg.To, from, to)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenamePairerIgnoresMoveSelf(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	from := filepath.Join(dir, "from")
+	to := filepath.Join(dir, "to")
+	if err := os.Mkdir(from, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	rp := newTestPairer(100 * time.Millisecond)
+	out := make(chan tasks.FsMessage, 10)
+	rp.handle(ctx, tasks.FsMessage{Name: from, Operation: ipc.Create}, out)
+	if err := os.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+	rp.handle(ctx, tasks.FsMessage{Name: from, Operation: ipc.Rename}, out)
+	rp.handle(ctx, tasks.FsMessage{Name: to, Operation: ipc.Create}, out)
+
+	// The second Rename a moved directory gets shouldn't be passed on
+	rp.handle(ctx, tasks.FsMessage{Name: from, Operation: ipc.Rename}, out)
+	rp.expire(ctx, time.Now().Add(50*time.Millisecond), out)
+
+	if got := len(drain(out)); got != 2 {
+		t.Errorf("got %d messages, want the Create and the Move", got)
+	}
+}
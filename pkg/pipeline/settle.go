@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"context"
+	"fsd/pkg/ipc"
+	"fsd/pkg/tasks"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type settlingFile struct {
+	// lastEvent is when we last saw a Create or Write for the path
+	lastEvent time.Time
+
+	// size and modTime are from the last time we checked on the path, size is -1 until then
+	size    int64
+	modTime time.Time
+}
+
+// Settler emits a Settled event once a file has stopped changing. A path becomes a candidate on
+// Create or Write, and is considered settled once it has seen no Writes for the quiet period
+// and its size and mtime are unchanged since we last looked. Every message is passed on as-is,
+// Settled events are added to the stream.
+type Settler struct {
+	// quiet is how long a file must go without changing to be considered settled
+	quiet time.Duration
+
+	// files are the paths we're waiting on
+	files map[string]*settlingFile
+}
+
+func NewSettler(quiet time.Duration) *Settler {
+	return &Settler{
+		quiet: quiet,
+		files: make(map[string]*settlingFile),
+	}
+}
+
+func (s *Settler) Run(ctx context.Context, in <-chan tasks.FsMessage, out chan<- tasks.FsMessage) {
+	ticker := time.NewTicker(s.quiet / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-in:
+			s.handle(msg)
+			emit(ctx, out, msg)
+		case now := <-ticker.C:
+			s.check(ctx, now, out)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Settler) handle(msg tasks.FsMessage) {
+	switch msg.Operation {
+	case ipc.Create, ipc.Write:
+		f, ok := s.files[msg.Name]
+		if !ok {
+			f = &settlingFile{size: -1}
+			s.files[msg.Name] = f
+		}
+		f.lastEvent = time.Now()
+	case ipc.Move:
+		// Whatever was settling is now settling somewhere else
+		if f, ok := s.files[msg.From]; ok {
+			delete(s.files, msg.From)
+			s.files[msg.To] = f
+		}
+	case ipc.Remove, ipc.Rename:
+		delete(s.files, msg.Name)
+	}
+}
+
+// check looks at every path that has been quiet for long enough and emits Settled for the ones
+// whose size and mtime have stopped moving.
+func (s *Settler) check(ctx context.Context, now time.Time, out chan<- tasks.FsMessage) {
+	for path, f := range s.files {
+		if now.Sub(f.lastEvent) < s.quiet {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			// Gone, or not ours to read; either way it'll never settle
+			delete(s.files, path)
+			continue
+		}
+
+		if info.IsDir() {
+			delete(s.files, path)
+			continue
+		}
+
+		// Some writers (e.g. mmap) don't produce Write events, so make sure the file has
+		// actually stopped changing before we call it done.
+		changed := f.size >= 0 && (info.Size() != f.size || !info.ModTime().Equal(f.modTime))
+		f.size = info.Size()
+		f.modTime = info.ModTime()
+		if changed {
+			f.lastEvent = now
+			continue
+		}
+
+		if now.Sub(info.ModTime()) < s.quiet {
+			f.lastEvent = info.ModTime()
+			continue
+		}
+
+		delete(s.files, path)
+		zap.L().Debug("file settled", zap.String("path", path), zap.Int64("size", f.size))
+		emit(ctx, out, tasks.FsMessage{
+			Name:      path,
+			Operation: ipc.Settled,
+		})
+	}
+}
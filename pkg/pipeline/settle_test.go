@@ -0,0 +1,85 @@
+package pipeline
+
+import (
+	"context"
+	"fsd/pkg/ipc"
+	"fsd/pkg/tasks"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSettler(t *testing.T) {
+	const quiet = time.Second
+
+	tests := []struct {
+		name string
+
+		// change is done to the file after its Create
+		change func(path string) error
+
+		// after is how long after now the check runs
+		after time.Duration
+		want  bool
+	}{
+		{name: "quiet", after: 2 * quiet, want: true},
+		{name: "too soon", after: quiet / 2, want: false},
+		{name: "removed", change: os.Remove, after: 2 * quiet, want: false},
+		{
+			name: "still being written",
+			change: func(path string) error {
+				// The mtime is as of the check, so it hasn't been quiet for long enough
+				return os.Chtimes(path, time.Time{}, time.Now().Add(2*quiet))
+			},
+			after: 2 * quiet,
+			want:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, []byte("contents"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s := NewSettler(quiet)
+			s.handle(tasks.FsMessage{Name: path, Operation: ipc.Create})
+			if tt.change != nil {
+				if err := tt.change(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			out := make(chan tasks.FsMessage, 10)
+			s.check(context.Background(), time.Now().Add(tt.after), out)
+
+			msgs := drain(out)
+			if got := len(msgs) == 1 && msgs[0].Operation == ipc.Settled && msgs[0].Name == path; got != tt.want {
+				t.Errorf("got settled %v, want %v (%v)", got, tt.want, msgs)
+			}
+		})
+	}
+}
+
+func TestSettlerFollowsMoves(t *testing.T) {
+	dir := t.TempDir()
+	from := filepath.Join(dir, "from")
+	to := filepath.Join(dir, "to")
+	if err := os.WriteFile(to, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSettler(time.Second)
+	s.handle(tasks.FsMessage{Name: from, Operation: ipc.Write})
+	s.handle(tasks.NewMoveMessage(from, to))
+
+	out := make(chan tasks.FsMessage, 10)
+	s.check(context.Background(), time.Now().Add(2*time.Second), out)
+
+	msgs := drain(out)
+	if len(msgs) != 1 || msgs[0].Name != to {
+		t.Errorf("got %v, want Settled for %s", msgs, to)
+	}
+}
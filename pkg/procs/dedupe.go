@@ -0,0 +1,539 @@
+package procs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fsd/internal/config"
+	"fsd/pkg/tasks"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"go.uber.org/zap"
+)
+
+// The ways a duplicate can be replaced
+const (
+	// DedupeHardlink replaces duplicates with hard links to the copy that's kept, so they share
+	// its permissions and owner from then on.
+	DedupeHardlink = "hardlink"
+
+	// DedupeReflink replaces duplicates with copy-on-write clones of the copy that's kept, which
+	// stay separate files. It falls back to a hard link where the filesystem can't clone.
+	DedupeReflink = "reflink"
+)
+
+// compareChunkSize is how much of each file is compared at a time
+const compareChunkSize = 64 << 10
+
+// DEDUPE_RESULTS_CREATE creates the table of what a dedupe proc did with each file it
+// considered, since there can be far more of them than the proc's output summary holds.
+const DEDUPE_RESULTS_CREATE string = `
+	CREATE TABLE IF NOT EXISTS dedupe_results (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		proc_id INTEGER NOT NULL,
+		path TEXT NOT NULL,
+		target TEXT NOT NULL,
+		action TEXT NOT NULL,
+		bytes INTEGER NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS dedupe_results_proc_id ON dedupe_results (proc_id);
+`
+
+// The actions reported for each file
+const (
+	dedupeHardlinked    = "hardlinked"
+	dedupeReflinked     = "reflinked"
+	dedupeWouldHardlink = "would_hardlink"
+	dedupeWouldReflink  = "would_reflink"
+	dedupeSkipped       = "skipped"
+	dedupeFailed        = "failed"
+)
+
+func init() {
+	tasks.RegisterNativeProc(DedupeProcName(), runDedupe)
+}
+
+// DedupeProc replaces duplicate files under a directory with links to a single copy. It runs
+// inside fsd, and records what it did with every file it considers in dedupe_results as well
+// as writing it to stdout as a line of JSON.
+type DedupeProc struct {
+	ID int
+
+	Cmd string
+
+	// Args are the flags followed by the directory
+	Args []string
+
+	// WorkDir is fsd's own working directory, since dedupe runs inside fsd
+	WorkDir string
+
+	db *sql.DB
+}
+
+func DedupeProcName() string {
+	return "dedupe"
+}
+
+func NewDedupeProc(ctx context.Context, dirname string, mode string, dryRun bool, priority int) (*DedupeProc, error) {
+	if mode != DedupeHardlink && mode != DedupeReflink {
+		return nil, fmt.Errorf("invalid mode: %s, wanted %s or %s", mode, DedupeHardlink, DedupeReflink)
+	}
+
+	root, err := filepath.Abs(config.GetConfig().WatchDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Always dedupe within the root path
+	dirname = filepath.Join(root, dirname)
+	if dirname != root && !strings.HasPrefix(dirname, root+"/") {
+		return nil, fmt.Errorf("%s is outside of %s", dirname, root)
+	}
+
+	db, err := sql.Open("sqlite3", config.GetDBPath())
+	if err != nil {
+		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
+		return nil, err
+	}
+
+	workDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := DedupeProcName()
+	args := []string{"--mode=" + mode}
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	args = append(args, dirname)
+
+	// Store in the database
+	id, err := tasks.QueueProc(ctx, db, tasks.ProcSpec{
+		Command:  cmd,
+		Args:     args,
+		WorkDir:  workDir,
+		Priority: priority,
+	})
+	if err != nil {
+		zap.L().Error("failed to insert into procs", zap.String("proc", DedupeProcName()), zap.Error(err))
+		return nil, err
+	}
+
+	return &DedupeProc{
+		ID:      id,
+		Cmd:     cmd,
+		Args:    args,
+		WorkDir: workDir,
+		db:      db,
+	}, nil
+}
+
+func (p *DedupeProc) GetID() int {
+	return p.ID
+}
+
+func (p *DedupeProc) GetCmd() string {
+	return p.Cmd
+}
+
+func (p *DedupeProc) GetArgs() []string {
+	return p.Args
+}
+
+func (p *DedupeProc) GetWorkDir() string {
+	return p.WorkDir
+}
+
+// dedupeOptions are the parsed arguments of a dedupe proc.
+type dedupeOptions struct {
+	mode   string
+	dryRun bool
+	dir    string
+}
+
+// parseDedupeArgs reads the arguments written by NewDedupeProc, the flags followed by the
+// directory.
+func parseDedupeArgs(args []string) (dedupeOptions, error) {
+	opts := dedupeOptions{mode: DedupeHardlink}
+
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "--"); i++ {
+		switch {
+		case args[i] == "--dry-run":
+			opts.dryRun = true
+		case strings.HasPrefix(args[i], "--mode="):
+			opts.mode = strings.TrimPrefix(args[i], "--mode=")
+		default:
+			return opts, fmt.Errorf("unknown flag: %s", args[i])
+		}
+	}
+
+	if i != len(args)-1 || args[i] == "" {
+		return opts, errors.New("a single directory is required")
+	}
+	opts.dir = args[i]
+
+	return opts, nil
+}
+
+// DedupeResult is what happened to a single duplicate.
+type DedupeResult struct {
+	ID   int64  `json:"id,omitempty"`
+	Path string `json:"path"`
+
+	// Target is the copy that's kept, which Path was (or would be) linked to
+	Target string `json:"target"`
+	Action string `json:"action"`
+	Bytes  int64  `json:"bytes"`
+	Error  string `json:"error,omitempty"`
+}
+
+// runDedupe finds the duplicates under the directory and links every copy but one to the one
+// that's kept, after checking byte for byte that they really are the same.
+func runDedupe(ctx context.Context, id int, args []string, stdout, stderr io.Writer) error {
+	opts, err := parseDedupeArgs(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", config.GetDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return dedupe(ctx, db, id, opts, stdout, stderr)
+}
+
+// dedupe does the work of runDedupe against the index in `db`.
+func dedupe(ctx context.Context, db *sql.DB, id int, opts dedupeOptions, stdout, stderr io.Writer) error {
+	if _, err := db.ExecContext(ctx, DEDUPE_RESULTS_CREATE); err != nil {
+		return err
+	}
+
+	// A requeued proc starts over
+	if _, err := db.ExecContext(ctx, `DELETE FROM dedupe_results WHERE proc_id = ?`, id); err != nil {
+		return err
+	}
+
+	groups, err := tasks.FindDuplicates(ctx, db, tasks.DuplicateQuery{
+		Prefixes: []string{opts.dir},
+		MinSize:  1,
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(stdout)
+	var linked, failed int
+	var reclaimed int64
+	for _, group := range groups {
+		// Keep whichever copy already has the most links
+		keep := group.Copies[0]
+		for _, copy := range group.Copies[1:] {
+			if len(copy.Paths) > len(keep.Paths) {
+				keep = copy
+			}
+		}
+
+		for _, copy := range group.Copies {
+			if copy.Inode == keep.Inode && copy.Device == keep.Device {
+				continue
+			}
+
+			// The space only comes back once every link to the copy is gone
+			freed := true
+			for _, path := range copy.Paths {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				result := dedupeFile(opts, keep, copy, path, group.SizeBytes)
+				switch result.Action {
+				case dedupeHardlinked, dedupeReflinked, dedupeWouldHardlink, dedupeWouldReflink:
+					linked++
+				case dedupeFailed:
+					failed++
+					freed = false
+				default:
+					freed = false
+				}
+
+				if err := recordDedupeResult(ctx, db, id, result); err != nil {
+					return err
+				}
+				if err := encoder.Encode(result); err != nil {
+					return err
+				}
+			}
+
+			// A clone shares the blocks, so it frees them just the same
+			if freed {
+				reclaimed += group.SizeBytes
+			}
+		}
+	}
+
+	verb := "linked"
+	if opts.dryRun {
+		verb = "would link"
+	}
+	fmt.Fprintf(stderr, "%s %d files, reclaiming %d bytes, %d failed, see /proc/%d/dedupe for each file\n", verb, linked, reclaimed, failed, id)
+
+	if failed > 0 {
+		return fmt.Errorf("failed to dedupe %d files", failed)
+	}
+
+	return nil
+}
+
+// dedupeCompared is called once `path` has been found to match the copy that's kept, before
+// anything is linked. It's only there for tests to change files at just the wrong moment.
+var dedupeCompared = func(path string) {}
+
+// dedupeFile replaces `path`, one of the links to `copy`, with a link to `keep`.
+func dedupeFile(opts dedupeOptions, keep, copy tasks.DuplicateCopy, path string, size int64) DedupeResult {
+	target := keep.Paths[0]
+	result := DedupeResult{Path: path, Target: target, Bytes: size}
+
+	if copy.Device != keep.Device {
+		result.Action = dedupeSkipped
+		result.Error = "on a different filesystem"
+		return result
+	}
+
+	before, err := os.Lstat(path)
+	if err != nil {
+		result.Action = dedupeFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	targetBefore, err := os.Lstat(target)
+	if err != nil {
+		result.Action = dedupeFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	same, err := sameContents(target, path)
+	if err != nil {
+		result.Action = dedupeFailed
+		result.Error = err.Error()
+		return result
+	}
+	if !same {
+		result.Action = dedupeSkipped
+		result.Error = "contents differ"
+		return result
+	}
+	dedupeCompared(path)
+
+	if opts.dryRun {
+		result.Action = dedupeWouldHardlink
+		if opts.mode == DedupeReflink {
+			result.Action = dedupeWouldReflink
+		}
+		return result
+	}
+
+	// Make the link next to the file and move it into place, so the path is never missing
+	tmp, cloned, err := linkBeside(path, target, opts.mode == DedupeReflink, before)
+	if err != nil {
+		result.Action = dedupeFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Action = dedupeHardlinked
+	if cloned {
+		result.Action = dedupeReflinked
+	}
+
+	// Don't clobber anything if either file changed since we compared them. A hard link has to
+	// be to the very file we compared against, not whatever has taken its place.
+	changed := !unchanged(path, before) || !unchanged(target, targetBefore)
+	if !cloned {
+		linked, err := os.Lstat(tmp)
+		changed = changed || err != nil || !os.SameFile(linked, targetBefore)
+	}
+	if changed {
+		os.Remove(tmp)
+		result.Action = dedupeSkipped
+		result.Error = "changed while comparing"
+		return result
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		result.Action = dedupeFailed
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// unchanged reports whether `path` is still the file described by `before`, with the same size
+// and mtime.
+func unchanged(path string, before os.FileInfo) bool {
+	after, err := os.Lstat(path)
+	return err == nil && os.SameFile(before, after) && after.Size() == before.Size() && after.ModTime().Equal(before.ModTime())
+}
+
+// linkBeside makes a new link to `target` in the same directory as `path`, cloning it instead
+// if `clone` is set and the filesystem can. The link gets a name nothing else is using, so
+// nothing already there is ever touched. It returns the link's path and whether it's a clone.
+func linkBeside(path, target string, clone bool, like os.FileInfo) (string, bool, error) {
+	for i := 0; i < 100; i++ {
+		tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.fsd-dedupe-%08x", filepath.Base(path), rand.Uint32()))
+
+		var cloned bool
+		var err error
+		if clone {
+			cloned, err = reflink(target, tmp, like)
+		}
+		if err == nil && !cloned {
+			err = os.Link(target, tmp)
+		}
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+
+		return tmp, cloned, err
+	}
+
+	return "", false, fmt.Errorf("no free temporary name next to %s", path)
+}
+
+// recordDedupeResult stores `result` for the proc with `id`.
+func recordDedupeResult(ctx context.Context, db *sql.DB, id int, result DedupeResult) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO dedupe_results (proc_id, path, target, action, bytes, error, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, id, result.Path, result.Target, result.Action, result.Bytes, result.Error, time.Now())
+	return err
+}
+
+// DedupeResults returns up to `limit` of the results of the dedupe proc with `id` that come
+// after `after`, in the order it got to them.
+func DedupeResults(ctx context.Context, db *sql.DB, id int, after int64, limit int) ([]DedupeResult, error) {
+	if _, err := db.ExecContext(ctx, DEDUPE_RESULTS_CREATE); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, path, target, action, bytes, error FROM dedupe_results
+		WHERE proc_id = ? AND id > ?
+		ORDER BY id
+		LIMIT ?
+	`, id, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []DedupeResult{}
+	for rows.Next() {
+		var result DedupeResult
+		if err := rows.Scan(&result.ID, &result.Path, &result.Target, &result.Action, &result.Bytes, &result.Error); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// reflink clones `src` to a new file at `dst`, keeping the permissions, owner and times of
+// `like`. It reports false without creating anything if the filesystem can't clone, and
+// removes what it created if anything else goes wrong.
+func reflink(src, dst string, like os.FileInfo) (cloned bool, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, like.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	defer out.Close()
+	defer func() {
+		if !cloned {
+			os.Remove(dst)
+		}
+	}()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if st, ok := like.Sys().(*syscall.Stat_t); ok {
+		// Only root can give files away, anyone else keeps them as their own
+		if err := out.Chown(int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, os.ErrPermission) {
+			return false, err
+		}
+	}
+
+	if err := os.Chtimes(dst, time.Time{}, like.ModTime()); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// sameContents compares the files at `a` and `b` byte for byte.
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, compareChunkSize)
+	bufB := make([]byte, compareChunkSize)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+
+		doneA := errors.Is(errA, io.EOF) || errors.Is(errA, io.ErrUnexpectedEOF)
+		doneB := errors.Is(errB, io.EOF) || errors.Is(errB, io.ErrUnexpectedEOF)
+		if errA != nil && !doneA {
+			return false, errA
+		}
+		if errB != nil && !doneB {
+			return false, errB
+		}
+		if doneA || doneB {
+			return doneA && doneB, nil
+		}
+	}
+}
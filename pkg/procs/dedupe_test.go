@@ -0,0 +1,354 @@
+package procs
+
+import (
+	"context"
+	"database/sql"
+	"fsd/pkg/hashing"
+	"fsd/pkg/tasks"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestParseDedupeArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    dedupeOptions
+		wantErr bool
+	}{
+		{name: "directory only", args: []string{"/w/a"}, want: dedupeOptions{mode: DedupeHardlink, dir: "/w/a"}},
+		{name: "mode", args: []string{"--mode=reflink", "/w/a"}, want: dedupeOptions{mode: DedupeReflink, dir: "/w/a"}},
+		{
+			name: "dry run",
+			args: []string{"--mode=hardlink", "--dry-run", "/w/a"},
+			want: dedupeOptions{mode: DedupeHardlink, dryRun: true, dir: "/w/a"},
+		},
+		{name: "unknown flag", args: []string{"--force", "/w/a"}, wantErr: true},
+		{name: "no directory", args: []string{"--dry-run"}, wantErr: true},
+		{name: "empty directory", args: []string{""}, wantErr: true},
+		{name: "two directories", args: []string{"/w/a", "/w/b"}, wantErr: true},
+		{name: "flag after the directory", args: []string{"/w/a", "--dry-run"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDedupeArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameContents(t *testing.T) {
+	long := strings.Repeat("x", 2*compareChunkSize)
+
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{name: "same", a: "contents", b: "contents", want: true},
+		{name: "different", a: "contents", b: "Contents"},
+		{name: "prefix", a: "contents", b: "content"},
+		{name: "empty", a: "", b: "", want: true},
+		{name: "one empty", a: "", b: "contents"},
+		{name: "same across chunks", a: long + "y", b: long + "y", want: true},
+		{name: "different in a later chunk", a: long + "y", b: long + "z"},
+		{name: "longer by a chunk", a: long, b: long + long},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+			if err := os.WriteFile(a, []byte(tt.a), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(b, []byte(tt.b), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := sameContents(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestDedupeIndex returns a database indexing the regular files under `root`, each with the
+// hash in `sums` if it has one and its real hash otherwise, as though the hash task had
+// been through them.
+func newTestDedupeIndex(t *testing.T, root string, sums map[string]string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "fsd.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(tasks.METADATA_CURRENT_CREATE); err != nil {
+		t.Fatal(err)
+	}
+
+	hasher := hashing.NewHasher(0)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		sum, ok := sums[filepath.Base(path)]
+		if !ok {
+			got, err := hasher.HashFile(context.Background(), path)
+			if err != nil {
+				return err
+			}
+			sum = got.SHA256
+		}
+
+		st := info.Sys().(*syscall.Stat_t)
+		_, err = db.Exec(`
+			INSERT INTO metadata_current
+				(full_path, size_bytes, file_mode, is_directory, inode, created_at, modified_at, device, nlink, file_type, sha256)
+			VALUES (?, ?, ?, 0, ?, ?, ?, ?, ?, 'regular', ?)
+		`, path, info.Size(), info.Mode(), st.Ino, info.ModTime(), info.ModTime(), st.Dev, st.Nlink, sum)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestDedupe(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+
+		// links are hard linked to another file, and sums are stored in place of the real hash
+		links map[string]string
+		sums  map[string]string
+
+		dryRun bool
+
+		// changed is a file that changes once it's been compared
+		changed string
+
+		want []DedupeResult
+
+		// linked are the files that end up as the same file as "a"
+		linked []string
+	}{
+		{
+			name:   "identical",
+			files:  map[string]string{"a": "same", "b": "same", "c": "same", "d": "diff"},
+			want:   []DedupeResult{{Path: "b", Target: "a", Action: dedupeHardlinked}, {Path: "c", Target: "a", Action: dedupeHardlinked}},
+			linked: []string{"b", "c"},
+		},
+		{
+			name:   "keeps the copy with the most links",
+			files:  map[string]string{"a": "same", "b": "same"},
+			links:  map[string]string{"b2": "b"},
+			want:   []DedupeResult{{Path: "a", Target: "b", Action: dedupeHardlinked}},
+			linked: []string{"b", "b2"},
+		},
+		{
+			name:  "already linked",
+			files: map[string]string{"a": "same"},
+			links: map[string]string{"b": "a"},
+		},
+		{
+			name:  "contents differ",
+			files: map[string]string{"a": "same", "b": "diff"},
+			sums:  map[string]string{"a": "collision", "b": "collision"},
+			want:  []DedupeResult{{Path: "b", Target: "a", Action: dedupeSkipped, Error: "contents differ"}},
+		},
+		{
+			name:   "dry run",
+			files:  map[string]string{"a": "same", "b": "same"},
+			dryRun: true,
+			want:   []DedupeResult{{Path: "b", Target: "a", Action: dedupeWouldHardlink}},
+		},
+		{
+			name:    "changed while comparing",
+			files:   map[string]string{"a": "same", "b": "same"},
+			changed: "b",
+			want:    []DedupeResult{{Path: "b", Target: "a", Action: dedupeSkipped, Error: "changed while comparing"}},
+		},
+		{
+			name:    "kept copy changed while comparing",
+			files:   map[string]string{"a": "same", "b": "same"},
+			changed: "a",
+			want:    []DedupeResult{{Path: "b", Target: "a", Action: dedupeSkipped, Error: "changed while comparing"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			root := t.TempDir()
+			for name, contents := range tt.files {
+				if err := os.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, target := range tt.links {
+				if err := os.Link(filepath.Join(root, target), filepath.Join(root, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db := newTestDedupeIndex(t, root, tt.sums)
+
+			contents := make(map[string]string)
+			dedupeCompared = func(path string) {
+				if tt.changed == "" {
+					return
+				}
+				changed := filepath.Join(root, tt.changed)
+				if err := os.WriteFile(changed, []byte("new!"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(changed, time.Time{}, time.Now().Add(time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+				contents[tt.changed] = "new!"
+			}
+			t.Cleanup(func() { dedupeCompared = func(string) {} })
+
+			const id = 7
+			opts := dedupeOptions{mode: DedupeHardlink, dryRun: tt.dryRun, dir: root}
+			if err := dedupe(ctx, db, id, opts, io.Discard, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+
+			results, err := DedupeResults(ctx, db, id, 0, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []DedupeResult
+			for _, result := range results {
+				result.ID = 0
+				result.Path, _ = filepath.Rel(root, result.Path)
+				result.Target, _ = filepath.Rel(root, result.Target)
+				got = append(got, result)
+			}
+			for i := range tt.want {
+				tt.want[i].Bytes = int64(len(tt.files["a"]))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got results %+v, want %+v", got, tt.want)
+			}
+
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			var want []string
+			for name := range tt.files {
+				want = append(want, name)
+			}
+			for name := range tt.links {
+				want = append(want, name)
+			}
+			slices.Sort(want)
+			if !slices.Equal(names, want) {
+				t.Errorf("got files %v, want %v", names, want)
+			}
+
+			// Nothing's lost, whatever was linked
+			for name, was := range tt.files {
+				if now, ok := contents[name]; ok {
+					was = now
+				}
+				got, err := os.ReadFile(filepath.Join(root, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != was {
+					t.Errorf("got %s containing %q, want %q", name, got, was)
+				}
+			}
+
+			a, err := os.Stat(filepath.Join(root, "a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range want {
+				info, err := os.Stat(filepath.Join(root, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantLinked := name == "a" || slices.Contains(tt.linked, name) || tt.links[name] == "a"
+				if os.SameFile(a, info) != wantLinked {
+					t.Errorf("got %s linked to a %v, want %v", name, !wantLinked, wantLinked)
+				}
+			}
+		})
+	}
+}
+
+func TestLinkBeside(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "copy")
+	target := filepath.Join(dir, "target")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{path, target} {
+		if err := os.WriteFile(name, []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	like, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, clone := range []bool{false, true} {
+		tmp, _, err := linkBeside(path, target, clone, like)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(tmp) != filepath.Dir(path) || !strings.HasPrefix(filepath.Base(tmp), ".copy.fsd-dedupe-") {
+			t.Errorf("got %s, want a hidden name next to %s", tmp, path)
+		}
+
+		got, err := os.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "contents" {
+			t.Errorf("got %q in the link, want the target's contents", got)
+		}
+		if err := os.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The copy itself is left alone until it's renamed over
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != "contents" {
+		t.Errorf("got %q and error %v from the copy, want it untouched", got, err)
+	}
+}
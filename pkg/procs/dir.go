@@ -4,8 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"fsd/internal/config"
+	"fsd/pkg/tasks"
 	"path/filepath"
-	"time"
 
 	"go.uber.org/zap"
 )
@@ -18,6 +18,9 @@ type DirProc struct {
 	// Args is the directory name and any additional flags
 	Args []string
 
+	// WorkDir is where mkdir runs, the watch directory
+	WorkDir string
+
 	db *sql.DB
 }
 
@@ -25,7 +28,7 @@ func DirProcName() string {
 	return "mkdir"
 }
 
-func NewDirProc(ctx context.Context, dirname string) (*DirProc, error) {
+func NewDirProc(ctx context.Context, dirname string, priority int) (*DirProc, error) {
 	db, err := sql.Open("sqlite3", config.GetDBPath())
 	if err != nil {
 		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
@@ -34,29 +37,32 @@ func NewDirProc(ctx context.Context, dirname string) (*DirProc, error) {
 
 	cmd := "mkdir"
 
-	// Always make directories in the root path
-	dirname = filepath.Join(config.GetConfig().WatchDir, dirname)
-
-	// Store in the database
-	result, err := db.Exec(`
-		INSERT INTO proc (command, args, is_executed, created_at) VALUES (?, ?, ?, ?)
-	`, cmd, dirname, 0, time.Now())
+	root, err := filepath.Abs(config.GetConfig().WatchDir)
 	if err != nil {
-		zap.L().Error("failed to insert into procs", zap.String("proc", YtProcName()), zap.Error(err))
 		return nil, err
 	}
 
-	id, err := result.LastInsertId()
+	// Always make directories in the root path
+	dirname = filepath.Join(root, dirname)
+
+	// Store in the database
+	id, err := tasks.QueueProc(ctx, db, tasks.ProcSpec{
+		Command:  cmd,
+		Args:     []string{dirname},
+		WorkDir:  root,
+		Priority: priority,
+	})
 	if err != nil {
-		zap.L().Error("failed to get last insert id", zap.String("proc", YtProcName()), zap.Error(err))
+		zap.L().Error("failed to insert into procs", zap.String("proc", YtProcName()), zap.Error(err))
 		return nil, err
 	}
 
 	return &DirProc{
-		ID:   int(id),
-		Cmd:  cmd,
-		Args: []string{dirname},
-		db:   db,
+		ID:      id,
+		Cmd:     cmd,
+		Args:    []string{dirname},
+		WorkDir: root,
+		db:      db,
 	}, nil
 }
 
@@ -71,3 +77,7 @@ func (p *DirProc) GetCmd() string {
 func (p *DirProc) GetArgs() []string {
 	return p.Args
 }
+
+func (p *DirProc) GetWorkDir() string {
+	return p.WorkDir
+}
@@ -5,9 +5,9 @@ import (
 	"database/sql"
 	"fmt"
 	"fsd/internal/config"
+	"fsd/pkg/tasks"
 	"path/filepath"
 	"strings"
-	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -19,6 +19,27 @@ var DEFAULT_FLAGS = map[string][]string{
 	"merge-output-format": {"mkv"},
 }
 
+// ValidateYtArgs checks the arguments of a yt-dlp request. Only the url, the channel name and
+// the flags in DEFAULT_FLAGS can be set, with a single value each, so a request can't slip in
+// any other yt-dlp option.
+func ValidateYtArgs(args map[string][]string) error {
+	for k, v := range args {
+		if _, ok := DEFAULT_FLAGS[k]; !ok && k != "url" && k != "channel-name" {
+			return fmt.Errorf("unsupported yt-dlp option: %s", k)
+		}
+		if len(v) != 1 {
+			return fmt.Errorf("%s takes a single value", k)
+		}
+	}
+
+	// The channel name is a directory right under the watch directory
+	if name, ok := args["channel-name"]; ok && (name[0] == "." || name[0] == ".." || strings.Contains(name[0], "/")) {
+		return fmt.Errorf("invalid channel-name: %s", name[0])
+	}
+
+	return nil
+}
+
 type YtProc struct {
 	ID int
 
@@ -28,6 +49,10 @@ type YtProc struct {
 	// Args are the arguments that the proc uses to execute the yt-dlp command
 	Args []string
 
+	// WorkDir is where yt-dlp runs, the watch directory, so that anything it leaves behind is
+	// somewhere fsd can see it
+	WorkDir string
+
 	// db is the database that the proc uses to store the output of the yt-dlp command
 	db *sql.DB
 }
@@ -36,7 +61,11 @@ func YtProcName() string {
 	return "yt-dlp"
 }
 
-func NewYtProc(ctx context.Context, overrides map[string][]string) (*YtProc, error) {
+func NewYtProc(ctx context.Context, overrides map[string][]string, priority int) (*YtProc, error) {
+	if err := ValidateYtArgs(overrides); err != nil {
+		return nil, err
+	}
+
 	db, err := sql.Open("sqlite3", config.GetDBPath())
 	if err != nil {
 		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
@@ -61,13 +90,13 @@ func NewYtProc(ctx context.Context, overrides map[string][]string) (*YtProc, err
 	}
 
 	cmd := "yt-dlp"
-	args := []string{url[0]}
+	var args []string
 
-	// Add all flags to the args slice
+	// Add all flags to the args slice, each with its value attached so the value can't be
+	// taken for an option of its own
 	for k, v := range flags {
-		if k != "url" && k != "channel-name" { // Skip the URL as we've already added it
-			args = append(args, fmt.Sprintf("--%s", k))
-			args = append(args, v...)
+		if k != "url" && k != "channel-name" {
+			args = append(args, fmt.Sprintf("--%s=%s", k, v[0]))
 		}
 	}
 
@@ -76,26 +105,32 @@ func NewYtProc(ctx context.Context, overrides map[string][]string) (*YtProc, err
 	outputPath := makePath(channelName)
 	args = append(args, "-o", fmt.Sprintf("%s/%%(title)s", outputPath))
 
-	// Store the proc in the database
-	result, err := db.Exec(`
-		INSERT INTO proc (command, args, is_executed, created_at) VALUES (?, ?, ?, ?)
-	`, cmd, strings.Join(args, " "), 0, time.Now())
+	// The url goes last, after the end of the options, in case it starts with a dash
+	args = append(args, "--", url[0])
+
+	root, err := filepath.Abs(config.GetConfig().WatchDir)
 	if err != nil {
-		zap.L().Error("failed to insert into procs", zap.String("proc", YtProcName()), zap.Error(err))
 		return nil, err
 	}
 
-	id, err := result.LastInsertId()
+	// Store the proc in the database
+	id, err := tasks.QueueProc(ctx, db, tasks.ProcSpec{
+		Command:  cmd,
+		Args:     args,
+		WorkDir:  root,
+		Priority: priority,
+	})
 	if err != nil {
-		zap.L().Error("failed to get last insert id", zap.String("proc", YtProcName()), zap.Error(err))
+		zap.L().Error("failed to insert into procs", zap.String("proc", YtProcName()), zap.Error(err))
 		return nil, err
 	}
 
 	return &YtProc{
-		ID:   int(id),
-		Cmd:  cmd,
-		Args: args,
-		db:   db,
+		ID:      id,
+		Cmd:     cmd,
+		Args:    args,
+		WorkDir: root,
+		db:      db,
 	}, nil
 }
 
@@ -111,6 +146,10 @@ func (p *YtProc) GetArgs() []string {
 	return p.Args
 }
 
+func (p *YtProc) GetWorkDir() string {
+	return p.WorkDir
+}
+
 func makePath(channelName string) string {
 	return filepath.Join(config.GetConfig().WatchDir, channelName)
 }
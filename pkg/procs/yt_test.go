@@ -0,0 +1,30 @@
+package procs
+
+import "testing"
+
+func TestValidateYtArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    map[string][]string
+		wantErr bool
+	}{
+		{name: "url and channel", args: map[string][]string{"url": {"https://example.com/v"}, "channel-name": {"chan"}}},
+		{
+			name: "defaults overridden",
+			args: map[string][]string{"url": {"-v"}, "channel-name": {"chan"}, "playlist-end": {"5"}, "merge-output-format": {"mp4"}},
+		},
+		{name: "other option", args: map[string][]string{"url": {"u"}, "channel-name": {"chan"}, "exec": {"rm -rf ~"}}, wantErr: true},
+		{name: "extra values", args: map[string][]string{"url": {"u"}, "channel-name": {"chan"}, "playlist-end": {"5", "--exec", "x"}}, wantErr: true},
+		{name: "no value", args: map[string][]string{"url": {"u"}, "channel-name": {"chan"}, "playlist-end": {}}, wantErr: true},
+		{name: "channel outside", args: map[string][]string{"url": {"u"}, "channel-name": {"../etc"}}, wantErr: true},
+		{name: "channel is the watch directory", args: map[string][]string{"url": {"u"}, "channel-name": {"."}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateYtArgs(tt.args); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
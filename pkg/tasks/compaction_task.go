@@ -11,6 +11,10 @@ import (
 	"go.uber.org/zap"
 )
 
+func init() {
+	ipc.RegisterMessage(CompactionMessage{})
+}
+
 type CompactionMessage struct {
 	Name      string    `json:"compaction_event_name"`
 	Operation ipc.FsdOp `json:"compaction_event_operation"`
@@ -100,25 +104,40 @@ func NewCompactionTask(state *CompactionTaskState) *CompactionTask {
 // compactStaleRecords deletes stale records. This is *not* compaction as is found in
 // systems like [rocksdb](https://github.com/facebook/rocksdb/wiki/Compaction), but
 // it eventually will support more comprehensive operations once the need arises.
-func (ct *CompactionTask) compactStaleRecords() {
+func (ct *CompactionTask) compactStaleRecords(ctx context.Context) {
 	// Broadcast a compaction message over the shared channel
 	ct.state.broadcaster.Broadcast(CompactionMessage{
 		Name:      "CompactNow",
 		Operation: ipc.Compact,
 	})
+
+	// The event log belongs to the broadcaster rather than any one task, so trim it here
+	rowsDeleted, err := ct.state.broadcaster.TrimLog(ctx, config.GetConfig().EventLogRetention)
+	if err != nil {
+		zap.L().Error("failed to trim event log", zap.String("task name", CompactionTaskName()), zap.Error(err))
+		return
+	}
+
+	zap.L().Info("deleted old records", zap.String("table name", "event_log"), zap.Int64("rows deleted", rowsDeleted))
 }
 
 func (ct *CompactionTask) StartEventLoop(ctx context.Context) {
+	// A ticker rather than time.After, otherwise a steady stream of messages keeps pushing
+	// compaction back forever.
+	ticker := time.NewTicker(config.GetConfig().CompactionInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case event := <-ct.state.BroadcastChannel():
 			if err := ct.HandleMessage(ctx, event); err != nil {
 				zap.L().Error("error handling message", zap.String("task name", CompactionTaskName()), zap.Error(err))
 			}
-		case <-time.After(config.GetConfig().CompactionInterval):
+			ct.state.broadcaster.Ack(CompactionTaskName(), event)
+		case <-ticker.C:
 			zap.L().Info("beginning compaction operation")
 			// We do this as a blocking operation since it's already off the main thread.
-			ct.compactStaleRecords()
+			ct.compactStaleRecords(ctx)
 		case <-ctx.Done():
 			zap.L().Info("got shutdown signal, exiting", zap.String("task name", CompactionTaskName()))
 			return
@@ -0,0 +1,301 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fsd/pkg/ipc"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// DuplicateQuery narrows down where to look for duplicates.
+type DuplicateQuery struct {
+	// Prefixes limits the search to these directories, everything indexed if empty
+	Prefixes []string
+
+	// Globs limits the search to matching paths or file names
+	Globs []string
+
+	// MinSize skips anything smaller, empty files are all alike but rarely interesting
+	MinSize int64
+
+	// Limit is the most groups to return, all of them if it's 0
+	Limit int
+}
+
+// DuplicateCopy is one copy of the content, made up of every path that links to it.
+type DuplicateCopy struct {
+	Device uint64   `json:"device"`
+	Inode  uint64   `json:"inode"`
+	Paths  []string `json:"paths"`
+}
+
+// DuplicateGroup is a set of separate files with identical content.
+type DuplicateGroup struct {
+	SHA256    string `json:"sha256"`
+	SizeBytes int64  `json:"size_bytes"`
+
+	// ReclaimableBytes is what would be freed by keeping a single copy
+	ReclaimableBytes int64           `json:"reclaimable_bytes"`
+	Copies           []DuplicateCopy `json:"copies"`
+}
+
+// fileID identifies a file regardless of how many paths link to it.
+type fileID struct {
+	device uint64
+	inode  uint64
+}
+
+// duplicateBatch is how many groups are read from the index at a time.
+const duplicateBatch = 100
+
+// duplicateCandidate is an indexed path that shares its size with at least one other.
+type duplicateCandidate struct {
+	path   string
+	size   int64
+	id     fileID
+	hashed bool
+}
+
+// FindDuplicates returns the groups of files under the query's scope with identical content,
+// most reclaimable first, then by hash. Files are bucketed by size, and those sharing a size
+// with another file are hashed now if the hash task hasn't got to them yet. Hard links to the
+// same file are a single copy rather than duplicates of each other.
+func FindDuplicates(ctx context.Context, db *sql.DB, query DuplicateQuery) ([]DuplicateGroup, error) {
+	where := []string{"file_type = ?", "size_bytes >= ?"}
+	args := []interface{}{fileTypeRegular, query.MinSize}
+
+	if len(query.Prefixes) > 0 {
+		var scopes []string
+		for _, prefix := range query.Prefixes {
+			lo, hi := descendantRange(strings.TrimSuffix(prefix, "/"))
+			scopes = append(scopes, "(full_path >= ? AND full_path < ?)")
+			args = append(args, lo, hi)
+		}
+		where = append(where, "("+strings.Join(scopes, " OR ")+")")
+	}
+	scope := strings.Join(where, " AND ")
+	globs := ipc.Filter{Globs: query.Globs}
+
+	if err := hashCandidates(ctx, db, scope, args, globs); err != nil {
+		return nil, err
+	}
+
+	// Leaving paths out with the globs can only make a group less reclaimable, so once the
+	// last group we have beats the next one as the index has it, nothing further on can
+	// displace it.
+	groups := []DuplicateGroup{}
+	for offset := 0; ; offset += duplicateBatch {
+		batch, err := duplicateSums(ctx, db, scope, args, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sum := range batch {
+			group, err := duplicateGroup(ctx, db, scope, args, sum, globs)
+			if err != nil {
+				return nil, err
+			}
+			if len(group.Copies) > 1 {
+				groups = append(groups, group)
+			}
+		}
+
+		sort.Slice(groups, func(i, j int) bool {
+			return groups[i].before(groups[j])
+		})
+
+		if len(batch) < duplicateBatch {
+			break
+		}
+
+		last := batch[len(batch)-1]
+		if query.Limit > 0 && len(groups) >= query.Limit && !last.before(groups[query.Limit-1]) {
+			break
+		}
+	}
+
+	if query.Limit > 0 && len(groups) > query.Limit {
+		groups = groups[:query.Limit]
+	}
+
+	return groups, nil
+}
+
+// before reports whether `g` is listed ahead of `other`.
+func (g DuplicateGroup) before(other DuplicateGroup) bool {
+	if g.ReclaimableBytes != other.ReclaimableBytes {
+		return g.ReclaimableBytes > other.ReclaimableBytes
+	}
+	return g.SHA256 < other.SHA256
+}
+
+// hashCandidates hashes the paths in `scope` matching `globs` that have no hash yet but share
+// their size with another file, so every possible duplicate has a hash to be grouped by.
+func hashCandidates(ctx context.Context, db *sql.DB, scope string, args []interface{}, globs ipc.Filter) error {
+	candidates, err := duplicateCandidates(ctx, db, scope, args)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(candidates); {
+		end := start
+		for end < len(candidates) && candidates[end].size == candidates[start].size {
+			end++
+		}
+		bucket := candidates[start:end]
+		start = end
+
+		files := make(map[fileID]bool)
+		var unhashed []string
+		for _, candidate := range bucket {
+			if !globs.MatchPath(candidate.path) {
+				continue
+			}
+			files[candidate.id] = true
+			if !candidate.hashed {
+				unhashed = append(unhashed, candidate.path)
+			}
+		}
+		if len(files) < 2 {
+			continue
+		}
+
+		for _, path := range unhashed {
+			if err := hashCandidate(ctx, db, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// duplicateCandidates returns the paths in `scope` whose size is shared by more than one path,
+// in sizes where at least one of them has no hash, ordered by size. They're all read up front
+// so nothing is left reading the index while the hashes are stored.
+func duplicateCandidates(ctx context.Context, db *sql.DB, scope string, args []interface{}) ([]duplicateCandidate, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT full_path, size_bytes, device, inode, sha256 IS NOT NULL FROM metadata_current
+		WHERE `+scope+` AND size_bytes IN (
+			SELECT size_bytes FROM metadata_current
+			WHERE `+scope+`
+			GROUP BY size_bytes HAVING count(*) > 1 AND count(sha256) < count(*)
+		)
+		ORDER BY size_bytes, full_path
+	`, append(args[:len(args):len(args)], args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []duplicateCandidate
+	for rows.Next() {
+		var candidate duplicateCandidate
+		err := rows.Scan(&candidate.path, &candidate.size, &candidate.id.device, &candidate.id.inode, &candidate.hashed)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, rows.Err()
+}
+
+// hashCandidate hashes `path` and stores it in the index. Paths that can't be hashed right now
+// are left without one, and so left out of the groups.
+func hashCandidate(ctx context.Context, db *sql.DB, path string) error {
+	file, ok, err := lookupHashable(ctx, db, path)
+	if err != nil || !ok {
+		return err
+	}
+
+	_, err = hashFile(ctx, db, sharedHasher(), file)
+	if errors.Is(err, errHashStale) || errors.Is(err, errHashChanged) || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		zap.L().Warn("skipping unreadable file", zap.String("path", path), zap.Error(err))
+		return nil
+	}
+
+	return err
+}
+
+// duplicateSums returns a batch of the hashes shared by more than one file in `scope`, with
+// what keeping one copy would reclaim if nothing was left out, in the order FindDuplicates
+// lists them.
+func duplicateSums(ctx context.Context, db *sql.DB, scope string, args []interface{}, offset int) ([]DuplicateGroup, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH files AS (
+			SELECT DISTINCT sha256, size_bytes, device, inode FROM metadata_current
+			WHERE `+scope+` AND sha256 IS NOT NULL
+		)
+		SELECT sha256, size_bytes, size_bytes * (count(*) - 1) AS reclaimable
+		FROM files
+		GROUP BY sha256, size_bytes HAVING count(*) > 1
+		ORDER BY reclaimable DESC, sha256
+		LIMIT ? OFFSET ?
+	`, append(args[:len(args):len(args)], duplicateBatch, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sums []DuplicateGroup
+	for rows.Next() {
+		var sum DuplicateGroup
+		if err := rows.Scan(&sum.SHA256, &sum.SizeBytes, &sum.ReclaimableBytes); err != nil {
+			return nil, err
+		}
+		sums = append(sums, sum)
+	}
+
+	return sums, rows.Err()
+}
+
+// duplicateGroup fills in the copies of `sum` in `scope` whose paths match `globs`, with their
+// links collapsed.
+func duplicateGroup(ctx context.Context, db *sql.DB, scope string, args []interface{}, sum DuplicateGroup, globs ipc.Filter) (DuplicateGroup, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT full_path, device, inode FROM metadata_current
+		WHERE `+scope+` AND sha256 = ? AND size_bytes = ?
+		ORDER BY full_path
+	`, append(args[:len(args):len(args)], sum.SHA256, sum.SizeBytes)...)
+	if err != nil {
+		return sum, err
+	}
+	defer rows.Close()
+
+	group := DuplicateGroup{SHA256: sum.SHA256, SizeBytes: sum.SizeBytes, Copies: []DuplicateCopy{}}
+	files := make(map[fileID]int)
+	for rows.Next() {
+		var path string
+		var id fileID
+		if err := rows.Scan(&path, &id.device, &id.inode); err != nil {
+			return group, err
+		}
+
+		if !globs.MatchPath(path) {
+			continue
+		}
+
+		if i, ok := files[id]; ok {
+			group.Copies[i].Paths = append(group.Copies[i].Paths, path)
+			continue
+		}
+
+		files[id] = len(group.Copies)
+		group.Copies = append(group.Copies, DuplicateCopy{Device: id.device, Inode: id.inode, Paths: []string{path}})
+	}
+	if err := rows.Err(); err != nil {
+		return group, err
+	}
+
+	group.ReclaimableBytes = group.SizeBytes * int64(max(len(group.Copies)-1, 0))
+	return group, nil
+}
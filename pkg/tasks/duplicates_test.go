@@ -0,0 +1,151 @@
+package tasks
+
+import (
+	"context"
+	"fsd/pkg/hashing"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	hasher := sharedHasher
+	sharedHasher = func() *hashing.Hasher { return hashing.NewHasher(0) }
+	t.Cleanup(func() { sharedHasher = hasher })
+
+	// files are the contents of each path, and links are the paths hard linked to another
+	files := map[string]string{
+		"a":      "same",
+		"b":      "same",
+		"d":      "diff",
+		"e":      "other size",
+		"sub/f":  "other size",
+		"sub/g":  "same",
+		"tiny":   "x",
+		"tiny.2": "x",
+	}
+	links := map[string]string{"c": "a"}
+
+	tests := []struct {
+		name  string
+		query DuplicateQuery
+
+		// want are the paths of each group's copies, and hashed the paths with a hash after
+		want   [][][]string
+		hashed []string
+	}{
+		{
+			name:  "everything",
+			query: DuplicateQuery{MinSize: 1},
+			want: [][][]string{
+				{{"e"}, {"sub/f"}},
+				{{"a", "c"}, {"b"}, {"sub/g"}},
+				{{"tiny"}, {"tiny.2"}},
+			},
+			hashed: []string{"a", "b", "c", "d", "e", "sub/f", "sub/g", "tiny", "tiny.2"},
+		},
+		{
+			name:   "limit",
+			query:  DuplicateQuery{MinSize: 1, Limit: 1},
+			want:   [][][]string{{{"e"}, {"sub/f"}}},
+			hashed: []string{"a", "b", "c", "d", "e", "sub/f", "sub/g", "tiny", "tiny.2"},
+		},
+		{
+			name:   "min size",
+			query:  DuplicateQuery{MinSize: 5},
+			want:   [][][]string{{{"e"}, {"sub/f"}}},
+			hashed: []string{"e", "sub/f"},
+		},
+		{
+			name:   "prefix",
+			query:  DuplicateQuery{Prefixes: []string{"sub"}, MinSize: 1},
+			hashed: []string{},
+		},
+		{
+			name:   "links are one copy",
+			query:  DuplicateQuery{Globs: []string{"a", "c"}, MinSize: 1},
+			hashed: []string{},
+		},
+		{
+			name:   "globs",
+			query:  DuplicateQuery{Globs: []string{"a", "g"}, MinSize: 1},
+			want:   [][][]string{{{"a"}, {"sub/g"}}},
+			hashed: []string{"a", "sub/g"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			root := t.TempDir()
+			for name, contents := range files {
+				path := filepath.Join(root, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, target := range links {
+				if err := os.Link(filepath.Join(root, target), filepath.Join(root, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ix := newTestIndex(t)
+			if err := ix.SyncTree(ctx, root); err != nil {
+				t.Fatal(err)
+			}
+
+			query := tt.query
+			query.Prefixes = nil
+			for _, prefix := range tt.query.Prefixes {
+				query.Prefixes = append(query.Prefixes, filepath.Join(root, prefix))
+			}
+			groups, err := FindDuplicates(ctx, ix.db, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got [][][]string
+			for _, group := range groups {
+				var copies [][]string
+				for _, copy := range group.Copies {
+					var paths []string
+					for _, path := range copy.Paths {
+						rel, _ := filepath.Rel(root, path)
+						paths = append(paths, rel)
+					}
+					copies = append(copies, paths)
+				}
+				got = append(got, copies)
+			}
+			if !slices.EqualFunc(got, tt.want, func(a, b [][]string) bool {
+				return slices.EqualFunc(a, b, slices.Equal)
+			}) {
+				t.Errorf("got groups %v, want %v", got, tt.want)
+			}
+
+			rows, err := ix.db.Query(`SELECT full_path FROM metadata_current WHERE sha256 IS NOT NULL ORDER BY full_path`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			hashed := []string{}
+			for rows.Next() {
+				var path string
+				if err := rows.Scan(&path); err != nil {
+					t.Fatal(err)
+				}
+				rel, _ := filepath.Rel(root, path)
+				hashed = append(hashed, rel)
+			}
+			if !slices.Equal(hashed, tt.hashed) {
+				t.Errorf("got %v hashed, want %v", hashed, tt.hashed)
+			}
+		})
+	}
+}
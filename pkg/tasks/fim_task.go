@@ -0,0 +1,649 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fsd/internal/config"
+	"fsd/pkg/fim"
+	"fsd/pkg/hashing"
+	"fsd/pkg/ipc"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FIM_BASELINE_CREATE holds the known good state of every path under `fim_paths`.
+const FIM_BASELINE_CREATE string = `
+	CREATE TABLE IF NOT EXISTS fim_baseline (
+		full_path TEXT NOT NULL PRIMARY KEY,
+		mode INTEGER NOT NULL,
+		uid INTEGER NOT NULL,
+		gid INTEGER NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		sha256 TEXT,
+		link_target TEXT,
+		xattrs TEXT,
+		captured_at DATETIME NOT NULL
+	)
+`
+
+// FIM_CHANGES_CREATE holds the paths that currently differ from the baseline. A path is removed
+// again once it's back the way the baseline has it.
+const FIM_CHANGES_CREATE string = `
+	CREATE TABLE IF NOT EXISTS fim_changes (
+		full_path TEXT NOT NULL PRIMARY KEY,
+		change TEXT NOT NULL,
+		fields TEXT,
+		current TEXT,
+		detected_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	)
+`
+
+// FIM_REPORTS_CREATE holds every signed report, exactly as it was signed.
+const FIM_REPORTS_CREATE string = `
+	CREATE TABLE IF NOT EXISTS fim_reports (
+		id INTEGER NOT NULL PRIMARY KEY,
+		report TEXT NOT NULL,
+		signature BLOB NOT NULL,
+		public_key BLOB NOT NULL,
+		created_at DATETIME NOT NULL
+	)
+`
+
+// The kinds of change from the baseline
+const (
+	FimAdded    = "added"
+	FimRemoved  = "removed"
+	FimModified = "modified"
+)
+
+// fimLock keeps baseline captures and checks from interleaving, since a check against a
+// baseline that's being replaced would record changes that aren't there.
+var fimLock sync.Mutex
+
+// FimPaths returns the configured `fim_paths` as absolute paths. Relative paths are taken to be
+// relative to `rootPath`, and config.Validate has already made sure none lie outside it, since
+// nothing else is watched.
+func FimPaths(rootPath string) []string {
+	var paths []string
+	for _, path := range config.GetConfig().FimPaths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(rootPath, path)
+		}
+		paths = append(paths, filepath.Clean(path))
+	}
+
+	return paths
+}
+
+// CaptureFimBaseline replaces the baseline with the current state of `paths`, and forgets
+// every change recorded against the old one. It hashes everything, so it takes a while.
+func CaptureFimBaseline(ctx context.Context, db *sql.DB, paths []string) (int, error) {
+	fimLock.Lock()
+	defer fimLock.Unlock()
+
+	entries := make(map[string]fim.Entry)
+	for _, path := range paths {
+		if err := captureFimTree(ctx, sharedHasher(), path, true, entries); err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM fim_baseline`); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM fim_changes`); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		xattrs, err := json.Marshal(entry.Xattrs)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO fim_baseline (
+				full_path, mode, uid, gid, size_bytes, sha256, link_target, xattrs, captured_at
+			)
+			VALUES (?, ?, ?, ?, ?, nullif(?, ''), nullif(?, ''), ?, ?)
+		`, entry.Path, uint32(entry.Mode), entry.UID, entry.GID, entry.Size, entry.SHA256,
+			entry.LinkTarget, string(xattrs), now)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	zap.L().Info("captured fim baseline", zap.Strings("paths", paths), zap.Int("entries", len(entries)))
+	return len(entries), nil
+}
+
+// captureFimTree adds the entry at `path` to `entries`, along with everything beneath it if
+// `recursive`. Paths that vanish partway through are left out.
+func captureFimTree(ctx context.Context, hasher *hashing.Hasher, path string, recursive bool, entries map[string]fim.Entry) error {
+	capture := func(path string) error {
+		entry, err := fim.Capture(ctx, hasher, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			zap.L().Warn("skipping unreadable path", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entries[path] = entry
+		return nil
+	}
+
+	if !recursive {
+		return capture(path)
+	}
+
+	return filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			zap.L().Warn("skipping unreadable directory", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return capture(path)
+	})
+}
+
+// loadFimBaseline returns the baseline for `path`, and everything beneath it if `recursive`.
+func loadFimBaseline(ctx context.Context, q dbExecutor, path string, recursive bool) (map[string]fim.Entry, error) {
+	lo, hi := descendantRange(path)
+	rows, err := q.QueryContext(ctx, `
+		SELECT full_path, mode, uid, gid, size_bytes, coalesce(sha256, ''), coalesce(link_target, ''),
+			coalesce(xattrs, 'null')
+		FROM fim_baseline
+		WHERE full_path = ? OR (? AND full_path >= ? AND full_path < ?)
+	`, path, recursive, lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]fim.Entry)
+	for rows.Next() {
+		var entry fim.Entry
+		var mode uint32
+		var xattrs string
+		if err := rows.Scan(&entry.Path, &mode, &entry.UID, &entry.GID, &entry.Size, &entry.SHA256,
+			&entry.LinkTarget, &xattrs); err != nil {
+			return nil, err
+		}
+
+		entry.Mode = fs.FileMode(mode)
+		if err := json.Unmarshal([]byte(xattrs), &entry.Xattrs); err != nil {
+			return nil, err
+		}
+		entries[entry.Path] = entry
+	}
+
+	return entries, rows.Err()
+}
+
+// FindFimChanges returns everything that currently differs from the baseline under `paths`,
+// with the baseline and current state of each. It's left to the caller to set GeneratedAt.
+func FindFimChanges(ctx context.Context, db *sql.DB, paths []string) (fim.Report, error) {
+	report := fim.Report{
+		Paths:    paths,
+		Added:    []fim.Change{},
+		Removed:  []fim.Change{},
+		Modified: []fim.Change{},
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		zap.L().Warn("failed to get hostname", zap.Error(err))
+	}
+	report.Hostname = hostname
+
+	var capturedAt time.Time
+	err = db.QueryRowContext(ctx, `
+		SELECT captured_at FROM fim_baseline ORDER BY captured_at DESC LIMIT 1
+	`).Scan(&capturedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return report, err
+	}
+	if err == nil {
+		report.BaselineCapturedAt = &capturedAt
+	}
+
+	filter := ipc.Filter{Prefixes: paths}
+	rows, err := db.QueryContext(ctx, `
+		SELECT full_path, change, coalesce(fields, 'null'), coalesce(current, 'null'), detected_at
+		FROM fim_changes
+		ORDER BY full_path
+	`)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	var changes []fim.Change
+	var kinds []string
+	for rows.Next() {
+		var change fim.Change
+		var kind, fields, current string
+		if err := rows.Scan(&change.Path, &kind, &fields, &current, &change.DetectedAt); err != nil {
+			return report, err
+		}
+
+		if !filter.MatchPath(change.Path) {
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(fields), &change.Fields); err != nil {
+			return report, err
+		}
+		if err := json.Unmarshal([]byte(current), &change.Current); err != nil {
+			return report, err
+		}
+
+		changes = append(changes, change)
+		kinds = append(kinds, kind)
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	rows.Close()
+
+	for i, change := range changes {
+		if kinds[i] != FimAdded {
+			baseline, err := loadFimBaseline(ctx, db, change.Path, false)
+			if err != nil {
+				return report, err
+			}
+			if entry, ok := baseline[change.Path]; ok {
+				change.Baseline = &entry
+			}
+		}
+
+		switch kinds[i] {
+		case FimAdded:
+			report.Added = append(report.Added, change)
+		case FimRemoved:
+			report.Removed = append(report.Removed, change)
+		case FimModified:
+			report.Modified = append(report.Modified, change)
+		}
+	}
+
+	return report, nil
+}
+
+type FimTaskState struct {
+	// rootPath is the root path that we're watching
+	rootPath string
+
+	// broadcaster is a pointer to the broadcaster.
+	broadcaster *ipc.Broadcaster
+
+	// broadcastChannel is the broadcast channel for this task.
+	broadcastChannel chan ipc.Message
+
+	// db is the sqlite database handle
+	db *sql.DB
+
+	// hasher hashes monitored files to compare with their baseline
+	hasher *hashing.Hasher
+
+	// paths are the monitored paths
+	paths []string
+}
+
+func NewFimTaskState(rootPath string, broadcaster *ipc.Broadcaster, broadcastChannel chan ipc.Message) *FimTaskState {
+	db, err := sql.Open("sqlite3", config.GetDBPath())
+	if err != nil {
+		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
+	}
+
+	_, err = db.Exec(FIM_BASELINE_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create fim_baseline table", zap.Error(err))
+	}
+
+	_, err = db.Exec(FIM_CHANGES_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create fim_changes table", zap.Error(err))
+	}
+
+	_, err = db.Exec(FIM_REPORTS_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create fim_reports table", zap.Error(err))
+	}
+
+	// Make sure reports can be signed before there's anything to report
+	if _, err := fim.LoadOrCreateKey(config.GetFimKeyPath()); err != nil {
+		zap.L().Fatal("failed to load fim signing key", zap.Error(err))
+	}
+
+	return &FimTaskState{
+		rootPath:         rootPath,
+		broadcaster:      broadcaster,
+		broadcastChannel: broadcastChannel,
+		db:               db,
+		hasher:           sharedHasher(),
+		paths:            FimPaths(rootPath),
+	}
+}
+
+// RootPath returns the root path of the project.
+func (ft *FimTaskState) RootPath() string {
+	return ft.rootPath
+}
+
+// Broadcaster returns a pointer to the broadcaster.
+func (ft *FimTaskState) Broadcaster() *ipc.Broadcaster {
+	return ft.broadcaster
+}
+
+// BroadcastChannel returns the broadcast channel for this task.
+func (ft *FimTaskState) BroadcastChannel() chan ipc.Message {
+	return ft.broadcastChannel
+}
+
+// FimTask compares the paths under `fim_paths` against their baseline as filesystem events come
+// in, keeping `fim_changes` up to date. The first time it runs it captures the baseline, and
+// after that everything is checked at startup and every `fim_check_interval`, to catch whatever
+// happened while fsd wasn't watching.
+type FimTask struct {
+	state *FimTaskState
+
+	// pending are the paths waiting to be checked, and whether to check beneath them too
+	pending *workQueue[bool]
+}
+
+func FimTaskName() string {
+	return "FimTask"
+}
+
+func NewFimTask(state *FimTaskState) *FimTask {
+	return &FimTask{
+		state: state,
+		pending: newWorkQueue(0, func(existing, recursive bool) bool {
+			return existing || recursive
+		}),
+	}
+}
+
+func (ft *FimTask) StartEventLoop(ctx context.Context) {
+	// Events only say which paths to look at again, checkLoop does the looking
+	go ft.checkLoop(ctx)
+
+	for {
+		select {
+		case event := <-ft.state.BroadcastChannel():
+			if err := ft.HandleMessage(ctx, event); err != nil {
+				zap.L().Error("error handling message", zap.String("task name", FimTaskName()), zap.Error(err))
+			}
+			ft.state.broadcaster.Ack(FimTaskName(), event)
+		case <-ctx.Done():
+			zap.L().Info("got shutdown signal, exiting", zap.String("task name", FimTaskName()))
+			return
+		}
+	}
+}
+
+// HandleMessage queues the paths touched by a filesystem event for checking. Anything that can
+// bring a whole directory in or out of view is checked all the way down.
+func (ft *FimTask) HandleMessage(ctx context.Context, msg ipc.Message) error {
+	var recursive bool
+	switch msg.EventOperation() {
+	case ipc.Settled, ipc.Chmod:
+		recursive = false
+	case ipc.Create, ipc.Remove, ipc.Rename, ipc.Move, ipc.Rescan:
+		recursive = true
+	default:
+		return nil
+	}
+
+	paths := []string{msg.EventName()}
+	if mp, ok := ipc.Unwrap(msg).(ipc.MultiPathMessage); ok {
+		paths = mp.EventPaths()
+	}
+
+	for _, path := range paths {
+		for _, monitored := range ft.state.paths {
+			switch {
+			case path == monitored || strings.HasPrefix(path, monitored+"/"):
+				ft.pending.add(path, recursive)
+			case recursive && strings.HasPrefix(monitored, path+"/"):
+				// A directory above the monitored path came or went
+				ft.pending.add(monitored, true)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SendMessage sends a message over the network
+func (ft *FimTask) SendMessage(msg ipc.Message) error {
+	ms, err := msg.String()
+	if err != nil {
+		zap.L().Error("attempted to send an invalid message", zap.Error(err))
+		return err
+	}
+	zap.L().Debug("sent message", zap.String("task name", FimTaskName()), zap.String("msg", ms))
+	return nil
+}
+
+// checkLoop works through the pending paths, checking everything at startup and every
+// `fim_check_interval` after that.
+func (ft *FimTask) checkLoop(ctx context.Context) {
+	ticker := time.NewTicker(config.GetConfig().FimCheckInterval)
+	defer ticker.Stop()
+
+	if err := ft.start(ctx); err != nil {
+		zap.L().Error("failed to check fim paths", zap.String("task name", FimTaskName()), zap.Error(err))
+	}
+
+	for {
+		path, recursive, ok := ft.pending.next()
+		if ok {
+			if err := ft.check(ctx, path, recursive); err != nil && ctx.Err() == nil {
+				zap.L().Error("failed to check path", zap.String("task name", FimTaskName()), zap.String("path", path), zap.Error(err))
+			}
+			continue
+		}
+
+		select {
+		case <-ft.pending.wake:
+		case <-ticker.C:
+			if err := ft.checkAll(ctx); err != nil {
+				zap.L().Error("failed to check fim paths", zap.String("task name", FimTaskName()), zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// start captures the baseline if there isn't one yet, and otherwise checks everything against
+// it.
+func (ft *FimTask) start(ctx context.Context) error {
+	var count int
+	err := ft.state.db.QueryRowContext(ctx, `SELECT count(*) FROM fim_baseline`).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		_, err := CaptureFimBaseline(ctx, ft.state.db, ft.state.paths)
+		return err
+	}
+
+	return ft.checkAll(ctx)
+}
+
+func (ft *FimTask) checkAll(ctx context.Context) error {
+	for _, path := range ft.state.paths {
+		if err := ft.check(ctx, path, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// check compares `path`, and everything beneath it if `recursive`, against the baseline.
+func (ft *FimTask) check(ctx context.Context, path string, recursive bool) error {
+	fimLock.Lock()
+	defer fimLock.Unlock()
+
+	baseline, err := loadFimBaseline(ctx, ft.state.db, path, recursive)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]fim.Entry)
+	if err := captureFimTree(ctx, ft.state.hasher, path, recursive, current); err != nil {
+		return err
+	}
+
+	for path, entry := range current {
+		if want, ok := baseline[path]; ok {
+			if err := ft.record(ctx, path, FimModified, fim.Diff(want, entry), &entry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := ft.record(ctx, path, FimAdded, nil, &entry); err != nil {
+			return err
+		}
+	}
+
+	for path := range baseline {
+		if _, ok := current[path]; ok {
+			continue
+		}
+
+		if err := ft.record(ctx, path, FimRemoved, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return ft.forget(ctx, path, recursive, baseline, current)
+}
+
+// forget clears the changes recorded for `path`, and everything beneath it if `recursive`,
+// that are neither in the baseline nor there any more, like a file that was added and then
+// removed again.
+func (ft *FimTask) forget(ctx context.Context, path string, recursive bool, baseline, current map[string]fim.Entry) error {
+	lo, hi := descendantRange(path)
+	rows, err := ft.state.db.QueryContext(ctx, `
+		SELECT full_path FROM fim_changes
+		WHERE full_path = ? OR (? AND full_path >= ? AND full_path < ?)
+	`, path, recursive, lo, hi)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var stale []string
+	for rows.Next() {
+		var changed string
+		if err := rows.Scan(&changed); err != nil {
+			return err
+		}
+
+		_, inBaseline := baseline[changed]
+		_, inCurrent := current[changed]
+		if !inBaseline && !inCurrent {
+			stale = append(stale, changed)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, changed := range stale {
+		_, err := ft.state.db.ExecContext(ctx, `DELETE FROM fim_changes WHERE full_path = ?`, changed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// record stores how `path` differs from the baseline, or clears it if it's a modification with
+// no changed fields.
+func (ft *FimTask) record(ctx context.Context, path, change string, fields []string, current *fim.Entry) error {
+	if change == FimModified && len(fields) == 0 {
+		_, err := ft.state.db.ExecContext(ctx, `DELETE FROM fim_changes WHERE full_path = ?`, path)
+		return err
+	}
+
+	fieldsJSON, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	currentJSON, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	// Only log the first time, checks come around again and again
+	var previousChange, previousFields string
+	err = ft.state.db.QueryRowContext(ctx, `
+		SELECT change, coalesce(fields, '') FROM fim_changes WHERE full_path = ?
+	`, path).Scan(&previousChange, &previousFields)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if previousChange != change || previousFields != string(fieldsJSON) {
+		zap.L().Warn("path differs from fim baseline",
+			zap.String("path", path),
+			zap.String("change", change),
+			zap.Strings("fields", fields))
+	}
+
+	now := time.Now()
+	_, err = ft.state.db.ExecContext(ctx, `
+		INSERT INTO fim_changes (full_path, change, fields, current, detected_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(full_path) DO UPDATE SET
+			change = excluded.change,
+			fields = excluded.fields,
+			current = excluded.current,
+			updated_at = excluded.updated_at
+	`, path, change, string(fieldsJSON), string(currentJSON), now, now)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
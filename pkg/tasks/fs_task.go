@@ -27,15 +27,40 @@ const DISK_STATS_CREATE string = `
 	)
 `
 
+func init() {
+	ipc.RegisterMessage(FsMessage{})
+}
+
 type FsMessage struct {
 	Name      string    `json:"event_name"`
 	Operation ipc.FsdOp `json:"event_operation"`
+
+	// From and To are only set for Move events, where Name is the same as To.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+
+	// Count is how many raw filesystem events this message stands for, which is more than one
+	// when a burst of events was coalesced. Synthesized events (e.g. Settled) have none.
+	Count int `json:"count,omitempty"`
 }
 
 func NewFromINotifyEvent(iNotifyEvent fsnotify.Event) FsMessage {
 	return FsMessage{
 		Name:      iNotifyEvent.Name,
 		Operation: ipc.NewFsdOpFromINotifyOp(iNotifyEvent.Op),
+		Count:     1,
+	}
+}
+
+// NewMoveMessage creates a Move event for a path that was renamed from `from` to `to`, made up
+// of the Rename and Create events that were paired together.
+func NewMoveMessage(from, to string) FsMessage {
+	return FsMessage{
+		Name:      to,
+		Operation: ipc.Move,
+		From:      from,
+		To:        to,
+		Count:     2,
 	}
 }
 
@@ -56,6 +81,15 @@ func (fs FsMessage) EventOperation() ipc.FsdOp {
 	return fs.Operation
 }
 
+// EventPaths implements ipc.MultiPathMessage, so moves can be matched on either end.
+func (fs FsMessage) EventPaths() []string {
+	if fs.Operation == ipc.Move {
+		return []string{fs.From, fs.To}
+	}
+
+	return []string{fs.Name}
+}
+
 type FsTaskState struct {
 	// rootPath is the root path of the project.
 	rootPath string
@@ -153,13 +187,18 @@ func (fs *FsTask) StartEventLoop(ctx context.Context) {
 		zap.L().Fatal("failed to compute initial disk stats for root dir")
 	}
 
+	// A ticker rather than time.After, which a steady stream of events would keep putting off
+	ticker := time.NewTicker(config.GetConfig().DiskStatsUpdateInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case event := <-fs.state.BroadcastChannel():
 			if err := fs.HandleMessage(ctx, event); err != nil {
 				zap.L().Error("error handling message", zap.String("task name", FsTaskName()), zap.Error(err))
 			}
-		case <-time.After(config.GetConfig().DiskStatsUpdateInterval):
+			fs.state.broadcaster.Ack(FsTaskName(), event)
+		case <-ticker.C:
 			if err := fs.RecomputeDiskStatistics(ctx); err != nil {
 				zap.L().Error("error computing disk stats", zap.String("task name", FsTaskName()), zap.Error(err))
 			}
@@ -170,15 +209,15 @@ func (fs *FsTask) StartEventLoop(ctx context.Context) {
 	}
 }
 
-// HandleMessage handles a network message
+// HandleMessage handles a network message. Disk stats are only recomputed on the
+// `disk_stats_update_interval` timer, not for every event.
 func (fs *FsTask) HandleMessage(ctx context.Context, msg ipc.Message) error {
 	// if it's a compact message, compact!
 	if msg.EventOperation() == ipc.Compact {
 		return fs.doCompaction(ctx)
 	}
 
-	// otherwise get the disk stats
-	return fs.RecomputeDiskStatistics(ctx)
+	return nil
 }
 
 // SendMessage sends a message over the network
@@ -0,0 +1,432 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fsd/internal/config"
+	"fsd/pkg/hashing"
+	"fsd/pkg/ipc"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// hashRetryDelay is how long to wait before trying a file again when the index hasn't
+	// caught up with it yet
+	hashRetryDelay = time.Second
+
+	// hashMaxRetries is how many times to try before leaving a file to the next sweep
+	hashMaxRetries = 5
+
+	// hashSweepBatch is how many unhashed files a sweep reads from the index at a time. The
+	// next batch isn't read until they've all been hashed.
+	hashSweepBatch = 1000
+
+	// hashMaxPending caps the files waiting to be hashed. Settled writes beyond that are left
+	// to the next sweep.
+	hashMaxPending = 10000
+
+	// hashFailureRetry is how long a file that couldn't be read is left alone, unless it
+	// changes in the meantime
+	hashFailureRetry = 24 * time.Hour
+)
+
+// HASH_FAILURES_CREATE creates the table of files that couldn't be hashed, so that sweeps
+// don't keep trying them. A failure only counts for as long as the file's size, mtime and
+// inode stay the same.
+const HASH_FAILURES_CREATE string = `
+	CREATE TABLE IF NOT EXISTS hash_failures (
+		full_path TEXT NOT NULL PRIMARY KEY,
+		size_bytes INTEGER NOT NULL,
+		inode INTEGER NOT NULL,
+		modified_at DATETIME NOT NULL,
+		error TEXT NOT NULL,
+		failed_at DATETIME NOT NULL
+	)
+`
+
+// sharedHasher is used for everything fsd hashes, so the rate limit holds across the hash,
+// scrub and FIM tasks alike.
+var sharedHasher = sync.OnceValue(func() *hashing.Hasher {
+	return hashing.NewHasher(config.GetConfig().HashRateLimit)
+})
+
+type HashTaskState struct {
+	// rootPath is the root path that we're watching
+	rootPath string
+
+	// broadcaster is a pointer to the broadcaster.
+	broadcaster *ipc.Broadcaster
+
+	// broadcastChannel is the broadcast channel for this task.
+	broadcastChannel chan ipc.Message
+
+	// db is the sqlite database handle
+	db *sql.DB
+
+	// hasher reads the files, no faster than `hash_rate_limit`
+	hasher *hashing.Hasher
+}
+
+func NewHashTaskState(rootPath string, broadcaster *ipc.Broadcaster, broadcastChannel chan ipc.Message) *HashTaskState {
+	db, err := sql.Open("sqlite3", config.GetDBPath())
+	if err != nil {
+		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
+	}
+
+	// The hash columns are added by the metadata task, which is set up before us
+	_, err = db.Exec(METADATA_CURRENT_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create metadata_current table", zap.Error(err))
+	}
+
+	_, err = db.Exec(HASH_FAILURES_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create hash_failures table", zap.Error(err))
+	}
+
+	return &HashTaskState{
+		rootPath:         rootPath,
+		broadcaster:      broadcaster,
+		broadcastChannel: broadcastChannel,
+		db:               db,
+		hasher:           sharedHasher(),
+	}
+}
+
+// RootPath returns the root path of the project.
+func (ht *HashTaskState) RootPath() string {
+	return ht.rootPath
+}
+
+// Broadcaster returns a pointer to the broadcaster.
+func (ht *HashTaskState) Broadcaster() *ipc.Broadcaster {
+	return ht.broadcaster
+}
+
+// BroadcastChannel returns the broadcast channel for this task.
+func (ht *HashTaskState) BroadcastChannel() chan ipc.Message {
+	return ht.broadcastChannel
+}
+
+// hashRequest is a file waiting to be hashed.
+type hashRequest struct {
+	// force rehashes the file even if it already has a hash
+	force bool
+
+	// attempts is how many times the index didn't match the file
+	attempts int
+}
+
+// HashTask fills in the content hashes of regular files in the metadata index. The index
+// clears a file's hashes whenever its size, mtime or inode change, so a sweep for files without
+// them picks up anything that needs (re)hashing. Settled writes are hashed straight away, even
+// if the stat looks the same.
+type HashTask struct {
+	state *HashTaskState
+
+	// pending are the files waiting to be hashed, worked through by hashLoop
+	pending *workQueue[hashRequest]
+}
+
+func HashTaskName() string {
+	return "HashTask"
+}
+
+func NewHashTask(state *HashTaskState) *HashTask {
+	return &HashTask{
+		state:   state,
+		pending: newWorkQueue(hashMaxPending, mergeHashRequests),
+	}
+}
+
+func (ht *HashTask) StartEventLoop(ctx context.Context) {
+	// Events only queue files, hashLoop reads them at its own pace
+	go ht.hashLoop(ctx)
+
+	for {
+		select {
+		case event := <-ht.state.BroadcastChannel():
+			if err := ht.HandleMessage(ctx, event); err != nil {
+				zap.L().Error("error handling message", zap.String("task name", HashTaskName()), zap.Error(err))
+			}
+			ht.state.broadcaster.Ack(HashTaskName(), event)
+		case <-ctx.Done():
+			zap.L().Info("got shutdown signal, exiting", zap.String("task name", HashTaskName()))
+			return
+		}
+	}
+}
+
+// HandleMessage handles a network message
+func (ht *HashTask) HandleMessage(ctx context.Context, msg ipc.Message) error {
+	if msg.EventOperation() == ipc.Settled {
+		ht.pending.add(msg.EventName(), hashRequest{force: true})
+	}
+
+	return nil
+}
+
+// SendMessage sends a message over the network
+func (ht *HashTask) SendMessage(msg ipc.Message) error {
+	ms, err := msg.String()
+	if err != nil {
+		zap.L().Error("attempted to send an invalid message", zap.Error(err))
+		return err
+	}
+	zap.L().Debug("sent message", zap.String("task name", HashTaskName()), zap.String("msg", ms))
+	return nil
+}
+
+// mergeHashRequests keeps a file that's waiting to be rehashed regardless from being
+// downgraded by a sweep queuing it again.
+func mergeHashRequests(existing, queued hashRequest) hashRequest {
+	queued.force = queued.force || existing.force
+	return queued
+}
+
+// hashLoop works through the pending files, sweeping the index for unhashed files at startup
+// and every `hash_scan_interval` after that. Each sweep reads a batch at a time, going on to
+// the next once the pending files have been dealt with.
+func (ht *HashTask) hashLoop(ctx context.Context) {
+	ticker := time.NewTicker(config.GetConfig().HashScanInterval)
+	defer ticker.Stop()
+
+	// sweepFrom is the path the sweep in progress carries on after, empty when there isn't one
+	sweepFrom, _ := descendantRange(ht.state.RootPath())
+	for {
+		path, req, ok := ht.pending.next()
+		if ok {
+			if err := ht.hash(ctx, path, req); err != nil && ctx.Err() == nil {
+				zap.L().Error("failed to hash file", zap.String("task name", HashTaskName()), zap.String("path", path), zap.Error(err))
+			}
+			continue
+		}
+
+		if sweepFrom != "" {
+			var err error
+			sweepFrom, err = ht.sweep(ctx, sweepFrom)
+			if err != nil && ctx.Err() == nil {
+				zap.L().Error("failed to sweep for unhashed files", zap.String("task name", HashTaskName()), zap.Error(err))
+			}
+			continue
+		}
+
+		select {
+		case <-ht.pending.wake:
+		case <-ticker.C:
+			sweepFrom, _ = descendantRange(ht.state.RootPath())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sweep queues the next batch of regular files under the root that don't have a hash, leaving
+// out the ones that recently failed. It returns the path to carry on after, or nothing once
+// it's reached the end.
+func (ht *HashTask) sweep(ctx context.Context, after string) (string, error) {
+	lo, hi := descendantRange(ht.state.RootPath())
+	retryBefore := time.Now().Add(-hashFailureRetry)
+	if after == lo {
+		_, err := ht.state.db.ExecContext(ctx, `DELETE FROM hash_failures WHERE failed_at < ?`, retryBefore)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	rows, err := ht.state.db.QueryContext(ctx, `
+		SELECT c.full_path FROM metadata_current c
+		LEFT JOIN hash_failures f ON f.full_path = c.full_path
+			AND f.size_bytes = c.size_bytes AND f.inode = c.inode AND f.modified_at = c.modified_at
+		WHERE c.file_type = ? AND c.sha256 IS NULL AND c.full_path > ? AND c.full_path < ?
+			AND f.full_path IS NULL
+		ORDER BY c.full_path
+		LIMIT ?
+	`, fileTypeRegular, after, hi, hashSweepBatch)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var last string
+	queued := 0
+	for rows.Next() {
+		if err := rows.Scan(&last); err != nil {
+			return "", err
+		}
+		ht.pending.add(last, hashRequest{})
+		queued++
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	if queued > 0 {
+		zap.L().Info("queued unhashed files", zap.String("task name", HashTaskName()), zap.Int("count", queued))
+	}
+
+	if queued < hashSweepBatch {
+		return "", nil
+	}
+	return last, nil
+}
+
+// errHashStale means the index doesn't match the file yet, so there's nothing to store the hash
+// against.
+var errHashStale = errors.New("index does not match file")
+
+// errHashChanged means the file changed as it was read, so events for the change are on the
+// way and the hash is no good.
+var errHashChanged = errors.New("file changed while it was read")
+
+// hashable is a regular file as the index has it.
+type hashable struct {
+	path  string
+	size  int64
+	inode uint64
+
+	// modifiedAt is also kept exactly as stored, so the hash can be written back against it
+	modifiedAt       time.Time
+	storedModifiedAt string
+
+	// sha256 is the stored hash, if there is one
+	sha256 string
+}
+
+// lookupHashable returns the indexed regular file at `path`, if there is one.
+func lookupHashable(ctx context.Context, q dbExecutor, path string) (hashable, bool, error) {
+	file := hashable{path: path}
+	err := q.QueryRowContext(ctx, `
+		SELECT size_bytes, inode, modified_at, CAST(modified_at AS TEXT), coalesce(sha256, '')
+		FROM metadata_current WHERE full_path = ? AND file_type = ?
+	`, path, fileTypeRegular).Scan(&file.size, &file.inode, &file.modifiedAt, &file.storedModifiedAt, &file.sha256)
+	if errors.Is(err, sql.ErrNoRows) {
+		return file, false, nil
+	}
+
+	return file, err == nil, err
+}
+
+// hashFile hashes `file` and stores the result, provided the file matches the index from before
+// it was read until after. It returns errHashStale if the index is behind, errHashChanged if
+// the file changed as it was read, or fs.ErrNotExist if it has gone.
+func hashFile(ctx context.Context, q dbExecutor, hasher *hashing.Hasher, file hashable) (hashing.Sums, error) {
+	before, err := os.Lstat(file.path)
+	if err != nil {
+		return hashing.Sums{}, err
+	}
+
+	if before.Size() != file.size || !before.ModTime().Equal(file.modifiedAt) {
+		return hashing.Sums{}, errHashStale
+	}
+	if st, ok := before.Sys().(*syscall.Stat_t); ok && st.Ino != file.inode {
+		return hashing.Sums{}, errHashStale
+	}
+
+	start := time.Now()
+	sums, err := hasher.HashFile(ctx, file.path)
+	if err != nil {
+		return sums, err
+	}
+
+	after, err := os.Lstat(file.path)
+	if err != nil {
+		return sums, err
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return sums, errHashChanged
+	}
+
+	now := time.Now()
+	for _, table := range []string{"metadata_current", "metadata"} {
+		_, err := q.ExecContext(ctx, `
+			UPDATE `+table+` SET sha256 = ?, xxhash = ?, hashed_at = ?
+			WHERE full_path = ? AND size_bytes = ? AND inode = ? AND modified_at = ?
+		`, sums.SHA256, sums.XXHash, now, file.path, file.size, file.inode, file.storedModifiedAt)
+		if err != nil {
+			return sums, err
+		}
+	}
+
+	zap.L().Debug("hashed file",
+		zap.String("path", file.path),
+		zap.Int64("size", file.size),
+		zap.String("sha256", sums.SHA256),
+		zap.Duration("took", time.Since(start)))
+	return sums, nil
+}
+
+// hash hashes `path` unless it already has a hash and the request isn't forced.
+func (ht *HashTask) hash(ctx context.Context, path string, req hashRequest) error {
+	file, ok, err := lookupHashable(ctx, ht.state.db, path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Either it's not a regular file, or it's not been indexed yet
+		if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+			ht.retry(path, req)
+		}
+		return nil
+	}
+
+	if file.sha256 != "" && !req.force {
+		return nil
+	}
+
+	_, err = hashFile(ctx, ht.state.db, ht.state.hasher, file)
+	switch {
+	case errors.Is(err, errHashStale):
+		ht.retry(path, req)
+		return nil
+	case errors.Is(err, errHashChanged), errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err == nil:
+		_, err = ht.state.db.ExecContext(ctx, `DELETE FROM hash_failures WHERE full_path = ?`, path)
+		return err
+	}
+
+	// The file can't be read as it is, so there's no point trying again until it changes
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		if err := ht.recordFailure(ctx, file, err); err != nil {
+			zap.L().Error("failed to record hash failure", zap.String("task name", HashTaskName()), zap.String("path", path), zap.Error(err))
+		}
+	}
+
+	return err
+}
+
+// recordFailure notes that `file` couldn't be hashed, so sweeps leave it alone for a while.
+func (ht *HashTask) recordFailure(ctx context.Context, file hashable, cause error) error {
+	_, err := ht.state.db.ExecContext(ctx, `
+		INSERT INTO hash_failures (full_path, size_bytes, inode, modified_at, error, failed_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(full_path) DO UPDATE SET
+			size_bytes = excluded.size_bytes,
+			inode = excluded.inode,
+			modified_at = excluded.modified_at,
+			error = excluded.error,
+			failed_at = excluded.failed_at
+	`, file.path, file.size, file.inode, file.storedModifiedAt, cause.Error(), time.Now())
+	return err
+}
+
+// retry tries `path` again shortly, giving the metadata index a chance to catch up.
+func (ht *HashTask) retry(path string, req hashRequest) {
+	req.attempts++
+	if req.attempts > hashMaxRetries {
+		return
+	}
+
+	time.AfterFunc(hashRetryDelay, func() {
+		ht.pending.add(path, req)
+	})
+}
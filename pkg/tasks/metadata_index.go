@@ -0,0 +1,812 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// METADATA_CURRENT_CREATE creates the current-state metadata table. Unlike `metadata`, which
+// keeps a snapshot row every time a path changes, this table holds exactly one row per path.
+const METADATA_CURRENT_CREATE string = `
+	CREATE TABLE IF NOT EXISTS metadata_current (
+		id INTEGER NOT NULL PRIMARY KEY,
+		full_path TEXT NOT NULL UNIQUE,
+		size_bytes INTEGER NOT NULL,
+		file_mode INTEGER NOT NULL,
+		is_directory INTEGER NOT NULL,
+		inode INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		modified_at DATETIME NOT NULL,
+		allocated_bytes INTEGER NOT NULL DEFAULT 0,
+		uid INTEGER NOT NULL DEFAULT 0,
+		gid INTEGER NOT NULL DEFAULT 0,
+		owner_name TEXT NOT NULL DEFAULT '',
+		group_name TEXT NOT NULL DEFAULT '',
+		device INTEGER NOT NULL DEFAULT 0,
+		nlink INTEGER NOT NULL DEFAULT 0,
+		accessed_at DATETIME,
+		changed_at DATETIME,
+		file_type TEXT NOT NULL DEFAULT '',
+		symlink_target TEXT,
+		sha256 TEXT,
+		xxhash TEXT,
+		hashed_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS metadata_current_inode ON metadata_current (inode);
+`
+
+// METADATA_HASH_INDEX_CREATE indexes the content hashes so files can be looked up by them. It
+// runs after the hash columns have been added to older tables.
+const METADATA_HASH_INDEX_CREATE string = `
+	CREATE INDEX IF NOT EXISTS metadata_current_sha256 ON metadata_current (sha256);
+	CREATE INDEX IF NOT EXISTS metadata_current_xxhash ON metadata_current (xxhash);
+`
+
+// metadataStatColumns are the stat columns added to the metadata tables since they were first
+// created. Existing rows pick up real values the next time they're reconciled.
+var metadataStatColumns = []columnDef{
+	{"allocated_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"uid", "INTEGER NOT NULL DEFAULT 0"},
+	{"gid", "INTEGER NOT NULL DEFAULT 0"},
+	{"owner_name", "TEXT NOT NULL DEFAULT ''"},
+	{"group_name", "TEXT NOT NULL DEFAULT ''"},
+	{"device", "INTEGER NOT NULL DEFAULT 0"},
+	{"nlink", "INTEGER NOT NULL DEFAULT 0"},
+	{"accessed_at", "DATETIME"},
+	{"changed_at", "DATETIME"},
+	{"file_type", "TEXT NOT NULL DEFAULT ''"},
+	{"symlink_target", "TEXT"},
+}
+
+// metadataHashColumns hold the content hashes of regular files, filled in by the hash task.
+// They're cleared whenever the size, mtime or inode changes, so a hash is never stale.
+var metadataHashColumns = []columnDef{
+	{"sha256", "TEXT"},
+	{"xxhash", "TEXT"},
+	{"hashed_at", "DATETIME"},
+}
+
+// File types as stored in the file_type column
+const (
+	fileTypeRegular     = "regular"
+	fileTypeDirectory   = "directory"
+	fileTypeSymlink     = "symlink"
+	fileTypeFifo        = "fifo"
+	fileTypeSocket      = "socket"
+	fileTypeCharDevice  = "char_device"
+	fileTypeBlockDevice = "block_device"
+	fileTypeIrregular   = "irregular"
+)
+
+func fileType(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return fileTypeRegular
+	case mode.IsDir():
+		return fileTypeDirectory
+	case mode&fs.ModeSymlink != 0:
+		return fileTypeSymlink
+	case mode&fs.ModeNamedPipe != 0:
+		return fileTypeFifo
+	case mode&fs.ModeSocket != 0:
+		return fileTypeSocket
+	case mode&fs.ModeCharDevice != 0:
+		return fileTypeCharDevice
+	case mode&fs.ModeDevice != 0:
+		return fileTypeBlockDevice
+	default:
+		return fileTypeIrregular
+	}
+}
+
+// METADATA_HISTORY_CREATE creates the append-only change log. Each row records a single
+// transition of a path along with its before and after values.
+const METADATA_HISTORY_CREATE string = `
+	CREATE TABLE IF NOT EXISTS metadata_history (
+		id INTEGER NOT NULL PRIMARY KEY,
+		full_path TEXT NOT NULL,
+		change TEXT NOT NULL,
+		old_path TEXT,
+		is_directory INTEGER NOT NULL,
+		old_size_bytes INTEGER,
+		new_size_bytes INTEGER,
+		old_file_mode INTEGER,
+		new_file_mode INTEGER,
+		old_modified_at DATETIME,
+		new_modified_at DATETIME,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS metadata_history_full_path ON metadata_history (full_path);
+	CREATE INDEX IF NOT EXISTS metadata_history_old_path ON metadata_history (old_path);
+`
+
+// The kinds of transitions recorded in metadata_history
+const (
+	changeCreated     = "created"
+	changeSizeChanged = "size_changed"
+	changeModeChanged = "mode_changed"
+	changeRemoved     = "removed"
+	changeRenamed     = "renamed"
+)
+
+// dbExecutor is satisfied by both *sql.DB and *sql.Tx.
+type dbExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// metadataEntry is the stat of a single path as it is stored in the index.
+type metadataEntry struct {
+	FullPath       string
+	SizeBytes      int64
+	AllocatedBytes int64
+	FileMode       fs.FileMode
+	IsDirectory    bool
+	Inode          uint64
+	ModifiedAt     time.Time
+	Uid            uint32
+	Gid            uint32
+	OwnerName      string
+	GroupName      string
+	Device         uint64
+	Nlink          uint64
+	AccessedAt     time.Time
+	ChangedAt      time.Time
+	FileType       string
+	SymlinkTarget  string
+}
+
+func newMetadataEntry(path string, info fs.FileInfo) metadataEntry {
+	entry := metadataEntry{
+		FullPath:    path,
+		SizeBytes:   info.Size(),
+		FileMode:    info.Mode().Perm(),
+		IsDirectory: info.IsDir(),
+		ModifiedAt:  info.ModTime(),
+		FileType:    fileType(info.Mode()),
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.Inode = st.Ino
+		// st_blocks is always in 512 byte units, whatever the filesystem block size
+		entry.AllocatedBytes = st.Blocks * 512
+		entry.Uid = st.Uid
+		entry.Gid = st.Gid
+		entry.OwnerName = owners.userName(st.Uid)
+		entry.GroupName = owners.groupName(st.Gid)
+		entry.Device = uint64(st.Dev)
+		entry.Nlink = uint64(st.Nlink)
+		entry.AccessedAt = time.Unix(st.Atim.Unix())
+		entry.ChangedAt = time.Unix(st.Ctim.Unix())
+	}
+
+	if entry.FileType == fileTypeSymlink {
+		// A failure here just means the link changed under us, the next event will catch it
+		if target, err := os.Readlink(path); err == nil {
+			entry.SymlinkTarget = target
+		}
+	}
+
+	return entry
+}
+
+// changed reports whether the stat of `other` differs from this entry. The atime and ctime
+// aren't compared, otherwise merely reading a file would count as a change; they're brought up
+// to date whenever something else changes.
+func (e metadataEntry) changed(other metadataEntry) bool {
+	return e.SizeBytes != other.SizeBytes ||
+		e.AllocatedBytes != other.AllocatedBytes ||
+		e.FileMode != other.FileMode ||
+		e.IsDirectory != other.IsDirectory ||
+		e.Inode != other.Inode ||
+		!e.ModifiedAt.Equal(other.ModifiedAt) ||
+		e.Uid != other.Uid ||
+		e.Gid != other.Gid ||
+		e.Device != other.Device ||
+		e.Nlink != other.Nlink ||
+		e.FileType != other.FileType ||
+		e.SymlinkTarget != other.SymlinkTarget
+}
+
+// metadataEntrySelect are the columns read back into a metadataEntry by scanMetadataEntry.
+const metadataEntrySelect = `
+	full_path, size_bytes, allocated_bytes, file_mode, is_directory, inode, modified_at,
+	uid, gid, owner_name, group_name, device, nlink, file_type, coalesce(symlink_target, '')
+`
+
+func scanMetadataEntry(row interface{ Scan(...any) error }) (metadataEntry, error) {
+	var entry metadataEntry
+	var isDirectory int
+	err := row.Scan(
+		&entry.FullPath,
+		&entry.SizeBytes,
+		&entry.AllocatedBytes,
+		&entry.FileMode,
+		&isDirectory,
+		&entry.Inode,
+		&entry.ModifiedAt,
+		&entry.Uid,
+		&entry.Gid,
+		&entry.OwnerName,
+		&entry.GroupName,
+		&entry.Device,
+		&entry.Nlink,
+		&entry.FileType,
+		&entry.SymlinkTarget,
+	)
+	entry.IsDirectory = isDirectory == 1
+	return entry, err
+}
+
+// metadataEntryColumns are the stat columns of an entry, in the order of values().
+const metadataEntryColumns = `
+	full_path, size_bytes, allocated_bytes, file_mode, is_directory, inode, modified_at,
+	uid, gid, owner_name, group_name, device, nlink, accessed_at, changed_at, file_type, symlink_target
+`
+
+// metadataEntryInsert are the columns written by put, in the order of values().
+const metadataEntryInsert = metadataEntryColumns + `, created_at`
+
+func (e metadataEntry) values(now time.Time) []any {
+	// Golang is silly...
+	isDirectory := 0
+	if e.IsDirectory {
+		isDirectory = 1
+	}
+
+	var symlinkTarget any
+	if e.SymlinkTarget != "" {
+		symlinkTarget = e.SymlinkTarget
+	}
+
+	return []any{
+		e.FullPath, e.SizeBytes, e.AllocatedBytes, e.FileMode, isDirectory, e.Inode, e.ModifiedAt,
+		e.Uid, e.Gid, e.OwnerName, e.GroupName, e.Device, e.Nlink, e.AccessedAt, e.ChangedAt, e.FileType, symlinkTarget,
+		now,
+	}
+}
+
+// unchangedContent is true in an upsert when the file's contents can't have changed, going by
+// its size, mtime and inode.
+const unchangedContent = `
+	size_bytes = excluded.size_bytes AND modified_at = excluded.modified_at AND inode = excluded.inode
+`
+
+// descendantRange returns the half-open range of paths [lo, hi) that sit underneath `path`.
+// '0' is the byte right after '/', so this picks up "path/..." without matching "path2".
+func descendantRange(path string) (string, string) {
+	return path + "/", path + "0"
+}
+
+// metadataIndex maintains the `metadata_current` table. Every write goes through here so the
+// current state and the `metadata` snapshot rows stay in step.
+type metadataIndex struct {
+	db *sql.DB
+
+	// lock serializes writers so that event handling and reconciliation don't fight over the
+	// sqlite write lock.
+	lock sync.Mutex
+}
+
+func newMetadataIndex(db *sql.DB) *metadataIndex {
+	return &metadataIndex{db: db}
+}
+
+// get returns the indexed entry for `path`, if there is one.
+func (ix *metadataIndex) get(ctx context.Context, q dbExecutor, path string) (metadataEntry, bool, error) {
+	entry, err := scanMetadataEntry(q.QueryRowContext(ctx, `
+		SELECT `+metadataEntrySelect+` FROM metadata_current WHERE full_path = ?
+	`, path))
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, err
+	}
+
+	return entry, true, nil
+}
+
+// put writes `entry` to the current-state table, appends a snapshot row, and records what
+// changed relative to `prev` (nil if the path is new) in the history table.
+func (ix *metadataIndex) put(ctx context.Context, q dbExecutor, prev *metadataEntry, entry metadataEntry) error {
+	now := time.Now()
+	values := entry.values(now)
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO metadata_current (`+metadataEntryInsert+`)
+		VALUES (`+placeholders(len(values))+`)
+		ON CONFLICT(full_path) DO UPDATE SET
+			size_bytes = excluded.size_bytes,
+			allocated_bytes = excluded.allocated_bytes,
+			file_mode = excluded.file_mode,
+			is_directory = excluded.is_directory,
+			inode = excluded.inode,
+			modified_at = excluded.modified_at,
+			uid = excluded.uid,
+			gid = excluded.gid,
+			owner_name = excluded.owner_name,
+			group_name = excluded.group_name,
+			device = excluded.device,
+			nlink = excluded.nlink,
+			accessed_at = excluded.accessed_at,
+			changed_at = excluded.changed_at,
+			file_type = excluded.file_type,
+			symlink_target = excluded.symlink_target,
+			sha256 = CASE WHEN `+unchangedContent+` THEN sha256 END,
+			xxhash = CASE WHEN `+unchangedContent+` THEN xxhash END,
+			hashed_at = CASE WHEN `+unchangedContent+` THEN hashed_at END
+	`, values...)
+	if err != nil {
+		return err
+	}
+
+	if err := ix.updateTree(ctx, q, prev, entry); err != nil {
+		return err
+	}
+
+	// The snapshot is a copy of the current row, so it carries any hash that's still good. It's
+	// taken now, whenever the path first turned up, so compaction goes by when it was taken.
+	_, err = q.ExecContext(ctx, `
+		INSERT INTO metadata (`+metadataEntryInsert+`, sha256, xxhash, hashed_at)
+		SELECT `+metadataEntryColumns+`, ?, sha256, xxhash, hashed_at FROM metadata_current WHERE full_path = ?
+	`, now, entry.FullPath)
+	if err != nil {
+		return err
+	}
+
+	return ix.recordChanges(ctx, q, prev, entry, now)
+}
+
+// recordChanges appends a history row for each transition between `prev` and `entry`. Changes
+// that only touch the mtime are not interesting enough to keep.
+func (ix *metadataIndex) recordChanges(ctx context.Context, q dbExecutor, prev *metadataEntry, entry metadataEntry, now time.Time) error {
+	isDirectory := 0
+	if entry.IsDirectory {
+		isDirectory = 1
+	}
+
+	insert := `
+		INSERT INTO metadata_history (
+			full_path, change, is_directory,
+			old_size_bytes, new_size_bytes, old_file_mode, new_file_mode, old_modified_at, new_modified_at,
+			created_at
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	if prev == nil {
+		_, err := q.ExecContext(ctx, insert,
+			entry.FullPath, changeCreated, isDirectory,
+			nil, entry.SizeBytes, nil, entry.FileMode, nil, entry.ModifiedAt,
+			now)
+		return err
+	}
+
+	var changes []string
+	if prev.SizeBytes != entry.SizeBytes {
+		changes = append(changes, changeSizeChanged)
+	}
+	if prev.FileMode != entry.FileMode {
+		changes = append(changes, changeModeChanged)
+	}
+
+	for _, change := range changes {
+		_, err := q.ExecContext(ctx, insert,
+			entry.FullPath, change, isDirectory,
+			prev.SizeBytes, entry.SizeBytes, prev.FileMode, entry.FileMode, prev.ModifiedAt, entry.ModifiedAt,
+			now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// delete drops `path` and everything beneath it from the index, recording `change` (either
+// removed or renamed) in the history for each of them.
+func (ix *metadataIndex) delete(ctx context.Context, q dbExecutor, path string, change string) error {
+	lo, hi := descendantRange(path)
+
+	parents, newest, err := ix.removeFromTree(ctx, q, path)
+	if err != nil {
+		return err
+	}
+
+	// A rename we couldn't follow keeps the old path so the timeline shows where it went missing
+	_, err = q.ExecContext(ctx, `
+		INSERT INTO metadata_history (
+			full_path, change, old_path, is_directory, old_size_bytes, old_file_mode, old_modified_at, created_at
+		)
+		SELECT full_path, ?, CASE WHEN ? = ? THEN full_path END, is_directory, size_bytes, file_mode, modified_at, ?
+		FROM metadata_current
+		WHERE full_path = ? OR (full_path >= ? AND full_path < ?)
+	`, change, change, changeRenamed, time.Now(), path, lo, hi)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"metadata_current", "metadata"} {
+		_, err := q.ExecContext(ctx, `
+			DELETE FROM `+table+` WHERE full_path = ? OR (full_path >= ? AND full_path < ?)
+		`, path, lo, hi)
+		if err != nil {
+			return err
+		}
+	}
+
+	return recomputeNewest(ctx, q, parents, newest)
+}
+
+// Sync stats `path` and updates the index if anything changed. Paths that no longer exist are
+// removed from the index.
+func (ix *metadataIndex) Sync(ctx context.Context, path string) error {
+	return ix.sync(ctx, path, true)
+}
+
+// sync is Sync, optionally re-syncing the other hard links to the same file when the link count
+// changes. The kernel only tells the inode's own watchers about that, and we watch directories.
+func (ix *metadataIndex) sync(ctx context.Context, path string, followLinks bool) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ix.Remove(ctx, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	entry := newMetadataEntry(path, info)
+	prev, written, err := ix.write(ctx, entry)
+	if err != nil || !written || !followLinks || entry.IsDirectory {
+		return err
+	}
+
+	if (prev == nil && entry.Nlink > 1) || (prev != nil && prev.Nlink != entry.Nlink) {
+		return ix.syncLinks(ctx, entry)
+	}
+
+	return nil
+}
+
+// write puts `entry` in the index if it differs from what's there, returning the previous entry
+// (nil if there wasn't one) and whether anything was written.
+func (ix *metadataIndex) write(ctx context.Context, entry metadataEntry) (*metadataEntry, bool, error) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	prev, ok, err := ix.get(ctx, ix.db, entry.FullPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if ok && !prev.changed(entry) {
+		return &prev, false, nil
+	}
+
+	var prevp *metadataEntry
+	if ok {
+		prevp = &prev
+	}
+
+	tx, err := ix.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := ix.put(ctx, tx, prevp, entry); err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+
+	return prevp, true, tx.Commit()
+}
+
+// syncLinks re-syncs every other indexed path that is a hard link to the same file as `entry`.
+func (ix *metadataIndex) syncLinks(ctx context.Context, entry metadataEntry) error {
+	rows, err := ix.db.QueryContext(ctx, `
+		SELECT full_path FROM metadata_current
+		WHERE inode = ? AND device = ? AND full_path != ? AND is_directory = 0
+	`, entry.Inode, entry.Device, entry.FullPath)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := ix.sync(ctx, path, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SyncTree syncs `root` and everything beneath it. This is used when a directory shows up
+// with contents we never received events for, e.g. it was moved in from outside the root.
+func (ix *metadataIndex) SyncTree(ctx context.Context, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Things disappearing mid-walk are expected, the Remove event will clean up.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		return ix.Sync(ctx, path)
+	})
+}
+
+// Remove drops `path` and everything beneath it from the index.
+func (ix *metadataIndex) Remove(ctx context.Context, path string) error {
+	return ix.remove(ctx, path, changeRemoved)
+}
+
+// RenameAway drops `path` and everything beneath it from the index after it was renamed to
+// somewhere we can't see.
+func (ix *metadataIndex) RenameAway(ctx context.Context, path string) error {
+	return ix.remove(ctx, path, changeRenamed)
+}
+
+// Move re-keys `from` and everything beneath it to `to`, recording a rename for each path.
+// Whatever was previously indexed at `to` was replaced by the move. Nothing happens if `from`
+// isn't indexed, which is the case when a replayed move was already picked up by
+// reconciliation.
+func (ix *metadataIndex) Move(ctx context.Context, from, to string) error {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	if _, ok, err := ix.get(ctx, ix.db, from); err != nil || !ok {
+		return err
+	}
+
+	tx, err := ix.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := ix.delete(ctx, tx, to, changeRemoved); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// sqlite's substr() counts characters, not bytes
+	lo, hi := descendantRange(from)
+	suffix := utf8.RuneCountInString(from) + 1
+
+	// The totals leave every directory above `from` and land on every directory above `to`
+	moved, newest, err := subtreeTotals(ctx, tx, from)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := adjustTree(ctx, tx, ancestors(from), moved.negate(), nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO metadata_history (
+			full_path, change, old_path, is_directory,
+			old_size_bytes, new_size_bytes, old_file_mode, new_file_mode, old_modified_at, new_modified_at,
+			created_at
+		)
+		SELECT
+			? || substr(full_path, ?), ?, full_path, is_directory,
+			size_bytes, size_bytes, file_mode, file_mode, modified_at, modified_at,
+			?
+		FROM metadata_current
+		WHERE full_path = ? OR (full_path >= ? AND full_path < ?)
+	`, to, suffix, changeRenamed, time.Now(), from, lo, hi)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE metadata_current SET full_path = ? || substr(full_path, ?)
+		WHERE full_path = ? OR (full_path >= ? AND full_path < ?)
+	`, to, suffix, from, lo, hi)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := moveTree(ctx, tx, from, to); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := adjustTree(ctx, tx, ancestors(to), moved, newest); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := recomputeNewest(ctx, tx, ancestors(from), newest); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ix *metadataIndex) remove(ctx context.Context, path string, change string) error {
+	prev, err := ix.deleteTree(ctx, path, change)
+	if err != nil {
+		return err
+	}
+
+	// Any other links to a removed file just lost one
+	if prev != nil && !prev.IsDirectory && prev.Nlink > 1 {
+		return ix.syncLinks(ctx, *prev)
+	}
+
+	return nil
+}
+
+// deleteTree runs delete in its own transaction, returning the entry that was at `path`.
+func (ix *metadataIndex) deleteTree(ctx context.Context, path string, change string) (*metadataEntry, error) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	prev, ok, err := ix.get(ctx, ix.db, path)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := ix.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ix.delete(ctx, tx, path, change); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil || !ok {
+		return nil, err
+	}
+
+	return &prev, nil
+}
+
+// Reconcile walks `root` and brings the index in line with what is actually on disk. Events
+// should keep the index current on their own, this is the safety net for anything we missed
+// (e.g. changes made while the daemon was down, or inotify queue overflows). Only entries at or
+// below `root` are considered, so it can also be used to rescan a single subtree.
+func (ix *metadataIndex) Reconcile(ctx context.Context, root string) (int, int, error) {
+	known := make(map[string]metadataEntry)
+	lo, hi := descendantRange(root)
+	rows, err := ix.db.QueryContext(ctx, `
+		SELECT `+metadataEntrySelect+` FROM metadata_current
+		WHERE full_path = ? OR (full_path >= ? AND full_path < ?)
+	`, root, lo, hi)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for rows.Next() {
+		entry, err := scanMetadataEntry(rows)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		known[entry.FullPath] = entry
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	// Walk first without holding any locks, we only need to write what differs. Events keep
+	// coming in meanwhile, so `known` may be out of date by the time anything is written.
+	var dirty []metadataEntry
+	err = filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			if path == root {
+				return err
+			}
+
+			zap.L().Warn("skipping unreadable path during reconciliation", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+
+		entry := newMetadataEntry(path, info)
+		prev, ok := known[path]
+		delete(known, path)
+		if !ok || prev.changed(entry) {
+			dirty = append(dirty, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(dirty) == 0 && len(known) == 0 {
+		return 0, 0, nil
+	}
+
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	tx, err := ix.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Each entry is compared against what's indexed now rather than what was indexed before
+	// the walk, so anything an event already took care of isn't applied a second time.
+	changed := 0
+	for _, entry := range dirty {
+		prev, ok, err := ix.get(ctx, tx, entry.FullPath)
+		if err != nil {
+			tx.Rollback()
+			return 0, 0, err
+		}
+		if ok && !prev.changed(entry) {
+			continue
+		}
+
+		var prevp *metadataEntry
+		if ok {
+			prevp = &prev
+		}
+		if err := ix.put(ctx, tx, prevp, entry); err != nil {
+			tx.Rollback()
+			return 0, 0, err
+		}
+		changed++
+	}
+
+	// Anything we didn't see on disk is gone, unless it turned up again after the walk
+	removed := 0
+	for path := range known {
+		if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err := ix.delete(ctx, tx, path, changeRemoved); err != nil {
+			tx.Rollback()
+			return 0, 0, err
+		}
+		removed++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	return changed, removed, nil
+}
@@ -4,11 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"fsd/internal/config"
 	"fsd/pkg/ipc"
 	"io/fs"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -25,10 +26,29 @@ const METADATA_CREATE string = `
 		file_mode INTEGER NOT NULL,
 		is_directory INTEGER NOT NULL,
 		created_at DATETIME NOT NULL,
-		modified_at DATETIME NOT NULL
+		modified_at DATETIME NOT NULL,
+		inode INTEGER NOT NULL DEFAULT 0,
+		allocated_bytes INTEGER NOT NULL DEFAULT 0,
+		uid INTEGER NOT NULL DEFAULT 0,
+		gid INTEGER NOT NULL DEFAULT 0,
+		owner_name TEXT NOT NULL DEFAULT '',
+		group_name TEXT NOT NULL DEFAULT '',
+		device INTEGER NOT NULL DEFAULT 0,
+		nlink INTEGER NOT NULL DEFAULT 0,
+		accessed_at DATETIME,
+		changed_at DATETIME,
+		file_type TEXT NOT NULL DEFAULT '',
+		symlink_target TEXT,
+		sha256 TEXT,
+		xxhash TEXT,
+		hashed_at DATETIME
 	)
 `
 
+func init() {
+	ipc.RegisterMessage(MetadataMessage{})
+}
+
 type MetadataMessage struct {
 	Name      string    `json:"event_name"`
 	Operation ipc.FsdOp `json:"event_operation"`
@@ -66,6 +86,9 @@ type MetadataTaskState struct {
 
 	// db is the sqlite database handle
 	db *sql.DB
+
+	// index maintains the current-state metadata table
+	index *metadataIndex
 }
 
 func NewMetadataTaskState(rootPath string, broadcaster *ipc.Broadcaster, broadcastChannel chan ipc.Message, watcher *fsnotify.Watcher) *MetadataTaskState {
@@ -79,12 +102,53 @@ func NewMetadataTaskState(rootPath string, broadcaster *ipc.Broadcaster, broadca
 		zap.L().Fatal("failed to create metadata table", zap.Error(err))
 	}
 
+	_, err = db.Exec(METADATA_CURRENT_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create metadata_current table", zap.Error(err))
+	}
+
+	migrations := map[string][]columnDef{
+		"metadata":         append(append([]columnDef{{"inode", "INTEGER NOT NULL DEFAULT 0"}}, metadataStatColumns...), metadataHashColumns...),
+		"metadata_current": append(append([]columnDef{}, metadataStatColumns...), metadataHashColumns...),
+	}
+	for table, columns := range migrations {
+		added, err := ensureColumns(db, table, columns...)
+		if err != nil {
+			zap.L().Fatal("failed to migrate metadata table", zap.String("table name", table), zap.Error(err))
+		}
+		if len(added) > 0 {
+			// Existing rows get filled in by the startup reconciliation
+			zap.L().Info("added columns", zap.String("table name", table), zap.Strings("columns", added))
+		}
+	}
+
+	_, err = db.Exec(METADATA_HASH_INDEX_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create metadata hash indexes", zap.Error(err))
+	}
+
+	_, err = db.Exec(METADATA_HISTORY_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create metadata_history table", zap.Error(err))
+	}
+
+	_, err = db.Exec(METADATA_TREE_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create metadata_tree table", zap.Error(err))
+	}
+
+	index := newMetadataIndex(db)
+	if err := index.ensureTree(context.Background()); err != nil {
+		zap.L().Fatal("failed to build metadata_tree table", zap.Error(err))
+	}
+
 	return &MetadataTaskState{
 		rootPath:         rootPath,
 		broadcaster:      broadcaster,
 		broadcastChannel: broadcastChannel,
 		watcher:          watcher,
 		db:               db,
+		index:            index,
 	}
 }
 
@@ -117,14 +181,17 @@ func NewMetadataTask(state *MetadataTaskState) *MetadataTask {
 	}
 }
 
-func (mt *MetadataTask) startMetadataUpdateTask(ctx context.Context) {
+// startReconcileTask reconciles the index against the filesystem at startup, and then again
+// every `metadata_reconcile_interval` as a safety net for missed events.
+func (mt *MetadataTask) startReconcileTask(ctx context.Context) {
 	for {
+		mt.reconcile(ctx, mt.state.rootPath)
+
 		select {
 		case <-ctx.Done():
-			zap.L().Info("got shutdown signal, exiting", zap.String("task name", fmt.Sprintf("%s-%s", MetadataTaskName(), "UpdateTask")))
+			zap.L().Info("got shutdown signal, exiting", zap.String("task name", fmt.Sprintf("%s-%s", MetadataTaskName(), "ReconcileTask")))
 			return
-		case <-time.After(config.GetConfig().MetadataUpdateInterval):
-			go mt.recursivelyUpdateMetadata(ctx)
+		case <-time.After(config.GetConfig().MetadataReconcileInterval):
 		}
 	}
 }
@@ -148,85 +215,48 @@ func (mt *MetadataTask) doCompaction(ctx context.Context) error {
 	}
 
 	zap.L().Info("deleted old records", zap.String("table name", "metadata"), zap.Int64("rows deleted", rowsDeleted))
-	return nil
-}
 
-// recursivelyUpdateMetadata runs as a goroutine and starts from `mt.rootPath` and walks through all
-// files, inserting their characteristics into the sqlite database.
-func (mt *MetadataTask) recursivelyUpdateMetadata(ctx context.Context) {
-	select {
-	case <-ctx.Done():
-		zap.L().Info("got shutdown signal, exiting", zap.String("task name", fmt.Sprintf("%s-%s-%s", MetadataTaskName(), "UpdateTask", "UpdateMetadataOperation")))
-		return
-	case <-time.After(config.GetConfig().MetadataUpdateInterval):
-		zap.L().Error("metadata update overlap!")
-	case <-time.After(2 * config.GetConfig().MetadataUpdateInterval):
-		zap.L().Error("still delayed updating, killing task")
-		return
-	default:
-		tx, err := mt.state.db.BeginTx(ctx, nil)
-		if err != nil {
-			zap.L().Error("failed to begin transaction", zap.String("task name", MetadataTaskName()), zap.Error(err))
-			return
-		}
-
-		stmt, err := tx.Prepare(`
-			INSERT INTO metadata (full_path, size_bytes, file_mode, is_directory, created_at, modified_at)
-			VALUES (?, ?, ?, ?, ?, ?)
-		`)
-		if err != nil {
-			tx.Rollback()
-			zap.L().Error("failed to prepare insert statement", zap.String("task name", MetadataTaskName()), zap.Error(err))
-		}
-		defer stmt.Close()
-
-		// Otherwise, begin updating from the walk
-		err = filepath.Walk(mt.state.rootPath, func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			// Golang is silly...
-			isDirectory := 0
-			if info.IsDir() {
-				isDirectory = 1
-			}
-
-			_, err = stmt.Exec(
-				path,
-				info.Size(),
-				info.Mode().Perm(),
-				isDirectory,
-				time.Now(),
-				info.ModTime(),
-			)
-
-			if err != nil {
-				return err
-			}
-
-			return nil
-		})
+	// The history is kept far longer than the snapshots, and forever if there's no retention
+	retention := config.GetConfig().HistoryRetention
+	if retention <= 0 {
+		return nil
+	}
 
-		if err != nil {
-			zap.L().Error("metadata update task failed", zap.Error(err))
-		}
+	result, err = mt.state.db.ExecContext(ctx, `
+		DELETE FROM metadata_history WHERE created_at < ?
+	`, time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
 
-		// Commit the transaction
-		if err := tx.Commit(); err != nil {
-			zap.L().Error("failed to commit transaction", zap.Error(err))
-			return
-		}
+	rowsDeleted, err = result.RowsAffected()
+	if err != nil {
+		return err
+	}
 
-		// zap.L().Debug("metadata update successful")
+	zap.L().Info("deleted old records", zap.String("table name", "metadata_history"), zap.Int64("rows deleted", rowsDeleted))
+	return nil
+}
 
+// reconcile walks `root` and updates the index with anything that drifted.
+func (mt *MetadataTask) reconcile(ctx context.Context, root string) {
+	start := time.Now()
+	changed, removed, err := mt.state.index.Reconcile(ctx, root)
+	if err != nil {
+		zap.L().Error("metadata reconciliation failed", zap.String("task name", MetadataTaskName()), zap.String("root", root), zap.Error(err))
 		return
 	}
+
+	zap.L().Info("metadata reconciliation complete",
+		zap.String("root", root),
+		zap.Int("changed", changed),
+		zap.Int("removed", removed),
+		zap.Duration("took", time.Since(start)))
 }
 
 func (mt *MetadataTask) StartEventLoop(ctx context.Context) {
 	// Start background tasks
-	go mt.startMetadataUpdateTask(ctx)
+	go mt.startReconcileTask(ctx)
 
 	for {
 		select {
@@ -234,6 +264,7 @@ func (mt *MetadataTask) StartEventLoop(ctx context.Context) {
 			if err := mt.HandleMessage(ctx, event); err != nil {
 				zap.L().Error("error handling message", zap.String("task name", MetadataTaskName()), zap.Error(err))
 			}
+			mt.state.broadcaster.Ack(MetadataTaskName(), event)
 		case <-ctx.Done():
 			zap.L().Info("got shutdown signal, exiting", zap.String("task name", MetadataTaskName()))
 			return
@@ -241,7 +272,9 @@ func (mt *MetadataTask) StartEventLoop(ctx context.Context) {
 	}
 }
 
-// HandleMessage handles a network message
+// HandleMessage handles a network message. Events replayed after a restart may already have
+// been picked up by the startup reconciliation, so every change is checked against the index
+// and only written if it actually differs.
 func (mt *MetadataTask) HandleMessage(ctx context.Context, msg ipc.Message) error {
 	ms, err := msg.String()
 	if err != nil {
@@ -253,12 +286,25 @@ func (mt *MetadataTask) HandleMessage(ctx context.Context, msg ipc.Message) erro
 	switch msg.EventOperation() {
 	case ipc.Create:
 		return mt.CreateMetadataEntry(ctx, msg.EventName())
+	case ipc.Write, ipc.Chmod, ipc.Settled:
+		return mt.UpdateMetadataEntry(ctx, msg.EventName())
 	case ipc.Remove:
+		UnwatchRecursive(mt.state.watcher, msg.EventName())
 		return mt.RemoveMetadataEntry(ctx, msg.EventName())
 	case ipc.Rename:
-	case ipc.Write:
+		// The old path is gone, the new one (if it's still under the root) shows up as a Create.
+		UnwatchRecursive(mt.state.watcher, msg.EventName())
+		return mt.state.index.RenameAway(ctx, msg.EventName())
+	case ipc.Move:
+		fsMsg, ok := ipc.Unwrap(msg).(FsMessage)
+		if !ok {
+			return fmt.Errorf("unexpected message type for move: %T", msg)
+		}
+		return mt.MoveMetadataEntry(ctx, fsMsg.From, fsMsg.To)
 	case ipc.Compact:
 		return mt.doCompaction(ctx)
+	case ipc.Rescan:
+		return mt.RescanMetadata(ctx, msg.EventName())
 	}
 
 	return nil
@@ -277,41 +323,68 @@ func (mt *MetadataTask) SendMessage(msg ipc.Message) error {
 
 func (mt *MetadataTask) CreateMetadataEntry(ctx context.Context, name string) error {
 	zap.L().Debug("Creating metadata entry", zap.String("name", name))
-	// Walk the directory, adding watches for all subdirectories
-	err := filepath.Walk(name, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
+	// Walk the directory, adding watches for all subdirectories. If it's already gone again
+	// the Remove or Rename event will tidy up.
+	if _, err := WatchRecursive(mt.state.watcher, name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
 		}
+		return err
+	}
 
-		if info.IsDir() {
-			zap.L().Debug("adding subdirectory", zap.String("path", path))
-			err = mt.state.watcher.Add(path)
-			if err != nil {
-				return err
-			}
-		}
+	// Anything created inside the new directory before the watch landed never produced an
+	// event, so index the whole subtree.
+	return mt.state.index.SyncTree(ctx, name)
+}
 
-		return nil
-	})
+func (mt *MetadataTask) UpdateMetadataEntry(ctx context.Context, name string) error {
+	zap.L().Debug("Updating metadata entry", zap.String("name", name))
+	return mt.state.index.Sync(ctx, name)
+}
 
-	if err != nil {
+func (mt *MetadataTask) MoveMetadataEntry(ctx context.Context, from, to string) error {
+	zap.L().Debug("Moving metadata entry", zap.String("from", from), zap.String("to", to))
+
+	// inotify watches follow the inode, so the old paths are stale now
+	UnwatchRecursive(mt.state.watcher, from)
+	if _, err := WatchRecursive(mt.state.watcher, to); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 
-	return nil
+	if err := mt.state.index.Move(ctx, from, to); err != nil {
+		return err
+	}
+
+	// A rename touches the ctime but nothing we track, this just catches anything written
+	// between the move and now.
+	return mt.state.index.Sync(ctx, to)
 }
 
-func (mt *MetadataTask) RemoveMetadataEntry(ctx context.Context, name string) error {
-	zap.L().Debug("Removing metadata entry", zap.String("name", name))
+// RescanMetadata re-reads `name` and everything beneath it, defaulting to the whole root. Any
+// directories we weren't watching yet get picked up along the way.
+func (mt *MetadataTask) RescanMetadata(ctx context.Context, name string) error {
+	if name == "" {
+		name = mt.state.rootPath
+	}
 
-	query := `
-		DELETE FROM metadata WHERE full_path = ?
-	`
+	if name != mt.state.rootPath && !strings.HasPrefix(name, mt.state.rootPath+"/") {
+		return fmt.Errorf("rescan path %s is outside of %s", name, mt.state.rootPath)
+	}
 
-	_, err := mt.state.db.ExecContext(ctx, query, name)
-	if err != nil {
+	zap.L().Debug("Rescanning metadata", zap.String("name", name))
+	if _, err := WatchRecursive(mt.state.watcher, name); err != nil {
+		// Whatever we had indexed there is stale
+		if errors.Is(err, fs.ErrNotExist) {
+			return mt.RemoveMetadataEntry(ctx, name)
+		}
 		return err
 	}
 
+	mt.reconcile(ctx, name)
 	return nil
 }
+
+func (mt *MetadataTask) RemoveMetadataEntry(ctx context.Context, name string) error {
+	zap.L().Debug("Removing metadata entry", zap.String("name", name))
+	return mt.state.index.Remove(ctx, name)
+}
@@ -0,0 +1,316 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// METADATA_TREE_CREATE creates the per-directory totals. Each row covers the directory itself
+// and everything beneath it, the same way `du` counts, and is kept up to date by the index as
+// entries come and go rather than by walking the tree.
+const METADATA_TREE_CREATE string = `
+	CREATE TABLE IF NOT EXISTS metadata_tree (
+		full_path TEXT NOT NULL PRIMARY KEY,
+		parent_path TEXT NOT NULL,
+		apparent_bytes INTEGER NOT NULL,
+		allocated_bytes INTEGER NOT NULL,
+		file_count INTEGER NOT NULL,
+		dir_count INTEGER NOT NULL,
+		newest_modified_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS metadata_tree_parent_path ON metadata_tree (parent_path);
+`
+
+// treeDelta is the change to a directory's totals.
+type treeDelta struct {
+	apparent  int64
+	allocated int64
+	files     int64
+	dirs      int64
+}
+
+// contribution is what `entry` adds to the totals of every directory above it.
+func contribution(entry *metadataEntry) treeDelta {
+	if entry == nil {
+		return treeDelta{}
+	}
+
+	d := treeDelta{apparent: entry.SizeBytes, allocated: entry.AllocatedBytes}
+	if entry.IsDirectory {
+		d.dirs = 1
+	} else {
+		d.files = 1
+	}
+
+	return d
+}
+
+func (d treeDelta) sub(other treeDelta) treeDelta {
+	return treeDelta{
+		apparent:  d.apparent - other.apparent,
+		allocated: d.allocated - other.allocated,
+		files:     d.files - other.files,
+		dirs:      d.dirs - other.dirs,
+	}
+}
+
+func (d treeDelta) negate() treeDelta {
+	return treeDelta{}.sub(d)
+}
+
+func (d treeDelta) zero() bool {
+	return d == treeDelta{}
+}
+
+// ancestors returns every directory above `path`, nearest first.
+func ancestors(path string) []string {
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == filepath.Dir(dir) {
+			return dirs
+		}
+	}
+}
+
+// placeholders returns "?, ?, ..." for an IN clause of `n` values.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// adjustTree applies `delta` to the totals of `paths`, and raises their newest mtime to
+// `newest` if given. Paths that aren't indexed directories (e.g. anything above the root) are
+// skipped by virtue of having no row.
+func adjustTree(ctx context.Context, q dbExecutor, paths []string, delta treeDelta, newest interface{}) error {
+	if len(paths) == 0 || (delta.zero() && newest == nil) {
+		return nil
+	}
+
+	args := []interface{}{delta.apparent, delta.allocated, delta.files, delta.dirs, newest}
+	for _, path := range paths {
+		args = append(args, path)
+	}
+
+	// max() with a NULL is NULL, hence the coalesce
+	_, err := q.ExecContext(ctx, `
+		UPDATE metadata_tree SET
+			apparent_bytes = apparent_bytes + ?,
+			allocated_bytes = allocated_bytes + ?,
+			file_count = file_count + ?,
+			dir_count = dir_count + ?,
+			newest_modified_at = coalesce(max(newest_modified_at, ?), newest_modified_at)
+		WHERE full_path IN (`+placeholders(len(paths))+`)
+	`, args...)
+	return err
+}
+
+// recomputeNewest recalculates the newest mtime of those `paths` whose newest mtime was
+// `stale`, after the entry holding it went away or got older.
+func recomputeNewest(ctx context.Context, q dbExecutor, paths []string, stale interface{}) error {
+	if len(paths) == 0 || stale == nil {
+		return nil
+	}
+
+	args := []interface{}{stale}
+	for _, path := range paths {
+		args = append(args, path)
+	}
+
+	_, err := q.ExecContext(ctx, `
+		UPDATE metadata_tree SET newest_modified_at = (
+			SELECT max(c.modified_at) FROM metadata_current c
+			WHERE c.full_path = metadata_tree.full_path
+				OR (c.full_path >= metadata_tree.full_path || '/' AND c.full_path < metadata_tree.full_path || '0')
+		)
+		WHERE newest_modified_at = ? AND full_path IN (`+placeholders(len(paths))+`)
+	`, args...)
+	return err
+}
+
+// subtreeTotals adds up `path` and everything indexed beneath it. The newest mtime comes back
+// exactly as stored so it can be compared against other stored values, or nil if there's
+// nothing there.
+func subtreeTotals(ctx context.Context, q dbExecutor, path string) (treeDelta, interface{}, error) {
+	lo, hi := descendantRange(path)
+
+	var totals treeDelta
+	var newest sql.NullString
+	err := q.QueryRowContext(ctx, `
+		SELECT
+			coalesce(sum(size_bytes), 0),
+			coalesce(sum(allocated_bytes), 0),
+			coalesce(sum(is_directory = 0), 0),
+			coalesce(sum(is_directory = 1), 0),
+			max(modified_at)
+		FROM metadata_current
+		WHERE full_path = ? OR (full_path >= ? AND full_path < ?)
+	`, path, lo, hi).Scan(&totals.apparent, &totals.allocated, &totals.files, &totals.dirs, &newest)
+	if err != nil || !newest.Valid {
+		return totals, nil, err
+	}
+
+	return totals, newest.String, nil
+}
+
+// insertTreeRow (re)computes the totals for directory `path` from whatever is indexed at and
+// beneath it.
+func insertTreeRow(ctx context.Context, q dbExecutor, path string) error {
+	lo, hi := descendantRange(path)
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO metadata_tree (
+			full_path, parent_path, apparent_bytes, allocated_bytes, file_count, dir_count, newest_modified_at
+		)
+		SELECT
+			?, ?,
+			coalesce(sum(size_bytes), 0),
+			coalesce(sum(allocated_bytes), 0),
+			coalesce(sum(is_directory = 0), 0),
+			coalesce(sum(is_directory = 1 AND full_path != ?), 0),
+			max(modified_at)
+		FROM metadata_current
+		WHERE full_path = ? OR (full_path >= ? AND full_path < ?)
+		ON CONFLICT(full_path) DO UPDATE SET
+			parent_path = excluded.parent_path,
+			apparent_bytes = excluded.apparent_bytes,
+			allocated_bytes = excluded.allocated_bytes,
+			file_count = excluded.file_count,
+			dir_count = excluded.dir_count,
+			newest_modified_at = excluded.newest_modified_at
+	`, path, filepath.Dir(path), path, path, lo, hi)
+	return err
+}
+
+// moveTree re-keys the rows for `from` and the directories beneath it to `to`.
+func moveTree(ctx context.Context, q dbExecutor, from, to string) error {
+	lo, hi := descendantRange(from)
+	suffix := utf8.RuneCountInString(from) + 1
+
+	_, err := q.ExecContext(ctx, `
+		UPDATE metadata_tree SET
+			full_path = ? || substr(full_path, ?),
+			parent_path = CASE WHEN full_path = ? THEN ? ELSE ? || substr(parent_path, ?) END
+		WHERE full_path = ? OR (full_path >= ? AND full_path < ?)
+	`, to, suffix, from, filepath.Dir(to), to, suffix, from, lo, hi)
+	return err
+}
+
+// updateTree carries the change from `prev` (nil if new) to `entry` into the directory totals.
+// It runs after metadata_current has been written.
+func (ix *metadataIndex) updateTree(ctx context.Context, q dbExecutor, prev *metadataEntry, entry metadataEntry) error {
+	delta := contribution(&entry).sub(contribution(prev))
+	parents := ancestors(entry.FullPath)
+	if err := adjustTree(ctx, q, parents, delta, entry.ModifiedAt); err != nil {
+		return err
+	}
+
+	switch {
+	case entry.IsDirectory && (prev == nil || !prev.IsDirectory):
+		// Anything indexed underneath before the directory itself is already counted above it,
+		// but the directory needs to start out with it too.
+		if err := insertTreeRow(ctx, q, entry.FullPath); err != nil {
+			return err
+		}
+	case entry.IsDirectory:
+		self := treeDelta{apparent: delta.apparent, allocated: delta.allocated}
+		if err := adjustTree(ctx, q, []string{entry.FullPath}, self, entry.ModifiedAt); err != nil {
+			return err
+		}
+		parents = append(parents, entry.FullPath)
+	case prev != nil && prev.IsDirectory:
+		if _, err := q.ExecContext(ctx, `DELETE FROM metadata_tree WHERE full_path = ?`, entry.FullPath); err != nil {
+			return err
+		}
+	}
+
+	// An mtime can go backwards (e.g. `touch -d`), which may leave a newer one behind
+	if prev != nil && entry.ModifiedAt.Before(prev.ModifiedAt) {
+		return recomputeNewest(ctx, q, parents, prev.ModifiedAt)
+	}
+
+	return nil
+}
+
+// removeFromTree takes `path` and everything beneath it out of the directory totals. It runs
+// before the entries are deleted from metadata_current, so it returns the directories whose
+// newest mtime needs recomputing afterwards along with the value that went stale.
+func (ix *metadataIndex) removeFromTree(ctx context.Context, q dbExecutor, path string) ([]string, interface{}, error) {
+	totals, newest, err := subtreeTotals(ctx, q, path)
+	if err != nil || newest == nil {
+		return nil, nil, err
+	}
+
+	parents := ancestors(path)
+	if err := adjustTree(ctx, q, parents, totals.negate(), nil); err != nil {
+		return nil, nil, err
+	}
+
+	lo, hi := descendantRange(path)
+	_, err = q.ExecContext(ctx, `
+		DELETE FROM metadata_tree WHERE full_path = ? OR (full_path >= ? AND full_path < ?)
+	`, path, lo, hi)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parents, newest, nil
+}
+
+// ensureTree builds metadata_tree from scratch if it's empty, which is the case the first time
+// we start up with an index from before it existed.
+func (ix *metadataIndex) ensureTree(ctx context.Context) error {
+	var built bool
+	err := ix.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM metadata_tree)`).Scan(&built)
+	if err != nil || built {
+		return err
+	}
+
+	rows, err := ix.db.QueryContext(ctx, `SELECT full_path FROM metadata_current WHERE is_directory = 1`)
+	if err != nil {
+		return err
+	}
+
+	var dirs []string
+	for rows.Next() {
+		var dir string
+		if err := rows.Scan(&dir); err != nil {
+			rows.Close()
+			return err
+		}
+		dirs = append(dirs, dir)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	tx, err := ix.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := insertTreeRow(ctx, tx, dir); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	zap.L().Info("built directory totals", zap.String("table name", "metadata_tree"), zap.Int("directories", len(dirs)))
+	return nil
+}
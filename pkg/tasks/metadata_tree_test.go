@@ -0,0 +1,222 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestIndex returns an index backed by a fresh database, set up the way
+// NewMetadataTaskState does it.
+func newTestIndex(t *testing.T) *metadataIndex {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "fsd.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, create := range []string{METADATA_CREATE, METADATA_CURRENT_CREATE, METADATA_HISTORY_CREATE, METADATA_TREE_CREATE} {
+		if _, err := db.Exec(create); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	columns := append(append([]columnDef{}, metadataStatColumns...), metadataHashColumns...)
+	if _, err := ensureColumns(db, "metadata", append([]columnDef{{"inode", "INTEGER NOT NULL DEFAULT 0"}}, columns...)...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ensureColumns(db, "metadata_current", columns...); err != nil {
+		t.Fatal(err)
+	}
+
+	return newMetadataIndex(db)
+}
+
+// checkTree fails unless every directory's totals add up to what's indexed beneath it.
+func checkTree(t *testing.T, ix *metadataIndex) {
+	t.Helper()
+	ctx := context.Background()
+
+	rows, err := ix.db.Query(`SELECT full_path, apparent_bytes, allocated_bytes, file_count, dir_count FROM metadata_tree`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path string
+		var got treeDelta
+		if err := rows.Scan(&path, &got.apparent, &got.allocated, &got.files, &got.dirs); err != nil {
+			t.Fatal(err)
+		}
+
+		want, _, err := subtreeTotals(ctx, ix.db, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A directory doesn't count itself
+		want.dirs--
+
+		if got != want {
+			t.Errorf("%s: got totals %+v, want %+v", path, got, want)
+		}
+	}
+}
+
+func historyCount(t *testing.T, ix *metadataIndex) int {
+	t.Helper()
+
+	var n int
+	if err := ix.db.QueryRow(`SELECT count(*) FROM metadata_history`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDescendantRange(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/data/a/b", want: true},
+		{path: "/data/a/b/c", want: true},
+		{path: "/data/a", want: false},
+		{path: "/data/a2", want: false},
+		{path: "/data/a.txt", want: false},
+		{path: "/data/a0", want: false},
+		{path: "/data/b", want: false},
+	}
+
+	lo, hi := descendantRange("/data/a")
+	for _, tt := range tests {
+		if got := tt.path >= lo && tt.path < hi; got != tt.want {
+			t.Errorf("%s: got descendant %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTreeDeltas(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	write := func(name string, size int) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write("a/one", 100)
+	write("a/b/two", 2000)
+
+	ix := newTestIndex(t)
+	steps := []struct {
+		name  string
+		apply func() error
+	}{
+		{"index", func() error { return ix.SyncTree(ctx, root) }},
+		{"grow", func() error {
+			write("a/b/two", 5000)
+			return ix.Sync(ctx, filepath.Join(root, "a", "b", "two"))
+		}},
+		{"move", func() error {
+			from, to := filepath.Join(root, "a", "b"), filepath.Join(root, "c")
+			if err := os.Rename(from, to); err != nil {
+				return err
+			}
+			return ix.Move(ctx, from, to)
+		}},
+		{"remove", func() error {
+			path := filepath.Join(root, "a", "one")
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			return ix.Remove(ctx, path)
+		}},
+		{"replace file with directory", func() error {
+			path := filepath.Join(root, "c", "two")
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			if err := os.Mkdir(path, 0755); err != nil {
+				return err
+			}
+			return ix.Sync(ctx, path)
+		}},
+	}
+
+	for _, step := range steps {
+		if err := step.apply(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		checkTree(t, ix)
+		if t.Failed() {
+			t.Fatalf("totals are off after %s", step.name)
+		}
+	}
+}
+
+func TestReconcileSkipsWhatEventsApplied(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	path := filepath.Join(root, "file")
+	if err := os.WriteFile(path, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ix := newTestIndex(t)
+	if err := ix.SyncTree(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("more contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reconciliation walks without the lock and then waits for it, which is when the event for
+	// the write gets in ahead of it
+	type result struct {
+		changed int
+		err     error
+	}
+	done := make(chan result)
+	ix.lock.Lock()
+	go func() {
+		changed, _, err := ix.Reconcile(ctx, root)
+		done <- result{changed, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	prev, _, err := ix.get(ctx, ix.db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.put(ctx, ix.db, &prev, newMetadataEntry(path, info)); err != nil {
+		t.Fatal(err)
+	}
+	history := historyCount(t, ix)
+	ix.lock.Unlock()
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.changed != 0 {
+		t.Errorf("got %d changed, want nothing", r.changed)
+	}
+	if got := historyCount(t, ix); got != history {
+		t.Errorf("got %d history rows, want %d", got, history)
+	}
+	checkTree(t, ix)
+}
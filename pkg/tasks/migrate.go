@@ -0,0 +1,53 @@
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// columnDef is a column that tables created by older versions may be missing.
+type columnDef struct {
+	name       string
+	definition string
+}
+
+// ensureColumns adds whichever of `columns` are missing from `table`, returning the names of
+// the ones it added. `CREATE TABLE IF NOT EXISTS` leaves existing tables alone, so new columns
+// have to go through here as well as the create statement.
+func ensureColumns(db *sql.DB, table string, columns ...columnDef) ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, kind string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var added []string
+	for _, column := range columns {
+		if existing[column.name] {
+			continue
+		}
+
+		_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column.name, column.definition))
+		if err != nil {
+			return added, fmt.Errorf("failed to add %s.%s: %w", table, column.name, err)
+		}
+		added = append(added, column.name)
+	}
+
+	return added, nil
+}
@@ -0,0 +1,52 @@
+package tasks
+
+import (
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// ownerNames resolves uids and gids to names. Lookups can go out to NSS (LDAP and the like), so
+// the results are cached for the life of the process, misses included.
+type ownerNames struct {
+	lock   sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+var owners = &ownerNames{
+	users:  make(map[uint32]string),
+	groups: make(map[uint32]string),
+}
+
+// userName returns the name for `uid`, or "" if it has none.
+func (o *ownerNames) userName(uid uint32) string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	name, ok := o.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+			name = u.Username
+		}
+		o.users[uid] = name
+	}
+
+	return name
+}
+
+// groupName returns the name for `gid`, or "" if it has none.
+func (o *ownerNames) groupName(gid uint32) string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	name, ok := o.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+			name = g.Name
+		}
+		o.groups[gid] = name
+	}
+
+	return name
+}
@@ -0,0 +1,139 @@
+package tasks
+
+import (
+	"bytes"
+	"fmt"
+	"fsd/internal/config"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// procSummaryBytes is how much of the end of each of a proc's outputs is kept in proc_results,
+// the rest is only in its log
+const procSummaryBytes = 64 << 10
+
+// procMaxLine is how long a line can get before it's written to the log unfinished, since
+// progress bars and the like can go a long time without one
+const procMaxLine = 64 << 10
+
+// ProcLogPath returns the path of the file that the proc with `id` writes its output to.
+func ProcLogPath(id int) string {
+	return filepath.Join(config.GetProcLogDir(), fmt.Sprintf("proc-%d.log", id))
+}
+
+// procLog is the file a proc's output goes to as it runs. Stdout and stderr are both written to
+// it a line at a time, so that their lines don't get mixed up.
+type procLog struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+
+	// failed is set once a write has failed, so it's only logged the once
+	failed bool
+}
+
+// createProcLog starts a new log for the proc with `id`, replacing the one from an earlier run.
+func createProcLog(id int) (*procLog, error) {
+	path := ProcLogPath(id)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &procLog{path: path, file: file}, nil
+}
+
+func (l *procLog) write(b []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.failed {
+		return
+	}
+
+	// The proc shouldn't fail over its log, proc_results still gets the summary
+	if _, err := l.file.Write(b); err != nil {
+		zap.L().Error("failed to write proc log", zap.String("path", l.path), zap.Error(err))
+		l.failed = true
+	}
+}
+
+func (l *procLog) Close() error {
+	return l.file.Close()
+}
+
+// procStream is one of a proc's outputs. Complete lines go on to the log, and the end of the
+// output is kept as the summary for proc_results.
+type procStream struct {
+	// log is nil if it couldn't be created
+	log *procLog
+
+	partial []byte
+	summary []byte
+	dropped int
+}
+
+func newProcStream(log *procLog) *procStream {
+	return &procStream{log: log}
+}
+
+// Write implements io.Writer.
+func (s *procStream) Write(b []byte) (int, error) {
+	s.summary = append(s.summary, b...)
+	if len(s.summary) > 2*procSummaryBytes {
+		cut := len(s.summary) - procSummaryBytes
+		s.dropped += cut
+		s.summary = bytes.Clone(s.summary[cut:])
+	}
+
+	if s.log == nil {
+		return len(b), nil
+	}
+
+	s.partial = append(s.partial, b...)
+	end := bytes.LastIndexAny(s.partial, "\r\n") + 1
+	if len(s.partial) > procMaxLine {
+		end = len(s.partial)
+	}
+	if end > 0 {
+		s.log.write(s.partial[:end])
+		s.partial = append(s.partial[:0], s.partial[end:]...)
+	}
+
+	return len(b), nil
+}
+
+// Flush writes out the last line if the output didn't end with a newline.
+func (s *procStream) Flush() {
+	if s.log != nil && len(s.partial) > 0 {
+		s.log.write(s.partial)
+		s.partial = s.partial[:0]
+	}
+}
+
+// Summary returns the end of the output, starting at a line and noting how much was left out.
+func (s *procStream) Summary() string {
+	summary := s.summary
+	dropped := s.dropped
+	if len(summary) > procSummaryBytes {
+		dropped += len(summary) - procSummaryBytes
+		summary = summary[len(summary)-procSummaryBytes:]
+	}
+	if dropped == 0 {
+		return string(summary)
+	}
+
+	if i := bytes.IndexByte(summary, '\n'); i >= 0 {
+		dropped += i + 1
+		summary = summary[i+1:]
+	}
+
+	where := "was not kept"
+	if s.log != nil {
+		where = "is in " + s.log.path
+	}
+	return fmt.Sprintf("[%d bytes truncated, the full output %s]\n%s", dropped, where, summary)
+}
@@ -0,0 +1,166 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// ProcQueueEntry is a proc that's running or waiting to.
+type ProcQueueEntry struct {
+	ID       int      `json:"id"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	State    string   `json:"state"`
+	Priority int      `json:"priority"`
+
+	// Position is the place in line among the queued procs for the same command, starting at
+	// 1, and 0 for running procs
+	Position  int        `json:"position"`
+	CreatedAt time.Time  `json:"created_at"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+
+	// EstimatedStartAt and EstimatedFinishAt are based on how long the latest runs of the
+	// command took, and missing if it hasn't finished before
+	EstimatedStartAt  *time.Time `json:"estimated_start_at,omitempty"`
+	EstimatedFinishAt *time.Time `json:"estimated_finish_at,omitempty"`
+}
+
+// ProcQueue returns the running procs followed by the queued ones in the order they'll start,
+// grouped by command since each command has its own concurrency limit.
+func ProcQueue(ctx context.Context, db *sql.DB) ([]ProcQueueEntry, error) {
+	averages, err := procAverageDurations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := queuedProcs(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) && entries[end].Command == entries[start].Command {
+			end++
+		}
+
+		command := entries[start].Command
+		average, ok := averages[command]
+		estimateQueue(entries[start:end], procConcurrency(command), average, ok, now)
+		start = end
+	}
+
+	return entries, nil
+}
+
+// queuedProcs returns the running and queued procs of each command in turn, running ones
+// first and then the queued ones in the order they'll start.
+func queuedProcs(ctx context.Context, db *sql.DB) ([]ProcQueueEntry, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, command, args, state, priority, created_at, started_at
+		FROM proc
+		WHERE state IN (?, ?)
+		ORDER BY command, state = ?, priority DESC, id
+	`, ProcRunning, ProcQueued, ProcQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ProcQueueEntry{}
+	for rows.Next() {
+		var entry ProcQueueEntry
+		var args string
+		if err := rows.Scan(&entry.ID, &entry.Command, &args, &entry.State, &entry.Priority,
+			&entry.CreatedAt, &entry.StartedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(args), &entry.Args); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// estimateQueue fills in the positions and estimates for the procs of a single command,
+// running ones first. Each proc is taken to last `average`, and to start as soon as one of
+// the command's `concurrency` slots is free.
+func estimateQueue(entries []ProcQueueEntry, concurrency int, average time.Duration, known bool, now time.Time) {
+	slots := make([]time.Time, concurrency)
+	for i := range slots {
+		slots[i] = now
+	}
+
+	position := 0
+	for i := range entries {
+		entry := &entries[i]
+		if entry.State == ProcRunning {
+			position = 0
+		} else {
+			position++
+		}
+		entry.Position = position
+
+		if !known {
+			continue
+		}
+
+		if entry.State == ProcRunning && entry.StartedAt != nil {
+			// Overdue procs are assumed to be just about done
+			finish := entry.StartedAt.Add(average)
+			if finish.Before(now) {
+				finish = now
+			}
+			entry.EstimatedFinishAt = &finish
+			if i < len(slots) {
+				slots[i] = finish
+			}
+			continue
+		}
+
+		// Take the slot that frees up first
+		next := slices.MinFunc(slots, func(a, b time.Time) int { return a.Compare(b) })
+		slot := slices.Index(slots, next)
+		finish := next.Add(average)
+		entry.EstimatedStartAt = &next
+		entry.EstimatedFinishAt = &finish
+		slots[slot] = finish
+	}
+}
+
+// procAverageDurations returns how long each command's latest successful runs took on average.
+func procAverageDurations(ctx context.Context, db *sql.DB) (map[string]time.Duration, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT command, avg(duration_ms) FROM (
+			SELECT p.command, r.duration_ms,
+				row_number() OVER (PARTITION BY p.command ORDER BY r.finished_at DESC) AS n
+			FROM proc_results r
+			JOIN proc p ON p.id = r.id
+			WHERE p.state = ? AND r.duration_ms IS NOT NULL
+		)
+		WHERE n <= ?
+		GROUP BY command
+	`, ProcSucceeded, procEstimateSample)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	averages := make(map[string]time.Duration)
+	for rows.Next() {
+		var command string
+		var ms float64
+		if err := rows.Scan(&command, &ms); err != nil {
+			return nil, err
+		}
+		averages[command] = time.Duration(ms * float64(time.Millisecond))
+	}
+
+	return averages, rows.Err()
+}
@@ -0,0 +1,184 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQueuedProcs(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "fsd.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(PROC_CREATE); err != nil {
+		t.Fatal(err)
+	}
+
+	procs := []struct {
+		command  string
+		state    string
+		priority int
+	}{
+		{"rsync", ProcQueued, 0},
+		{"rsync", ProcQueued, 5},
+		{"rsync", ProcRunning, 0},
+		{"rsync", ProcSucceeded, 9},
+		{"rclone", ProcQueued, 0},
+		{"rsync", ProcQueued, 5},
+		{"rclone", ProcQueued, -1},
+		{"rclone", ProcQueued, 1},
+	}
+	for _, proc := range procs {
+		_, err := db.Exec(`
+			INSERT INTO proc (command, args, state, priority, created_at) VALUES (?, '[]', ?, ?, ?)
+		`, proc.command, proc.state, proc.priority, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := queuedProcs(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Higher priorities go first, and otherwise the oldest
+	var got []int
+	for _, entry := range entries {
+		got = append(got, entry.ID)
+	}
+	if want := []int{8, 5, 7, 3, 2, 6, 1}; !slices.Equal(got, want) {
+		t.Errorf("got ids %v, want %v", got, want)
+	}
+}
+
+func TestEstimateQueue(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	const average = 10 * time.Minute
+
+	// at returns a time `minutes` from now
+	at := func(minutes int) *time.Time {
+		when := now.Add(time.Duration(minutes) * time.Minute)
+		return &when
+	}
+
+	type estimate struct {
+		position int
+		start    *time.Time
+		finish   *time.Time
+	}
+
+	tests := []struct {
+		name        string
+		concurrency int
+		known       bool
+
+		// running are how many minutes ago each running proc started, and queued is how many
+		// procs are waiting after them
+		running []int
+		queued  int
+		want    []estimate
+	}{
+		{
+			name:        "one at a time",
+			concurrency: 1,
+			known:       true,
+			queued:      3,
+			want: []estimate{
+				{1, at(0), at(10)},
+				{2, at(10), at(20)},
+				{3, at(20), at(30)},
+			},
+		},
+		{
+			name:        "waits for the running proc",
+			concurrency: 1,
+			known:       true,
+			running:     []int{4},
+			queued:      2,
+			want: []estimate{
+				{0, nil, at(6)},
+				{1, at(6), at(16)},
+				{2, at(16), at(26)},
+			},
+		},
+		{
+			name:        "takes whichever slot frees up first",
+			concurrency: 3,
+			known:       true,
+			running:     []int{7, 2},
+			queued:      4,
+			want: []estimate{
+				{0, nil, at(3)},
+				{0, nil, at(8)},
+				{1, at(0), at(10)},
+				{2, at(3), at(13)},
+				{3, at(8), at(18)},
+				{4, at(10), at(20)},
+			},
+		},
+		{
+			name:        "overdue",
+			concurrency: 1,
+			known:       true,
+			running:     []int{30},
+			queued:      1,
+			want: []estimate{
+				{0, nil, at(0)},
+				{1, at(0), at(10)},
+			},
+		},
+		{
+			name:        "never run before",
+			concurrency: 2,
+			running:     []int{5},
+			queued:      2,
+			want: []estimate{
+				{0, nil, nil},
+				{1, nil, nil},
+				{2, nil, nil},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries []ProcQueueEntry
+			for _, minutes := range tt.running {
+				entries = append(entries, ProcQueueEntry{State: ProcRunning, StartedAt: at(-minutes)})
+			}
+			for range tt.queued {
+				entries = append(entries, ProcQueueEntry{State: ProcQueued})
+			}
+
+			estimateQueue(entries, tt.concurrency, average, tt.known, now)
+
+			for i, entry := range entries {
+				want := tt.want[i]
+				if entry.Position != want.position {
+					t.Errorf("%d: got position %d, want %d", i, entry.Position, want.position)
+				}
+				if !sameTime(entry.EstimatedStartAt, want.start) {
+					t.Errorf("%d: got start %v, want %v", i, entry.EstimatedStartAt, want.start)
+				}
+				if !sameTime(entry.EstimatedFinishAt, want.finish) {
+					t.Errorf("%d: got finish %v, want %v", i, entry.EstimatedFinishAt, want.finish)
+				}
+			}
+		})
+	}
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
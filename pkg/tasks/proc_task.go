@@ -3,26 +3,41 @@ package tasks
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fsd/internal/config"
 	"fsd/pkg/ipc"
+	"io"
+	"io/fs"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"bytes"
 	"errors"
 	"fmt"
 
 	"go.uber.org/zap"
 )
 
+// PROC_CREATE creates the proc table. args and env are JSON arrays, with env in the KEY=value
+// form, and an empty work_dir runs the proc in fsd's own working directory.
 const PROC_CREATE string = `
 	CREATE TABLE IF NOT EXISTS proc (
 		id INTEGER NOT NULL PRIMARY KEY,
 		command TEXT NOT NULL,
 		args TEXT NOT NULL,
 		is_executed INTEGER NOT NULL DEFAULT 0,
-		created_at DATETIME NOT NULL
+		created_at DATETIME NOT NULL,
+		state TEXT NOT NULL DEFAULT 'queued',
+		started_at DATETIME,
+		priority INTEGER NOT NULL DEFAULT 0,
+		env TEXT NOT NULL DEFAULT '[]',
+		work_dir TEXT NOT NULL DEFAULT ''
 	)
 `
 
@@ -31,10 +46,237 @@ const PROC_RESULTS_CREATE string = `
 		id INTEGER NOT NULL PRIMARY KEY,
 		stdout TEXT NOT NULL,
 		stderr TEXT NOT NULL,
-		created_at DATETIME NOT NULL
+		created_at DATETIME NOT NULL,
+		exit_code INTEGER,
+		started_at DATETIME,
+		finished_at DATETIME,
+		duration_ms INTEGER
 	)
 `
 
+// procColumns and procResultColumns were added after the tables were first created
+var procColumns = []columnDef{
+	{"state", "TEXT NOT NULL DEFAULT 'queued'"},
+	{"started_at", "DATETIME"},
+	{"priority", "INTEGER NOT NULL DEFAULT 0"},
+	{"env", "TEXT NOT NULL DEFAULT '[]'"},
+	{"work_dir", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// PROC_QUEUE_INDEX_CREATE covers picking the next proc to run for a command
+const PROC_QUEUE_INDEX_CREATE string = `
+	CREATE INDEX IF NOT EXISTS proc_queue ON proc (state, command, priority DESC, id)
+`
+
+// procEstimateSample is how many of the latest runs of a command its queue estimates are
+// based on
+const procEstimateSample = 20
+
+var procResultColumns = []columnDef{
+	{"exit_code", "INTEGER"},
+	{"started_at", "DATETIME"},
+	{"finished_at", "DATETIME"},
+	{"duration_ms", "INTEGER"},
+}
+
+// The states a proc goes through. Everything starts out queued, and ends up in one of the
+// states after running.
+const (
+	ProcQueued    = "queued"
+	ProcRunning   = "running"
+	ProcSucceeded = "succeeded"
+	ProcFailed    = "failed"
+	ProcCancelled = "cancelled"
+	ProcTimedOut  = "timed_out"
+)
+
+// The ways of dealing with procs that were running when fsd stopped, for `proc_recovery`
+const (
+	// ProcRecoveryFail marks them failed
+	ProcRecoveryFail = "fail"
+
+	// ProcRecoveryRequeue runs them again from the start
+	ProcRecoveryRequeue = "requeue"
+)
+
+// procInterrupted is the stderr recorded for procs that were failed on recovery
+const procInterrupted = "fsd stopped while the proc was running"
+
+// procUnmigratable is the stderr recorded for queued procs whose args can't be recovered from
+// when they were joined with spaces
+const procUnmigratable = "fsd was upgraded while the proc was queued and its arguments can't be told apart any more, submit it again"
+
+var (
+	// ErrProcNotFound means there's no proc with the given id
+	ErrProcNotFound = errors.New("no such proc")
+
+	// ErrProcFinished means the proc has already stopped, one way or another
+	ErrProcFinished = errors.New("proc has already finished")
+
+	// errProcCancelled is the cause given when a proc is cancelled through the API
+	errProcCancelled = errors.New("proc cancelled")
+)
+
+// runningProc is a proc that's been picked up and hasn't finished yet.
+type runningProc struct {
+	command string
+	cancel  context.CancelCauseFunc
+
+	// done is closed once the outcome has been recorded
+	done chan struct{}
+}
+
+var (
+	runningProcsLock sync.Mutex
+	runningProcs     = make(map[int]*runningProc)
+)
+
+// CancelProc stops the proc with `id`. A queued proc is cancelled straight away. A running one
+// has its process group sent SIGTERM, and SIGKILL if it's still going after
+// `proc_kill_grace`, and this waits until that's done. It returns the state the proc ended up
+// in, which can be something other than cancelled if it finished first.
+func CancelProc(ctx context.Context, db *sql.DB, id int) (string, error) {
+	result, err := db.ExecContext(ctx, `
+		UPDATE proc SET state = ? WHERE id = ? AND state = ?
+	`, ProcCancelled, id, ProcQueued)
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		return ProcCancelled, nil
+	}
+
+	// Procs are claimed and registered in one go, so if it's not queued any more it's either
+	// here or finished
+	runningProcsLock.Lock()
+	running, ok := runningProcs[id]
+	runningProcsLock.Unlock()
+	if ok {
+		running.cancel(errProcCancelled)
+	}
+
+	if ok {
+		select {
+		case <-running.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	var state string
+	err = db.QueryRowContext(ctx, `SELECT state FROM proc WHERE id = ?`, id).Scan(&state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrProcNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !ok && state != ProcQueued && state != ProcRunning {
+		return state, ErrProcFinished
+	}
+
+	return state, nil
+}
+
+// ProcSpec is everything a proc runs with. It's stored as is, so the proc runs exactly the argv
+// it was given, without ever going through a shell.
+type ProcSpec struct {
+	Command string
+	Args    []string
+
+	// Env is added to fsd's own environment, in the KEY=value form
+	Env []string
+
+	// WorkDir is where the proc runs, fsd's own working directory if it's empty. It's stored
+	// as the directory it'll be, so that it can be seen where each proc ran.
+	WorkDir  string
+	Priority int
+}
+
+// QueueProc adds a proc to the queue, returning its id.
+func QueueProc(ctx context.Context, db *sql.DB, spec ProcSpec) (int, error) {
+	// Nil slices would be stored as null
+	if spec.Args == nil {
+		spec.Args = []string{}
+	}
+	if spec.Env == nil {
+		spec.Env = []string{}
+	}
+	if spec.WorkDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return 0, err
+		}
+		spec.WorkDir = wd
+	}
+
+	args, err := json.Marshal(spec.Args)
+	if err != nil {
+		return 0, err
+	}
+
+	env, err := json.Marshal(spec.Env)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO proc (command, args, env, work_dir, is_executed, created_at, priority)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, spec.Command, string(args), string(env), spec.WorkDir, 0, time.Now(), spec.Priority)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func init() {
+	ipc.RegisterMessage(ProcMessage{})
+}
+
+// NativeProc is a proc that runs inside fsd rather than as a separate command. Like a command,
+// it writes its output to stdout and stderr and fails by returning an error. It's given the
+// proc's id for keeping anything more structured than its output.
+type NativeProc func(ctx context.Context, id int, args []string, stdout, stderr io.Writer) error
+
+var nativeProcs = make(map[string]NativeProc)
+
+// RegisterNativeProc makes `command` run `proc` in-process. It's meant to be called from init.
+func RegisterNativeProc(command string, proc NativeProc) {
+	nativeProcs[command] = proc
+}
+
+// ProcMessage is broadcast when a proc finishes running.
+type ProcMessage struct {
+	ID        int       `json:"id"`
+	Command   string    `json:"command"`
+	Args      []string  `json:"args"`
+	State     string    `json:"state"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Operation ipc.FsdOp `json:"event_operation"`
+}
+
+func (m ProcMessage) String() (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (m ProcMessage) EventName() string {
+	return m.Command
+}
+
+func (m ProcMessage) EventOperation() ipc.FsdOp {
+	return m.Operation
+}
+
 // ProcTaskState is the state for the proc task.
 type ProcTaskState struct {
 	// rootPath is the root path that we're watching
@@ -66,6 +308,52 @@ func NewProcTaskState(rootPath string, broadcaster *ipc.Broadcaster, broadcastCh
 		zap.L().Fatal("failed to create proc_results table", zap.Error(err))
 	}
 
+	// The proc migration records results, so proc_results has to be up to date first
+	if _, err := ensureColumns(db, "proc_results", procResultColumns...); err != nil {
+		zap.L().Fatal("failed to migrate proc_results table", zap.Error(err))
+	}
+
+	added, err := ensureColumns(db, "proc", procColumns...)
+	if err != nil {
+		zap.L().Fatal("failed to migrate proc table", zap.Error(err))
+	}
+	if slices.Contains(added, "state") {
+		// Before there were states, failures weren't recorded and a crash lost the result, so
+		// anything that ran without leaving one behind is taken to have failed
+		_, err = db.Exec(`
+			UPDATE proc SET state = CASE
+				WHEN is_executed = 0 THEN ?
+				WHEN id IN (SELECT id FROM proc_results) THEN ?
+				ELSE ?
+			END
+		`, ProcQueued, ProcSucceeded, ProcFailed)
+		if err != nil {
+			zap.L().Fatal("failed to set proc states", zap.Error(err))
+		}
+	}
+	if slices.Contains(added, "env") {
+		if err := migrateProcArgs(db); err != nil {
+			zap.L().Fatal("failed to convert proc args to JSON", zap.Error(err))
+		}
+	}
+	if len(added) > 0 {
+		zap.L().Info("added columns", zap.String("table name", "proc"), zap.Strings("columns", added))
+	}
+
+	_, err = db.Exec(PROC_QUEUE_INDEX_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create proc queue index", zap.Error(err))
+	}
+
+	// Procs can print anything, secrets included, so their logs are only for fsd's user. The
+	// directory used to be created readable by everyone.
+	if err := os.MkdirAll(config.GetProcLogDir(), 0700); err != nil {
+		zap.L().Fatal("failed to create proc log directory", zap.Error(err))
+	}
+	if err := os.Chmod(config.GetProcLogDir(), 0700); err != nil {
+		zap.L().Fatal("failed to restrict proc log directory", zap.Error(err))
+	}
+
 	return &ProcTaskState{
 		rootPath:         rootPath,
 		broadcaster:      broadcaster,
@@ -74,6 +362,91 @@ func NewProcTaskState(rootPath string, broadcaster *ipc.Broadcaster, broadcastCh
 	}
 }
 
+// migrateProcArgs converts args stored before they were JSON, when they were joined with spaces.
+// Procs that already ran get them split on spaces again, since that's how they were run. Queued
+// ones get what was meant where that can be told, mkdir and dedupe both ending in a single path.
+// Anything else that's queued, like yt-dlp with its channel in the middle, could have had
+// spaces in any of its args, so it's failed rather than run with the wrong ones.
+func migrateProcArgs(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, command, args, state FROM proc`)
+	if err != nil {
+		return err
+	}
+
+	converted := make(map[int][]byte)
+	var failed []int
+	for rows.Next() {
+		var id int
+		var command, args, state string
+		if err := rows.Scan(&id, &command, &args, &state); err != nil {
+			rows.Close()
+			return err
+		}
+
+		argv := strings.Split(args, " ")
+		if state == ProcQueued {
+			switch command {
+			case "mkdir":
+				argv = []string{args}
+			case "dedupe":
+				flags := 0
+				for flags < len(argv) && strings.HasPrefix(argv[flags], "--") {
+					flags++
+				}
+				if flags < len(argv) {
+					argv = append(argv[:flags], strings.Join(argv[flags:], " "))
+				}
+			default:
+				if len(argv) > 1 {
+					failed = append(failed, id)
+				}
+			}
+		}
+
+		converted[id], err = json.Marshal(argv)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, argv := range converted {
+		if _, err := tx.Exec(`UPDATE proc SET args = ? WHERE id = ?`, string(argv), id); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, id := range failed {
+		_, err := tx.Exec(`
+			INSERT OR REPLACE INTO proc_results (id, stdout, stderr, created_at, finished_at)
+			SELECT id, '', ?, created_at, ? FROM proc WHERE id = ?
+		`, procUnmigratable, now, id)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`UPDATE proc SET state = ? WHERE id = ?`, ProcFailed, id); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		zap.L().Warn("failed queued procs whose args couldn't be converted", zap.Ints("ids", failed))
+	}
+
+	return tx.Commit()
+}
+
 func (p *ProcTaskState) RootPath() string {
 	return p.rootPath
 }
@@ -89,9 +462,12 @@ func (p *ProcTaskState) BroadcastChannel() chan ipc.Message {
 // ProcTask takes tasks from the proc table and executes them as shell commands in a
 // separate go task. It then updates the proc_results table with the results of the
 // command. The API will give an associated ID to the command so that the client can
-// poll for the results.
+// poll for the results, or follow the proc's log while it runs.
 type ProcTask struct {
 	state *ProcTaskState
+
+	// wake nudges the event loop when a proc finishes, so the next one can start
+	wake chan struct{}
 }
 
 // SendMessage implements Task.
@@ -106,15 +482,31 @@ func ProcTaskName() string {
 func NewProcTask(state *ProcTaskState) *ProcTask {
 	return &ProcTask{
 		state: state,
+		wake:  make(chan struct{}, 1),
 	}
 }
 
 func (p *ProcTask) StartEventLoop(ctx context.Context) {
+	if err := p.recover(ctx); err != nil {
+		zap.L().Error("failed to recover interrupted procs", zap.String("task name", ProcTaskName()), zap.Error(err))
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			zap.L().Info("got shutdown signal, exiting", zap.String("task name", ProcTaskName()))
 			return
+		case event := <-p.state.BroadcastChannel():
+			// Only compaction matters here, but the channel still has to be drained so that
+			// blocking delivery doesn't stall everyone else.
+			if err := p.HandleMessage(ctx, event); err != nil {
+				zap.L().Error("error handling message", zap.String("task name", ProcTaskName()), zap.Error(err))
+			}
+			p.state.broadcaster.Ack(ProcTaskName(), event)
+		case <-p.wake:
+			if err := p.doTask(ctx); err != nil {
+				zap.L().Error("failed to execute shell commands from the proc table", zap.Error(err))
+			}
 		case <-time.After(time.Second * 1):
 			if err := p.doTask(ctx); err != nil {
 				zap.L().Error("failed to execute shell commands from the proc table", zap.Error(err))
@@ -131,82 +523,381 @@ func (p *ProcTask) HandleMessage(ctx context.Context, msg ipc.Message) error {
 	}
 	zap.L().Debug("got message", zap.String("task name", ProcTaskName()), zap.String("msg", ms))
 
+	if msg.EventOperation() == ipc.Compact {
+		return p.doCompaction(ctx)
+	}
+
 	return nil
 }
 
-// doTask takes a command from the proc table and executes it as a goroutine, storing std
-// out and std err to the proc_results table as raw text.
-func (p *ProcTask) doTask(ctx context.Context) error {
-	query := `
-		SELECT id, command, args, created_at FROM proc WHERE is_executed = 0
-	`
+// doCompaction deletes the logs that haven't been written to for `proc_log_retention`, keeping
+// them forever if there's no retention. Procs that are still queued or running keep theirs,
+// and every proc keeps its summary in proc_results.
+func (p *ProcTask) doCompaction(ctx context.Context) error {
+	retention := config.GetConfig().ProcLogRetention
+	if retention <= 0 {
+		return nil
+	}
 
-	rows, err := p.state.db.Query(query)
+	entries, err := os.ReadDir(config.GetProcLogDir())
 	if err != nil {
 		return err
 	}
 
-	for rows.Next() {
-		var id int
-		var command string
-		var args string
-		var createdAt time.Time
-		err = rows.Scan(&id, &command, &args, &createdAt)
+	thresh := time.Now().Add(-retention)
+	deleted := 0
+	for _, entry := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "proc-"), ".log"))
+		if err != nil || entry.Name() != filepath.Base(ProcLogPath(id)) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
 		if err != nil {
 			return err
 		}
+		if !info.ModTime().Before(thresh) {
+			continue
+		}
 
-		go func() {
-			_, err = p.state.db.Exec(`
-			UPDATE proc SET is_executed = 1 WHERE id = ?
-		`, id)
+		var state string
+		err = p.state.db.QueryRowContext(ctx, `SELECT state FROM proc WHERE id = ?`, id).Scan(&state)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if state == ProcQueued || state == ProcRunning {
+			continue
+		}
 
-			if err != nil {
-				zap.L().Error("failed to update proc table", zap.Error(err))
-			}
+		if err := os.Remove(ProcLogPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		deleted++
+	}
 
-			stdout, stderr, err := p.executeCommand(ctx, command, strings.Split(args, " "))
-			if err != nil {
-				zap.L().Error("failed to execute command", zap.Error(err))
-			}
+	zap.L().Info("deleted old proc logs", zap.String("task name", ProcTaskName()), zap.Int("logs deleted", deleted))
+	return nil
+}
 
-			stmt, err := p.state.db.Prepare(`
-				INSERT INTO proc_results (id, stdout, stderr, created_at) VALUES (?, ?, ?, ?)
-			`)
+// recover deals with the procs that were still running when fsd last stopped, according to
+// `proc_recovery`.
+func (p *ProcTask) recover(ctx context.Context) error {
+	policy := config.GetConfig().ProcRecovery
+
+	var result sql.Result
+	var err error
+	switch policy {
+	case ProcRecoveryRequeue:
+		result, err = p.state.db.ExecContext(ctx, `
+			UPDATE proc SET state = ?, is_executed = 0, started_at = NULL WHERE state = ?
+		`, ProcQueued, ProcRunning)
+	case ProcRecoveryFail:
+		tx, err := p.state.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
 
-			if err != nil {
-				zap.L().Error("failed to prepare insert statement", zap.Error(err))
-			}
+		now := time.Now()
+		_, err = tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO proc_results (id, stdout, stderr, created_at, started_at, finished_at)
+			SELECT id, '', ?, created_at, started_at, ? FROM proc WHERE state = ?
+		`, procInterrupted, now, ProcRunning)
+		if err != nil {
+			return err
+		}
+
+		result, err = tx.ExecContext(ctx, `UPDATE proc SET state = ? WHERE state = ?`, ProcFailed, ProcRunning)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid proc_recovery: %s, wanted %s or %s", policy, ProcRecoveryFail, ProcRecoveryRequeue)
+	}
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		zap.L().Warn("recovered interrupted procs", zap.String("policy", policy), zap.Int64("count", n))
+	}
+
+	return nil
+}
+
+// queuedProc is a row of the proc table waiting to run, with args and env still as JSON.
+type queuedProc struct {
+	id        int
+	command   string
+	args      string
+	env       string
+	workDir   string
+	createdAt time.Time
+}
+
+// procConcurrency is how many procs running `command` can run at once.
+func procConcurrency(command string) int {
+	limit, ok := config.GetConfig().ProcConcurrency[command]
+	if !ok {
+		limit = config.GetConfig().ProcDefaultConcurrency
+	}
+
+	return max(limit, 1)
+}
 
-			_, err = stmt.Exec(id, stdout, stderr, createdAt)
+// doTask starts as many queued procs as each command's concurrency allows, highest priority
+// first, storing the end of std out and std err to the proc_results table as raw text.
+func (p *ProcTask) doTask(ctx context.Context) error {
+	rows, err := p.state.db.QueryContext(ctx, `
+		SELECT DISTINCT command FROM proc WHERE state = ?
+	`, ProcQueued)
+	if err != nil {
+		return err
+	}
+
+	var commands []string
+	for rows.Next() {
+		var command string
+		if err := rows.Scan(&command); err != nil {
+			rows.Close()
+			return err
+		}
+		commands = append(commands, command)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, command := range commands {
+		for p.running(command) < procConcurrency(command) {
+			started, err := p.startNext(ctx, command)
 			if err != nil {
-				zap.L().Error("failed to insert into proc_results", zap.Error(err))
+				return err
+			}
+			if !started {
+				break
 			}
+		}
+	}
 
-			if err := stmt.Close(); err != nil {
-				zap.L().Error("failed to close statement", zap.Error(err))
+	return nil
+}
+
+// running is how many procs running `command` haven't finished yet.
+func (p *ProcTask) running(command string) int {
+	runningProcsLock.Lock()
+	defer runningProcsLock.Unlock()
+
+	count := 0
+	for _, running := range runningProcs {
+		if running.command == command {
+			count++
+		}
+	}
+
+	return count
+}
+
+// startNext claims the next queued proc for `command` and runs it, reporting false if there
+// was nothing left to claim.
+func (p *ProcTask) startNext(ctx context.Context, command string) (bool, error) {
+	// Claiming and registering happen together, so that a proc can always be cancelled either
+	// through the table or through runningProcs
+	runningProcsLock.Lock()
+	defer runningProcsLock.Unlock()
+
+	var proc queuedProc
+	startedAt := time.Now()
+	err := p.state.db.QueryRowContext(ctx, `
+		UPDATE proc SET state = ?, is_executed = 1, started_at = ?
+		WHERE id = (
+			SELECT id FROM proc WHERE state = ? AND command = ?
+			ORDER BY priority DESC, id
+			LIMIT 1
+		)
+		RETURNING id, command, args, env, work_dir, created_at
+	`, ProcRunning, startedAt, ProcQueued, command).Scan(&proc.id, &proc.command, &proc.args, &proc.env,
+		&proc.workDir, &proc.createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	procCtx, cancel := context.WithCancelCause(ctx)
+	running := &runningProc{command: command, cancel: cancel, done: make(chan struct{})}
+	runningProcs[proc.id] = running
+
+	go func() {
+		defer func() {
+			runningProcsLock.Lock()
+			delete(runningProcs, proc.id)
+			runningProcsLock.Unlock()
+			cancel(nil)
+			close(running.done)
+
+			select {
+			case p.wake <- struct{}{}:
+			default:
 			}
 		}()
+		p.run(ctx, procCtx, proc, startedAt)
+	}()
+
+	return true, nil
+}
+
+// run executes a claimed proc and records how it went. `ctx` is fsd's own context, and
+// `procCtx` is the proc's, which is cancelled when the proc is.
+func (p *ProcTask) run(ctx context.Context, procCtx context.Context, proc queuedProc, startedAt time.Time) {
+	runCtx := procCtx
+	if timeout := config.GetConfig().ProcTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(procCtx, timeout)
+		defer cancel()
 	}
 
-	return nil
+	var args, env []string
+	var stdout, stderr string
+	var exitCode *int
+	err := json.Unmarshal([]byte(proc.args), &args)
+	if err == nil {
+		err = json.Unmarshal([]byte(proc.env), &env)
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid args or env: %w", err)
+		stderr = err.Error()
+	} else {
+		stdout, stderr, exitCode, err = p.executeCommand(runCtx, proc.id, proc.command, args, env, proc.workDir)
+	}
+	finishedAt := time.Now()
+
+	// Leave procs cut short by shutdown as running, so they're recovered on the next start
+	if ctx.Err() != nil {
+		zap.L().Warn("proc interrupted by shutdown", zap.Int("id", proc.id), zap.String("command", proc.command))
+		return
+	}
+
+	state := ProcSucceeded
+	switch {
+	case errors.Is(context.Cause(procCtx), errProcCancelled):
+		state = ProcCancelled
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded):
+		state = ProcTimedOut
+	case err != nil:
+		state = ProcFailed
+	}
+
+	done := ProcMessage{
+		ID:        proc.id,
+		Command:   proc.command,
+		Args:      args,
+		State:     state,
+		ExitCode:  exitCode,
+		Operation: ipc.ProcCompleted,
+	}
+	if err != nil {
+		zap.L().Error("failed to execute command", zap.Error(err))
+		done.Error = err.Error()
+	}
+	defer p.state.broadcaster.Broadcast(done)
+
+	_, err = p.state.db.Exec(`
+		INSERT INTO proc_results (
+			id, stdout, stderr, created_at, exit_code, started_at, finished_at, duration_ms
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, proc.id, stdout, stderr, proc.createdAt, exitCode, startedAt, finishedAt,
+		finishedAt.Sub(startedAt).Milliseconds())
+	if err != nil {
+		zap.L().Error("failed to insert into proc_results", zap.Error(err))
+	}
+
+	_, err = p.state.db.Exec(`UPDATE proc SET state = ? WHERE id = ?`, state, proc.id)
+	if err != nil {
+		zap.L().Error("failed to update proc table", zap.Error(err))
+	}
 }
 
-func (p *ProcTask) executeCommand(ctx context.Context, command string, args []string) (string, string, error) {
-	zap.L().Info("executing command", zap.String("command", command), zap.Any("args", args))
-	cmd := exec.CommandContext(ctx, command, args...)
+// executeCommand runs `command` for the proc with `id`, returning the end of its output and its
+// exit code. The exit code is nil if the command never got to run. Output is written to the
+// proc's log as it comes, a line at a time. Commands run in their own process group, so that
+// when `ctx` is cancelled anything they started goes down with them. Native procs are left to
+// notice `ctx` themselves, and run with fsd's own environment and working directory.
+func (p *ProcTask) executeCommand(ctx context.Context, id int, command string, args, env []string, workDir string) (string, string, *int, error) {
+	// Only the names of the environment variables are logged, their values may well be secrets
+	envKeys := make([]string, 0, len(env))
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		envKeys = append(envKeys, key)
+	}
+	zap.L().Info("executing command", zap.Int("id", id), zap.String("command", command), zap.Strings("args", args),
+		zap.Strings("env", envKeys), zap.String("work dir", workDir))
+
+	log, err := createProcLog(id)
+	if err != nil {
+		zap.L().Error("failed to create proc log, keeping only the summary", zap.Int("id", id), zap.Error(err))
+	} else {
+		defer log.Close()
+	}
+
+	stdout, stderr := newProcStream(log), newProcStream(log)
+	var exitCode *int
+	if native, ok := nativeProcs[command]; ok {
+		err = native(ctx, id, args, stdout, stderr)
+		code := 0
+		if err != nil {
+			code = 1
+		}
+		exitCode = &code
+	} else {
+		cmd := exec.CommandContext(ctx, command, args...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		cmd.Dir = workDir
+		if len(env) > 0 {
+			cmd.Env = append(os.Environ(), env...)
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+		// Ask the whole group to stop, the process itself is killed if it hasn't after the
+		// grace period
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		}
+		cmd.WaitDelay = config.GetConfig().ProcKillGrace
+
+		err = cmd.Run()
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+		// Take down whatever's left of the group, such as the ffmpeg that yt-dlp starts
+		if ctx.Err() != nil && cmd.Process != nil {
+			if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+				zap.L().Warn("failed to kill process group", zap.Int("pgid", cmd.Process.Pid), zap.Error(err))
+			}
+		}
+		if cmd.ProcessState != nil {
+			code := cmd.ProcessState.ExitCode()
+			exitCode = &code
+		}
+	}
+	stdout.Flush()
+	stderr.Flush()
 
-	err := cmd.Run()
 	if err != nil {
 		// Capture the error message
-		errorMsg := fmt.Sprintf("Command failed: %v\nStderr: %s", err, stderr.String())
+		errorMsg := fmt.Sprintf("Command failed: %v\nStderr: %s", err, stderr.Summary())
 		zap.L().Error("error executing command", zap.Error(errors.New(errorMsg)))
-		return stdout.String(), stderr.String(), errors.New(errorMsg)
+		return stdout.Summary(), stderr.Summary(), exitCode, errors.New(errorMsg)
 	}
 
-	return stdout.String(), stderr.String(), nil
+	return stdout.Summary(), stderr.Summary(), exitCode, nil
 }
@@ -22,7 +22,8 @@ func NewTaskRegistry() *TaskRegistry {
 
 func (t *TaskRegistry) Init(rootPath string, broadcaster *ipc.Broadcaster, watcher *fsnotify.Watcher, names ...string) {
 	for _, name := range names {
-		taskChan := broadcaster.Subscribe(name)
+		// Pick up from wherever the task got to before the last shutdown
+		taskChan := broadcaster.Resume(name)
 		switch name {
 		case FsTaskName():
 			taskState := NewFsTaskState(rootPath, broadcaster, taskChan)
@@ -40,6 +41,26 @@ func (t *TaskRegistry) Init(rootPath string, broadcaster *ipc.Broadcaster, watch
 			taskState := NewProcTaskState(rootPath, broadcaster, taskChan)
 			task := NewProcTask(taskState)
 			t.tasks[ProcTaskName()] = task
+		case WebhookTaskName():
+			taskState := NewWebhookTaskState(rootPath, broadcaster, taskChan)
+			task := NewWebhookTask(taskState)
+			t.tasks[WebhookTaskName()] = task
+		case UsageTaskName():
+			taskState := NewUsageTaskState(rootPath, broadcaster, taskChan)
+			task := NewUsageTask(taskState)
+			t.tasks[UsageTaskName()] = task
+		case HashTaskName():
+			taskState := NewHashTaskState(rootPath, broadcaster, taskChan)
+			task := NewHashTask(taskState)
+			t.tasks[HashTaskName()] = task
+		case ScrubTaskName():
+			taskState := NewScrubTaskState(rootPath, broadcaster, taskChan)
+			task := NewScrubTask(taskState)
+			t.tasks[ScrubTaskName()] = task
+		case FimTaskName():
+			taskState := NewFimTaskState(rootPath, broadcaster, taskChan)
+			task := NewFimTask(taskState)
+			t.tasks[FimTaskName()] = task
 		}
 	}
 }
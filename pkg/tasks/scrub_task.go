@@ -0,0 +1,494 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fsd/internal/config"
+	"fsd/pkg/hashing"
+	"fsd/pkg/ipc"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SCRUB_STATE_CREATE holds the progress of the current (or last) scrub pass, in a single row, so
+// that a pass picks up where it left off after a restart.
+const SCRUB_STATE_CREATE string = `
+	CREATE TABLE IF NOT EXISTS scrub_state (
+		id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+		pass INTEGER NOT NULL,
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME,
+		cursor TEXT NOT NULL,
+		files_total INTEGER NOT NULL,
+		files_scrubbed INTEGER NOT NULL,
+		files_skipped INTEGER NOT NULL,
+		bytes_scrubbed INTEGER NOT NULL,
+		corrupt_count INTEGER NOT NULL,
+		updated_at DATETIME NOT NULL
+	)
+`
+
+// SCRUB_RESULTS_CREATE records every file found to be corrupt.
+const SCRUB_RESULTS_CREATE string = `
+	CREATE TABLE IF NOT EXISTS scrub_results (
+		id INTEGER NOT NULL PRIMARY KEY,
+		pass INTEGER NOT NULL,
+		full_path TEXT NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		modified_at DATETIME NOT NULL,
+		expected_sha256 TEXT NOT NULL,
+		actual_sha256 TEXT NOT NULL,
+		hashed_at DATETIME,
+		detected_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS scrub_results_pass ON scrub_results (pass);
+`
+
+const (
+	// scrubBatchSize is how many files are read from the index at a time
+	scrubBatchSize = 100
+
+	// scrubSaveFiles and scrubSaveInterval are how often progress is saved during a pass,
+	// whichever comes first. A restart only has to redo what was scrubbed since.
+	scrubSaveFiles    = 100
+	scrubSaveInterval = 10 * time.Second
+
+	// scrubRetryMin and scrubRetryMax bound the wait before trying again after a failure,
+	// which doubles each time in between
+	scrubRetryMin = time.Minute
+	scrubRetryMax = time.Hour
+)
+
+func init() {
+	ipc.RegisterMessage(ScrubMessage{})
+}
+
+// ScrubMessage is broadcast when a scrub finds a file whose contents no longer match its
+// checksum.
+type ScrubMessage struct {
+	Name           string    `json:"event_name"`
+	Operation      ipc.FsdOp `json:"event_operation"`
+	Pass           int64     `json:"pass"`
+	SizeBytes      int64     `json:"size_bytes"`
+	ExpectedSHA256 string    `json:"expected_sha256"`
+	ActualSHA256   string    `json:"actual_sha256"`
+}
+
+func (m ScrubMessage) String() (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (m ScrubMessage) EventName() string {
+	return m.Name
+}
+
+func (m ScrubMessage) EventOperation() ipc.FsdOp {
+	return m.Operation
+}
+
+type ScrubTaskState struct {
+	// rootPath is the root path that we're watching
+	rootPath string
+
+	// broadcaster is a pointer to the broadcaster.
+	broadcaster *ipc.Broadcaster
+
+	// broadcastChannel is the broadcast channel for this task.
+	broadcastChannel chan ipc.Message
+
+	// db is the sqlite database handle
+	db *sql.DB
+
+	// hasher re-reads hashed files to compare them with what was stored, sharing its budget
+	// with hashing
+	hasher *hashing.Hasher
+
+	// interval is how long after a pass finishes the next one starts
+	interval time.Duration
+}
+
+func NewScrubTaskState(rootPath string, broadcaster *ipc.Broadcaster, broadcastChannel chan ipc.Message) *ScrubTaskState {
+	db, err := sql.Open("sqlite3", config.GetDBPath())
+	if err != nil {
+		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
+	}
+
+	_, err = db.Exec(SCRUB_STATE_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create scrub_state table", zap.Error(err))
+	}
+
+	_, err = db.Exec(SCRUB_RESULTS_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create scrub_results table", zap.Error(err))
+	}
+
+	return &ScrubTaskState{
+		rootPath:         rootPath,
+		broadcaster:      broadcaster,
+		broadcastChannel: broadcastChannel,
+		db:               db,
+		hasher:           sharedHasher(),
+		interval:         config.GetConfig().ScrubInterval,
+	}
+}
+
+// RootPath returns the root path of the project.
+func (st *ScrubTaskState) RootPath() string {
+	return st.rootPath
+}
+
+// Broadcaster returns a pointer to the broadcaster.
+func (st *ScrubTaskState) Broadcaster() *ipc.Broadcaster {
+	return st.broadcaster
+}
+
+// BroadcastChannel returns the broadcast channel for this task.
+func (st *ScrubTaskState) BroadcastChannel() chan ipc.Message {
+	return st.broadcastChannel
+}
+
+// scrubProgress mirrors the scrub_state row.
+type scrubProgress struct {
+	pass          int64
+	startedAt     time.Time
+	finishedAt    *time.Time
+	cursor        string
+	filesTotal    int64
+	filesScrubbed int64
+	filesSkipped  int64
+	bytesScrubbed int64
+	corruptCount  int64
+}
+
+// ScrubTask re-reads every file with a checksum every `scrub_interval`, looking for silent
+// corruption. The checksums are the ones stored by the hash task, which the index clears as soon
+// as a file's size, mtime or inode change, so a file that still has one is supposed to be
+// exactly as it was when it was hashed.
+type ScrubTask struct {
+	state *ScrubTaskState
+}
+
+func ScrubTaskName() string {
+	return "ScrubTask"
+}
+
+func NewScrubTask(state *ScrubTaskState) *ScrubTask {
+	return &ScrubTask{
+		state: state,
+	}
+}
+
+func (st *ScrubTask) StartEventLoop(ctx context.Context) {
+	// A pass reads back every hashed file and can run for days, so scrubLoop gets a goroutine
+	// of its own
+	go st.scrubLoop(ctx)
+
+	for {
+		select {
+		case event := <-st.state.BroadcastChannel():
+			if err := st.HandleMessage(ctx, event); err != nil {
+				zap.L().Error("error handling message", zap.String("task name", ScrubTaskName()), zap.Error(err))
+			}
+			st.state.broadcaster.Ack(ScrubTaskName(), event)
+		case <-ctx.Done():
+			zap.L().Info("got shutdown signal, exiting", zap.String("task name", ScrubTaskName()))
+			return
+		}
+	}
+}
+
+// HandleMessage handles a network message
+func (st *ScrubTask) HandleMessage(ctx context.Context, msg ipc.Message) error {
+	ms, err := msg.String()
+	if err != nil {
+		zap.L().Error("received invalid message", zap.Error(err))
+		return err
+	}
+	zap.L().Debug("got message", zap.String("task name", ScrubTaskName()), zap.String("msg", ms))
+
+	return nil
+}
+
+// SendMessage sends a message over the network
+func (st *ScrubTask) SendMessage(msg ipc.Message) error {
+	ms, err := msg.String()
+	if err != nil {
+		zap.L().Error("attempted to send an invalid message", zap.Error(err))
+		return err
+	}
+	zap.L().Debug("sent message", zap.String("task name", ScrubTaskName()), zap.String("msg", ms))
+	return nil
+}
+
+// scrubLoop resumes an unfinished pass, and then starts a new one every `scrub_interval`.
+// Failures are retried after a while, picking up from the last saved progress.
+func (st *ScrubTask) scrubLoop(ctx context.Context) {
+	retry := scrubRetryMin
+	for {
+		err := st.scrubNext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			retry = scrubRetryMin
+			continue
+		}
+
+		zap.L().Error("scrub failed, retrying later", zap.String("task name", ScrubTaskName()), zap.Duration("retry in", retry), zap.Error(err))
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+		retry = min(2*retry, scrubRetryMax)
+	}
+}
+
+// scrubNext waits until the next pass is due, if the last one finished, and runs it through to
+// the end.
+func (st *ScrubTask) scrubNext(ctx context.Context) error {
+	progress, ok, err := st.loadProgress(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load scrub progress: %w", err)
+	}
+
+	if ok && progress.finishedAt != nil {
+		wait := time.Until(progress.finishedAt.Add(st.state.interval))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if !ok || progress.finishedAt != nil {
+		progress, err = st.startPass(ctx, progress.pass+1)
+		if err != nil {
+			return fmt.Errorf("failed to start scrub pass: %w", err)
+		}
+	} else {
+		zap.L().Info("resuming scrub pass", zap.Int64("pass", progress.pass), zap.String("after", progress.cursor))
+	}
+
+	return st.runPass(ctx, &progress)
+}
+
+func (st *ScrubTask) loadProgress(ctx context.Context) (scrubProgress, bool, error) {
+	var p scrubProgress
+	err := st.state.db.QueryRowContext(ctx, `
+		SELECT pass, started_at, finished_at, cursor, files_total, files_scrubbed, files_skipped,
+			bytes_scrubbed, corrupt_count
+		FROM scrub_state WHERE id = 1
+	`).Scan(&p.pass, &p.startedAt, &p.finishedAt, &p.cursor, &p.filesTotal, &p.filesScrubbed,
+		&p.filesSkipped, &p.bytesScrubbed, &p.corruptCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, false, nil
+	}
+
+	return p, err == nil, err
+}
+
+func (st *ScrubTask) saveProgress(ctx context.Context, p scrubProgress) error {
+	_, err := st.state.db.ExecContext(ctx, `
+		INSERT INTO scrub_state (
+			id, pass, started_at, finished_at, cursor, files_total, files_scrubbed, files_skipped,
+			bytes_scrubbed, corrupt_count, updated_at
+		)
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			pass = excluded.pass,
+			started_at = excluded.started_at,
+			finished_at = excluded.finished_at,
+			cursor = excluded.cursor,
+			files_total = excluded.files_total,
+			files_scrubbed = excluded.files_scrubbed,
+			files_skipped = excluded.files_skipped,
+			bytes_scrubbed = excluded.bytes_scrubbed,
+			corrupt_count = excluded.corrupt_count,
+			updated_at = excluded.updated_at
+	`, p.pass, p.startedAt, p.finishedAt, p.cursor, p.filesTotal, p.filesScrubbed, p.filesSkipped,
+		p.bytesScrubbed, p.corruptCount, time.Now())
+	return err
+}
+
+// startPass begins pass number `pass` from the top of the root path.
+func (st *ScrubTask) startPass(ctx context.Context, pass int64) (scrubProgress, error) {
+	lo, hi := descendantRange(st.state.RootPath())
+	p := scrubProgress{pass: pass, startedAt: time.Now()}
+
+	// Only an estimate, since files come and go over the course of the pass
+	err := st.state.db.QueryRowContext(ctx, `
+		SELECT count(*) FROM metadata_current
+		WHERE file_type = ? AND sha256 IS NOT NULL AND full_path >= ? AND full_path < ?
+	`, fileTypeRegular, lo, hi).Scan(&p.filesTotal)
+	if err != nil {
+		return p, err
+	}
+
+	zap.L().Info("starting scrub pass", zap.Int64("pass", pass), zap.Int64("files", p.filesTotal))
+	return p, st.saveProgress(ctx, p)
+}
+
+// runPass scrubs the files after the cursor in path order, saving progress every so often
+// and whenever something turns out to be corrupt.
+func (st *ScrubTask) runPass(ctx context.Context, p *scrubProgress) error {
+	lo, hi := descendantRange(st.state.RootPath())
+	unsaved := 0
+	saved := time.Now()
+	for {
+		// The cursor starts out empty, which sorts before everything
+		after := max(p.cursor, lo)
+		rows, err := st.state.db.QueryContext(ctx, `
+			SELECT full_path FROM metadata_current
+			WHERE file_type = ? AND sha256 IS NOT NULL AND full_path > ? AND full_path < ?
+			ORDER BY full_path
+			LIMIT ?
+		`, fileTypeRegular, after, hi, scrubBatchSize)
+		if err != nil {
+			return err
+		}
+
+		var paths []string
+		for rows.Next() {
+			var path string
+			if err := rows.Scan(&path); err != nil {
+				rows.Close()
+				return err
+			}
+			paths = append(paths, path)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(paths) == 0 {
+			break
+		}
+
+		for _, path := range paths {
+			corrupt := p.corruptCount
+			if err := st.scrubFile(ctx, p, path); err != nil {
+				return err
+			}
+			p.cursor = path
+			unsaved++
+
+			// Corrupt files are saved straight away, so they aren't recorded twice if the
+			// pass has to pick up from before them
+			if unsaved < scrubSaveFiles && time.Since(saved) < scrubSaveInterval && p.corruptCount == corrupt {
+				continue
+			}
+			if err := st.saveProgress(ctx, *p); err != nil {
+				return err
+			}
+			unsaved = 0
+			saved = time.Now()
+		}
+	}
+
+	now := time.Now()
+	p.finishedAt = &now
+	if err := st.saveProgress(ctx, *p); err != nil {
+		return err
+	}
+
+	zap.L().Info("finished scrub pass",
+		zap.Int64("pass", p.pass),
+		zap.Int64("scrubbed", p.filesScrubbed),
+		zap.Int64("skipped", p.filesSkipped),
+		zap.Int64("corrupt", p.corruptCount),
+		zap.Duration("took", now.Sub(p.startedAt)))
+	return nil
+}
+
+// scrubFile rehashes `path` and compares it to the stored checksum. Files that have changed
+// since the index last saw them are skipped, the next pass will get them once they've been
+// hashed again.
+func (st *ScrubTask) scrubFile(ctx context.Context, p *scrubProgress, path string) error {
+	file, ok, err := lookupHashable(ctx, st.state.db, path)
+	if err != nil {
+		return err
+	}
+	if !ok || file.sha256 == "" {
+		p.filesSkipped++
+		return nil
+	}
+
+	before, err := os.Lstat(path)
+	if err != nil || !unchangedSince(before, file) {
+		p.filesSkipped++
+		return nil
+	}
+
+	sums, err := st.state.hasher.HashFile(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		p.filesSkipped++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	after, err := os.Lstat(path)
+	if err != nil || !unchangedSince(after, file) {
+		p.filesSkipped++
+		return nil
+	}
+
+	p.filesScrubbed++
+	p.bytesScrubbed += file.size
+	if sums.SHA256 == file.sha256 {
+		return nil
+	}
+
+	p.corruptCount++
+	zap.L().Warn("file is corrupt",
+		zap.String("path", path),
+		zap.String("expected sha256", file.sha256),
+		zap.String("actual sha256", sums.SHA256))
+
+	_, err = st.state.db.ExecContext(ctx, `
+		INSERT INTO scrub_results (
+			pass, full_path, size_bytes, modified_at, expected_sha256, actual_sha256, hashed_at, detected_at
+		)
+		SELECT ?, full_path, size_bytes, modified_at, ?, ?, hashed_at, ?
+		FROM metadata_current WHERE full_path = ?
+	`, p.pass, file.sha256, sums.SHA256, time.Now(), path)
+	if err != nil {
+		return err
+	}
+
+	st.state.broadcaster.Broadcast(ScrubMessage{
+		Name:           path,
+		Operation:      ipc.Corrupt,
+		Pass:           p.pass,
+		SizeBytes:      file.size,
+		ExpectedSHA256: file.sha256,
+		ActualSHA256:   sums.SHA256,
+	})
+	return nil
+}
+
+// unchangedSince reports whether `info` still matches what the index has for `file`.
+func unchangedSince(info os.FileInfo, file hashable) bool {
+	if info.Size() != file.size || !info.ModTime().Equal(file.modifiedAt) {
+		return false
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return !ok || st.Ino == file.inode
+}
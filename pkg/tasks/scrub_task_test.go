@@ -0,0 +1,206 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"fsd/pkg/hashing"
+	"fsd/pkg/ipc"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	const interval = time.Hour
+
+	tests := []struct {
+		name string
+
+		// saved is the progress left by an earlier run, with the cursor relative to the root
+		saved *scrubProgress
+
+		// corrupt are changed with their mtime put back, as the disk would, and changed are
+		// changed the way anyone would without the index catching up yet
+		corrupt []string
+		changed []string
+
+		wantPass     int64
+		wantScrubbed int64
+		wantSkipped  int64
+		wantCorrupt  []string
+	}{
+		{
+			name:         "clean",
+			wantPass:     1,
+			wantScrubbed: 3,
+		},
+		{
+			name:         "corrupt",
+			corrupt:      []string{"b"},
+			wantPass:     1,
+			wantScrubbed: 3,
+			wantCorrupt:  []string{"b"},
+		},
+		{
+			name:         "changed files are skipped",
+			changed:      []string{"a"},
+			corrupt:      []string{"c"},
+			wantPass:     1,
+			wantScrubbed: 2,
+			wantSkipped:  1,
+			wantCorrupt:  []string{"c"},
+		},
+		{
+			name:         "resumes after the cursor",
+			saved:        &scrubProgress{pass: 4, cursor: "a", filesScrubbed: 1},
+			corrupt:      []string{"a", "c"},
+			wantPass:     4,
+			wantScrubbed: 3,
+			wantCorrupt:  []string{"c"},
+		},
+		{
+			name:         "next pass once the interval is up",
+			saved:        &scrubProgress{pass: 4, cursor: "c", finishedAt: ptr(time.Now().Add(-interval - time.Second))},
+			corrupt:      []string{"a"},
+			wantPass:     5,
+			wantScrubbed: 3,
+			wantCorrupt:  []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			root := t.TempDir()
+			for _, name := range []string{"a", "b", "c"} {
+				if err := os.WriteFile(filepath.Join(root, name), []byte("contents of "+name), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ix := newTestIndex(t)
+			if err := ix.SyncTree(ctx, root); err != nil {
+				t.Fatal(err)
+			}
+			for _, create := range []string{SCRUB_STATE_CREATE, SCRUB_RESULTS_CREATE} {
+				if _, err := ix.db.Exec(create); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			hasher := hashing.NewHasher(0)
+			for _, name := range []string{"a", "b", "c"} {
+				file, _, err := lookupHashable(ctx, ix.db, filepath.Join(root, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := hashFile(ctx, ix.db, hasher, file); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			logDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "events.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { logDB.Close() })
+			broadcaster := ipc.NewBroadcasterWithDB(logDB)
+
+			st := NewScrubTask(&ScrubTaskState{
+				rootPath:    root,
+				broadcaster: broadcaster,
+				db:          ix.db,
+				hasher:      hasher,
+				interval:    interval,
+			})
+
+			if tt.saved != nil {
+				saved := *tt.saved
+				saved.cursor = filepath.Join(root, saved.cursor)
+				if err := st.saveProgress(ctx, saved); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, name := range tt.corrupt {
+				path := filepath.Join(root, name)
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("CONTENTS OF "+name), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, time.Time{}, info.ModTime()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range tt.changed {
+				if err := os.WriteFile(filepath.Join(root, name), []byte("changed"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := st.scrubNext(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			progress, ok, err := st.loadProgress(ctx)
+			if err != nil || !ok {
+				t.Fatalf("got progress %v, error %v", ok, err)
+			}
+			if progress.finishedAt == nil {
+				t.Error("got an unfinished pass")
+			}
+			if progress.pass != tt.wantPass || progress.filesScrubbed != tt.wantScrubbed || progress.filesSkipped != tt.wantSkipped {
+				t.Errorf("got pass %d with %d scrubbed and %d skipped, want pass %d with %d scrubbed and %d skipped",
+					progress.pass, progress.filesScrubbed, progress.filesSkipped, tt.wantPass, tt.wantScrubbed, tt.wantSkipped)
+			}
+			if progress.corruptCount != int64(len(tt.wantCorrupt)) {
+				t.Errorf("got %d corrupt, want %d", progress.corruptCount, len(tt.wantCorrupt))
+			}
+
+			rows, err := ix.db.Query(`SELECT pass, full_path, expected_sha256, actual_sha256 FROM scrub_results ORDER BY full_path`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			var recorded []string
+			for rows.Next() {
+				var pass int64
+				var path, expected, actual string
+				if err := rows.Scan(&pass, &path, &expected, &actual); err != nil {
+					t.Fatal(err)
+				}
+				if pass != tt.wantPass || expected == actual {
+					t.Errorf("got %s recorded in pass %d with %s expected and %s found", path, pass, expected, actual)
+				}
+				recorded = append(recorded, filepath.Base(path))
+			}
+			if !slices.Equal(recorded, tt.wantCorrupt) {
+				t.Errorf("got %v recorded as corrupt, want %v", recorded, tt.wantCorrupt)
+			}
+
+			events, err := broadcaster.ReadLog(ctx, 0, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var broadcast []string
+			for _, event := range events {
+				if event.EventOperation() == ipc.Corrupt {
+					broadcast = append(broadcast, filepath.Base(event.EventName()))
+				}
+			}
+			if !slices.Equal(broadcast, tt.wantCorrupt) {
+				t.Errorf("got %v broadcast as corrupt, want %v", broadcast, tt.wantCorrupt)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,344 @@
+package tasks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"fsd/internal/config"
+	"fsd/pkg/ipc"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// USAGE_CREATE creates the per-user and per-group usage history. Each snapshot is a set of rows
+// sharing a created_at, one per owner of anything under the root path, much like disk_stats
+// is for the filesystem as a whole.
+const USAGE_CREATE string = `
+	CREATE TABLE IF NOT EXISTS usage_users (
+		id INTEGER NOT NULL PRIMARY KEY,
+		uid INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		apparent_bytes INTEGER NOT NULL,
+		allocated_bytes INTEGER NOT NULL,
+		file_count INTEGER NOT NULL,
+		dir_count INTEGER NOT NULL,
+		largest_files TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS usage_users_created_at ON usage_users (created_at);
+	CREATE INDEX IF NOT EXISTS usage_users_uid ON usage_users (uid, created_at);
+
+	CREATE TABLE IF NOT EXISTS usage_groups (
+		id INTEGER NOT NULL PRIMARY KEY,
+		gid INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		apparent_bytes INTEGER NOT NULL,
+		allocated_bytes INTEGER NOT NULL,
+		file_count INTEGER NOT NULL,
+		dir_count INTEGER NOT NULL,
+		largest_files TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS usage_groups_created_at ON usage_groups (created_at);
+	CREATE INDEX IF NOT EXISTS usage_groups_gid ON usage_groups (gid, created_at);
+`
+
+// usageKind is one of the two ways usage is rolled up.
+type usageKind struct {
+	table      string
+	idColumn   string
+	nameColumn string
+}
+
+var (
+	usageByUser  = usageKind{table: "usage_users", idColumn: "uid", nameColumn: "owner_name"}
+	usageByGroup = usageKind{table: "usage_groups", idColumn: "gid", nameColumn: "group_name"}
+)
+
+// UsageFile is one of an owner's largest files at the time of a snapshot.
+type UsageFile struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// usageRow is an owner's totals in a single snapshot.
+type usageRow struct {
+	id        int64
+	name      string
+	apparent  int64
+	allocated int64
+	files     int64
+	dirs      int64
+	largest   []UsageFile
+}
+
+type UsageTaskState struct {
+	// rootPath is the root path that we're watching
+	rootPath string
+
+	// broadcaster is a pointer to the broadcaster.
+	broadcaster *ipc.Broadcaster
+
+	// broadcastChannel is the broadcast channel for this task.
+	broadcastChannel chan ipc.Message
+
+	// db is the sqlite database handle
+	db *sql.DB
+}
+
+func NewUsageTaskState(rootPath string, broadcaster *ipc.Broadcaster, broadcastChannel chan ipc.Message) *UsageTaskState {
+	db, err := sql.Open("sqlite3", config.GetDBPath())
+	if err != nil {
+		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
+	}
+
+	// The snapshots are taken from the index, so make sure it's there even if we beat the
+	// metadata task to it.
+	_, err = db.Exec(METADATA_CURRENT_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create metadata_current table", zap.Error(err))
+	}
+
+	_, err = db.Exec(USAGE_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create usage tables", zap.Error(err))
+	}
+
+	return &UsageTaskState{
+		rootPath:         rootPath,
+		broadcaster:      broadcaster,
+		broadcastChannel: broadcastChannel,
+		db:               db,
+	}
+}
+
+// RootPath returns the root path of the project.
+func (ut *UsageTaskState) RootPath() string {
+	return ut.rootPath
+}
+
+// Broadcaster returns a pointer to the broadcaster.
+func (ut *UsageTaskState) Broadcaster() *ipc.Broadcaster {
+	return ut.broadcaster
+}
+
+// BroadcastChannel returns the broadcast channel for this task.
+func (ut *UsageTaskState) BroadcastChannel() chan ipc.Message {
+	return ut.broadcastChannel
+}
+
+// UsageTask periodically rolls the metadata index up by owning user and group.
+type UsageTask struct {
+	state *UsageTaskState
+}
+
+func UsageTaskName() string {
+	return "UsageTask"
+}
+
+func NewUsageTask(state *UsageTaskState) *UsageTask {
+	return &UsageTask{
+		state: state,
+	}
+}
+
+func (ut *UsageTask) StartEventLoop(ctx context.Context) {
+	// No snapshot at startup, the index is still catching up with whatever changed while we
+	// were down until the first reconciliation finishes.
+	ticker := time.NewTicker(config.GetConfig().UsageSnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-ut.state.BroadcastChannel():
+			if err := ut.HandleMessage(ctx, event); err != nil {
+				zap.L().Error("error handling message", zap.String("task name", UsageTaskName()), zap.Error(err))
+			}
+			ut.state.broadcaster.Ack(UsageTaskName(), event)
+		case <-ticker.C:
+			if err := ut.Snapshot(ctx); err != nil {
+				zap.L().Error("error taking usage snapshot", zap.String("task name", UsageTaskName()), zap.Error(err))
+			}
+		case <-ctx.Done():
+			zap.L().Info("got shutdown signal, exiting", zap.String("task name", UsageTaskName()))
+			return
+		}
+	}
+}
+
+// HandleMessage handles a network message
+func (ut *UsageTask) HandleMessage(ctx context.Context, msg ipc.Message) error {
+	if msg.EventOperation() == ipc.Compact {
+		return ut.doCompaction(ctx)
+	}
+
+	return nil
+}
+
+// SendMessage sends a message over the network
+func (ut *UsageTask) SendMessage(msg ipc.Message) error {
+	ms, err := msg.String()
+	if err != nil {
+		zap.L().Error("attempted to send an invalid message", zap.Error(err))
+		return err
+	}
+	zap.L().Debug("sent message", zap.String("task name", UsageTaskName()), zap.String("msg", ms))
+	return nil
+}
+
+// doCompaction drops snapshots older than the usage retention, keeping them forever if
+// there's no retention.
+func (ut *UsageTask) doCompaction(ctx context.Context) error {
+	retention := config.GetConfig().UsageRetention
+	if retention <= 0 {
+		return nil
+	}
+
+	thresh := time.Now().Add(-retention)
+	for _, kind := range []usageKind{usageByUser, usageByGroup} {
+		result, err := ut.state.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE created_at < ?`, kind.table), thresh)
+		if err != nil {
+			return err
+		}
+
+		rowsDeleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		zap.L().Info("deleted old records", zap.String("table name", kind.table), zap.Int64("rows deleted", rowsDeleted))
+	}
+
+	return nil
+}
+
+// Snapshot records the current usage of every user and group that owns something under the
+// root path.
+func (ut *UsageTask) Snapshot(ctx context.Context) error {
+	now := time.Now()
+	for _, kind := range []usageKind{usageByUser, usageByGroup} {
+		rows, err := ut.rollUp(ctx, kind)
+		if err != nil {
+			return fmt.Errorf("failed to roll up %s: %w", kind.table, err)
+		}
+
+		if err := ut.insert(ctx, kind, rows, now); err != nil {
+			return fmt.Errorf("failed to insert into %s: %w", kind.table, err)
+		}
+	}
+
+	return nil
+}
+
+// rollUp adds up everything indexed under the root path by owner. Like metadata_tree, sizes
+// are counted per path, so a file with several hardlinks counts once for each.
+func (ut *UsageTask) rollUp(ctx context.Context, kind usageKind) ([]*usageRow, error) {
+	root := ut.state.RootPath()
+	lo, hi := descendantRange(root)
+
+	rows, err := ut.state.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT
+			%[1]s,
+			coalesce(max(%[2]s), ''),
+			sum(size_bytes),
+			sum(allocated_bytes),
+			sum(is_directory = 0),
+			sum(is_directory = 1)
+		FROM metadata_current
+		WHERE %[1]s IS NOT NULL AND (full_path = ? OR (full_path >= ? AND full_path < ?))
+		GROUP BY %[1]s
+		ORDER BY %[1]s
+	`, kind.idColumn, kind.nameColumn), root, lo, hi)
+	if err != nil {
+		return nil, err
+	}
+
+	var usage []*usageRow
+	byID := make(map[int64]*usageRow)
+	for rows.Next() {
+		row := &usageRow{largest: []UsageFile{}}
+		if err := rows.Scan(&row.id, &row.name, &row.apparent, &row.allocated, &row.files, &row.dirs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		usage = append(usage, row)
+		byID[row.id] = row
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	limit := config.GetConfig().UsageLargestFiles
+	if limit <= 0 || len(usage) == 0 {
+		return usage, nil
+	}
+
+	rows, err = ut.state.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %[1]s, full_path, size_bytes FROM (
+			SELECT %[1]s, full_path, size_bytes,
+				row_number() OVER (PARTITION BY %[1]s ORDER BY size_bytes DESC, full_path) AS rank
+			FROM metadata_current
+			WHERE is_directory = 0 AND %[1]s IS NOT NULL
+				AND (full_path >= ? AND full_path < ?)
+		)
+		WHERE rank <= ?
+		ORDER BY %[1]s, rank
+	`, kind.idColumn), lo, hi, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var file UsageFile
+		if err := rows.Scan(&id, &file.Path, &file.SizeBytes); err != nil {
+			return nil, err
+		}
+		if row, ok := byID[id]; ok {
+			row.largest = append(row.largest, file)
+		}
+	}
+
+	return usage, rows.Err()
+}
+
+func (ut *UsageTask) insert(ctx context.Context, kind usageKind, usage []*usageRow, now time.Time) error {
+	if len(usage) == 0 {
+		return nil
+	}
+
+	tx, err := ut.state.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s(%s, name, apparent_bytes, allocated_bytes, file_count, dir_count, largest_files, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, kind.table, kind.idColumn))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range usage {
+		largest, err := json.Marshal(row.largest)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = stmt.ExecContext(ctx, row.id, row.name, row.apparent, row.allocated, row.files, row.dirs, string(largest), now)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
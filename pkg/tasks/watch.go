@@ -0,0 +1,76 @@
+package tasks
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// WatchRecursive walks `root` and registers every directory underneath it (including `root`
+// itself) with the watcher. Directories that cannot be read are skipped with a warning so a
+// single bad permission does not take down the whole tree. It returns the number of
+// directories that were added.
+func WatchRecursive(watcher *fsnotify.Watcher, root string) (int, error) {
+	added := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The root itself must be watchable, anything else we can live without.
+			if path == root {
+				return err
+			}
+
+			zap.L().Warn("skipping unreadable path", zap.String("path", path), zap.Error(err))
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if err := watcher.Add(path); err != nil {
+			if path == root {
+				return err
+			}
+
+			zap.L().Warn("failed to watch directory", zap.String("path", path), zap.Error(err))
+			return filepath.SkipDir
+		}
+
+		zap.L().Debug("watching directory", zap.String("path", path))
+		added++
+		return nil
+	})
+
+	return added, err
+}
+
+// UnwatchRecursive removes the watch on `root` along with any watches on directories beneath
+// it. This is used when a directory is removed or renamed out from under us, since inotify
+// keeps the watch attached to the inode rather than the path.
+func UnwatchRecursive(watcher *fsnotify.Watcher, root string) int {
+	removed := 0
+	prefix := root + string(filepath.Separator)
+	for _, path := range watcher.WatchList() {
+		if path != root && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+
+		// The kernel may have already dropped the watch for us (e.g. IN_DELETE_SELF)
+		if err := watcher.Remove(path); err != nil && !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+			zap.L().Warn("failed to remove watch", zap.String("path", path), zap.Error(err))
+			continue
+		}
+
+		zap.L().Debug("removed watch", zap.String("path", path))
+		removed++
+	}
+
+	return removed
+}
@@ -0,0 +1,436 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fsd/internal/config"
+	"fsd/pkg/ipc"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WEBHOOK_DELIVERIES_CREATE is the outbox of webhook requests that haven't gone out yet. Matched
+// events land here first so a slow or dead target never holds up the broadcaster.
+const WEBHOOK_DELIVERIES_CREATE string = `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER NOT NULL PRIMARY KEY,
+		webhook TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		last_error TEXT,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhook, id);
+`
+
+// WEBHOOK_DEAD_LETTERS_CREATE holds deliveries that ran out of attempts.
+const WEBHOOK_DEAD_LETTERS_CREATE string = `
+	CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+		id INTEGER NOT NULL PRIMARY KEY,
+		webhook TEXT NOT NULL,
+		url TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT,
+		created_at DATETIME NOT NULL,
+		failed_at DATETIME NOT NULL
+	)
+`
+
+const (
+	// webhookSignatureHeader carries "sha256=<hex hmac>" of the request body
+	webhookSignatureHeader = "X-Fsd-Signature-256"
+
+	// webhookBaseBackoff is the delay after the first failed attempt, doubling from there
+	webhookBaseBackoff = time.Second
+)
+
+// webhookFsOps are the operations a webhook gets when it doesn't list any.
+var webhookFsOps = []ipc.FsdOp{ipc.Create, ipc.Write, ipc.Remove, ipc.Rename, ipc.Chmod, ipc.Move, ipc.Settled}
+
+// webhook is a configured target along with its parsed filter.
+type webhook struct {
+	name   string
+	url    string
+	secret string
+
+	// filter selects filesystem events, proc completions bypass the path filters
+	filter         ipc.Filter
+	procCompletion bool
+
+	// wake nudges the delivery worker when something new is queued
+	wake chan struct{}
+}
+
+func newWebhook(cfg config.WebhookConfig) (*webhook, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("url is required")
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = cfg.URL
+	}
+
+	filter := ipc.Filter{
+		Prefixes:   cfg.Prefixes,
+		Globs:      cfg.Globs,
+		Operations: make(map[ipc.FsdOp]bool),
+	}
+	for _, name := range cfg.Ops {
+		op, err := ipc.ParseFsdOp(name)
+		if err != nil {
+			return nil, err
+		}
+		filter.Operations[op] = true
+	}
+
+	if len(filter.Operations) == 0 {
+		for _, op := range webhookFsOps {
+			filter.Operations[op] = true
+		}
+	}
+
+	return &webhook{
+		name:           name,
+		url:            cfg.URL,
+		secret:         cfg.Secret,
+		filter:         filter,
+		procCompletion: cfg.ProcCompletion || filter.Operations[ipc.ProcCompleted],
+		wake:           make(chan struct{}, 1),
+	}, nil
+}
+
+func (w *webhook) match(msg ipc.Message) bool {
+	if msg.EventOperation() == ipc.ProcCompleted {
+		return w.procCompletion
+	}
+
+	return w.filter.Match(msg)
+}
+
+// sign returns the signature header value for `body`, or "" if the webhook has no secret.
+func (w *webhook) sign(body []byte) string {
+	if w.secret == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(w.secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns how long to wait after `attempts` failures, up to `maxBackoff`, with
+// some jitter so that a target coming back up isn't hit by everything at once.
+func webhookBackoff(attempts int, maxBackoff time.Duration) time.Duration {
+	backoff := maxBackoff
+	if attempts < 30 {
+		backoff = min(webhookBaseBackoff<<(attempts-1), backoff)
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+type WebhookTaskState struct {
+	// rootPath is the root path that we're watching
+	rootPath string
+
+	// broadcaster is a pointer to the broadcaster.
+	broadcaster *ipc.Broadcaster
+
+	// broadcastChannel is the broadcast channel for this task.
+	broadcastChannel chan ipc.Message
+
+	// db is the sqlite database handle
+	db *sql.DB
+
+	// webhooks are the configured targets
+	webhooks []*webhook
+
+	// client sends the requests
+	client *http.Client
+
+	// maxAttempts and maxBackoff are `webhook_max_attempts` and `webhook_max_backoff`
+	maxAttempts int
+	maxBackoff  time.Duration
+}
+
+func NewWebhookTaskState(rootPath string, broadcaster *ipc.Broadcaster, broadcastChannel chan ipc.Message) *WebhookTaskState {
+	db, err := sql.Open("sqlite3", config.GetDBPath())
+	if err != nil {
+		zap.L().Fatal("failed to open sqlite database", zap.Error(err))
+	}
+
+	_, err = db.Exec(WEBHOOK_DELIVERIES_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create webhook_deliveries table", zap.Error(err))
+	}
+
+	_, err = db.Exec(WEBHOOK_DEAD_LETTERS_CREATE)
+	if err != nil {
+		zap.L().Fatal("failed to create webhook_dead_letters table", zap.Error(err))
+	}
+
+	var webhooks []*webhook
+	for i, cfg := range config.GetConfig().Webhooks {
+		hook, err := newWebhook(cfg)
+		if err != nil {
+			zap.L().Error("skipping invalid webhook", zap.Int("index", i), zap.String("name", cfg.Name), zap.Error(err))
+			continue
+		}
+		webhooks = append(webhooks, hook)
+	}
+
+	return &WebhookTaskState{
+		rootPath:         rootPath,
+		broadcaster:      broadcaster,
+		broadcastChannel: broadcastChannel,
+		db:               db,
+		webhooks:         webhooks,
+		client:           &http.Client{Timeout: config.GetConfig().WebhookTimeout},
+		maxAttempts:      config.GetConfig().WebhookMaxAttempts,
+		maxBackoff:       config.GetConfig().WebhookMaxBackoff,
+	}
+}
+
+func (wt *WebhookTaskState) RootPath() string {
+	return wt.rootPath
+}
+
+func (wt *WebhookTaskState) Broadcaster() *ipc.Broadcaster {
+	return wt.broadcaster
+}
+
+func (wt *WebhookTaskState) BroadcastChannel() chan ipc.Message {
+	return wt.broadcastChannel
+}
+
+// WebhookTask POSTs matching messages to the configured webhook targets. Messages are queued in
+// the webhook_deliveries table and sent in order by one worker per target, which retries with
+// exponential backoff and gives up to webhook_dead_letters after `webhook_max_attempts`.
+type WebhookTask struct {
+	state *WebhookTaskState
+}
+
+func WebhookTaskName() string {
+	return "WebhookTask"
+}
+
+func NewWebhookTask(state *WebhookTaskState) *WebhookTask {
+	return &WebhookTask{
+		state: state,
+	}
+}
+
+func (wt *WebhookTask) StartEventLoop(ctx context.Context) {
+	for _, hook := range wt.state.webhooks {
+		zap.L().Info("starting webhook delivery", zap.String("webhook", hook.name), zap.String("url", hook.url))
+		go wt.deliverLoop(ctx, hook)
+	}
+
+	for {
+		select {
+		case event := <-wt.state.BroadcastChannel():
+			if err := wt.HandleMessage(ctx, event); err != nil {
+				zap.L().Error("error handling message", zap.String("task name", WebhookTaskName()), zap.Error(err))
+			}
+			wt.state.broadcaster.Ack(WebhookTaskName(), event)
+		case <-ctx.Done():
+			zap.L().Info("got shutdown signal, exiting", zap.String("task name", WebhookTaskName()))
+			return
+		}
+	}
+}
+
+// HandleMessage queues a delivery for every webhook that `msg` matches.
+func (wt *WebhookTask) HandleMessage(ctx context.Context, msg ipc.Message) error {
+	var payload []byte
+	for _, hook := range wt.state.webhooks {
+		if !hook.match(msg) {
+			continue
+		}
+
+		if payload == nil {
+			event, ok := msg.(ipc.Event)
+			if !ok {
+				event = ipc.Event{Timestamp: time.Now(), Message: msg}
+			}
+
+			var err error
+			payload, err = json.Marshal(event)
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		_, err := wt.state.db.ExecContext(ctx, `
+			INSERT INTO webhook_deliveries (webhook, seq, payload, attempts, next_attempt_at, created_at)
+			VALUES (?, ?, ?, 0, ?, ?)
+		`, hook.name, ipc.Sequence(msg), string(payload), now, now)
+		if err != nil {
+			return fmt.Errorf("failed to queue delivery for %s: %w", hook.name, err)
+		}
+
+		select {
+		case hook.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// SendMessage implements Task.
+func (wt *WebhookTask) SendMessage(msg ipc.Message) error {
+	return nil
+}
+
+// deliverLoop sends the queued deliveries for `hook` oldest first. A failing delivery holds
+// back the ones behind it so the target always sees events in order.
+func (wt *WebhookTask) deliverLoop(ctx context.Context, hook *webhook) {
+	for {
+		wait, err := wt.deliverNext(ctx, hook)
+		if err != nil {
+			zap.L().Error("webhook delivery failed", zap.String("webhook", hook.name), zap.Error(err))
+			wait = time.Second
+		}
+
+		if wait == 0 {
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-hook.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// deliverNext attempts the oldest queued delivery for `hook`, returning how long to wait before
+// the next one. With nothing queued it waits for a wake up, or a minute as a fallback.
+func (wt *WebhookTask) deliverNext(ctx context.Context, hook *webhook) (time.Duration, error) {
+	var id, seq int64
+	var attempts int
+	var payload string
+	var nextAttemptAt, createdAt time.Time
+	err := wt.state.db.QueryRowContext(ctx, `
+		SELECT id, seq, payload, attempts, next_attempt_at, created_at FROM webhook_deliveries
+		WHERE webhook = ? ORDER BY id LIMIT 1
+	`, hook.name).Scan(&id, &seq, &payload, &attempts, &nextAttemptAt, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Minute, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if wait := time.Until(nextAttemptAt); wait > 0 {
+		return wait, nil
+	}
+
+	sendErr := wt.post(ctx, hook, id, []byte(payload))
+	if sendErr == nil {
+		_, err := wt.state.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE id = ?`, id)
+		return 0, err
+	}
+
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	attempts++
+	if attempts >= wt.state.maxAttempts {
+		zap.L().Error("giving up on webhook delivery",
+			zap.String("webhook", hook.name),
+			zap.Int64("seq", seq),
+			zap.Int("attempts", attempts),
+			zap.Error(sendErr))
+		return 0, wt.deadLetter(ctx, hook, id, seq, payload, attempts, sendErr, createdAt)
+	}
+
+	backoff := webhookBackoff(attempts, wt.state.maxBackoff)
+	zap.L().Warn("webhook delivery failed, retrying",
+		zap.String("webhook", hook.name),
+		zap.Int64("seq", seq),
+		zap.Int("attempts", attempts),
+		zap.Duration("backoff", backoff),
+		zap.Error(sendErr))
+
+	_, err = wt.state.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?
+	`, attempts, time.Now().Add(backoff), sendErr.Error(), id)
+	return backoff, err
+}
+
+// post sends a single delivery. Anything other than a 2xx response counts as a failure.
+func (wt *WebhookTask) post(ctx context.Context, hook *webhook, id int64, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fsd-webhook")
+	req.Header.Set("X-Fsd-Delivery", strconv.FormatInt(id, 10))
+	if signature := hook.sign(body); signature != "" {
+		req.Header.Set(webhookSignatureHeader, signature)
+	}
+
+	res, err := wt.state.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	return nil
+}
+
+func (wt *WebhookTask) deadLetter(ctx context.Context, hook *webhook, id, seq int64, payload string, attempts int, sendErr error, createdAt time.Time) error {
+	tx, err := wt.state.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webhook_dead_letters (webhook, url, seq, payload, attempts, last_error, created_at, failed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, hook.name, hook.url, seq, payload, attempts, sendErr.Error(), createdAt, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE id = ?`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
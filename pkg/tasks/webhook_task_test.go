@@ -0,0 +1,167 @@
+package tasks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fsd/internal/config"
+	"fsd/pkg/ipc"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestWebhookTask returns a task with a single webhook posting to `url`, backed by a fresh
+// database.
+func newTestWebhookTask(t *testing.T, url, secret string, maxAttempts int) (*WebhookTask, *webhook) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "fsd.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, create := range []string{WEBHOOK_DELIVERIES_CREATE, WEBHOOK_DEAD_LETTERS_CREATE} {
+		if _, err := db.Exec(create); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hook, err := newWebhook(config.WebhookConfig{Name: "test", URL: url, Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewWebhookTask(&WebhookTaskState{
+		db:          db,
+		webhooks:    []*webhook{hook},
+		client:      &http.Client{Timeout: time.Second},
+		maxAttempts: maxAttempts,
+		maxBackoff:  time.Minute,
+	}), hook
+}
+
+func TestWebhookSignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{name: "signed", secret: "s3cret"},
+		{name: "unsigned"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			var signature string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = io.ReadAll(r.Body)
+				signature = r.Header.Get(webhookSignatureHeader)
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			wt, hook := newTestWebhookTask(t, server.URL, tt.secret, 3)
+			msg := ipc.Event{Seq: 1, Timestamp: time.Now(), Message: FsMessage{Name: "/a", Operation: ipc.Write, Count: 1}}
+			if err := wt.HandleMessage(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.deliverNext(ctx, hook); err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(string(body), `"seq":1`) {
+				t.Errorf("got body %s, want the event", body)
+			}
+
+			want := ""
+			if tt.secret != "" {
+				mac := hmac.New(sha256.New, []byte(tt.secret))
+				mac.Write(body)
+				want = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			}
+			if signature != want {
+				t.Errorf("got signature %q, want %q", signature, want)
+			}
+		})
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts   int
+		maxBackoff time.Duration
+		want       time.Duration
+	}{
+		{attempts: 1, maxBackoff: time.Hour, want: time.Second},
+		{attempts: 2, maxBackoff: time.Hour, want: 2 * time.Second},
+		{attempts: 5, maxBackoff: time.Hour, want: 16 * time.Second},
+		{attempts: 5, maxBackoff: 10 * time.Second, want: 10 * time.Second},
+		{attempts: 29, maxBackoff: time.Hour, want: time.Hour},
+		{attempts: 100, maxBackoff: time.Hour, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		// The jitter takes off up to half
+		for range 100 {
+			got := webhookBackoff(tt.attempts, tt.maxBackoff)
+			if got < tt.want/2 || got > tt.want {
+				t.Fatalf("webhookBackoff(%d, %s) = %s, want between %s and %s", tt.attempts, tt.maxBackoff, got, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	const maxAttempts = 3
+	ctx := context.Background()
+	wt, hook := newTestWebhookTask(t, server.URL, "", maxAttempts)
+	if err := wt.HandleMessage(ctx, FsMessage{Name: "/a", Operation: ipc.Write, Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		wait, err := wt.deliverNext(ctx, hook)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt < maxAttempts && wait <= 0 {
+			t.Errorf("attempt %d: got no backoff", attempt)
+		}
+
+		// Skip the backoff
+		if _, err := wt.state.db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = ?`, time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var queued int
+	if err := wt.state.db.QueryRow(`SELECT count(*) FROM webhook_deliveries`).Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != 0 {
+		t.Errorf("got %d deliveries still queued, want none", queued)
+	}
+
+	var attempts int
+	var lastError string
+	err := wt.state.db.QueryRow(`SELECT attempts, last_error FROM webhook_dead_letters`).Scan(&attempts, &lastError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != maxAttempts || !strings.Contains(lastError, "500") {
+		t.Errorf("got %d attempts and error %q, want %d attempts and the status", attempts, lastError, maxAttempts)
+	}
+}
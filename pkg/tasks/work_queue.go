@@ -0,0 +1,64 @@
+package tasks
+
+import "sync"
+
+// workQueue is the set of paths a task has yet to get to, each with whatever it needs to know
+// about the path. A path that's queued again while it's still waiting is only done once.
+type workQueue[T any] struct {
+	lock    sync.Mutex
+	pending map[string]T
+
+	// max caps how many paths can be waiting, with no cap if it's 0
+	max int
+
+	// merge combines what's queued for a path that's already waiting with what was there
+	merge func(existing, queued T) T
+
+	// wake is sent on when something new is pending
+	wake chan struct{}
+}
+
+func newWorkQueue[T any](max int, merge func(existing, queued T) T) *workQueue[T] {
+	return &workQueue[T]{
+		pending: make(map[string]T),
+		max:     max,
+		merge:   merge,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// add queues `path`, unless the queue is full. It reports whether it was queued.
+func (q *workQueue[T]) add(path string, value T) bool {
+	q.lock.Lock()
+	existing, ok := q.pending[path]
+	if !ok && q.max > 0 && len(q.pending) >= q.max {
+		q.lock.Unlock()
+		return false
+	}
+	if ok {
+		value = q.merge(existing, value)
+	}
+	q.pending[path] = value
+	q.lock.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// next takes a path off the queue.
+func (q *workQueue[T]) next() (string, T, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for path, value := range q.pending {
+		delete(q.pending, path)
+		return path, value, true
+	}
+
+	var zero T
+	return "", zero, false
+}